@@ -50,23 +50,105 @@ func main() {
 	// create the auth service with configured PASETO provider
 	authSvc := services.NewAuthorizationService(pstp, s)
 
+	// create the quota service (counting usage toward the configured quotas)
+	qtaSvc, err := services.NewQuotaService(s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create quota service")
+	}
+
+	// create the rate limit service (limiting requests per client, runner and
+	// token subject)
+	rtlSvc, err := services.NewRateLimitService(s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create rate limit service")
+	}
+
+	// create the tracing service (exporting a span for each step of the
+	// request, when an exporter is configured)
+	trcSvc, err := services.NewTracingService(s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create tracing service")
+	}
+	defer trcSvc.Shutdown()
+
+	// create the access log service (writing a record of each request, when
+	// an access log path is configured)
+	alSvc, err := services.NewAccessLogService(s)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create access log service")
+	}
+	defer alSvc.Close()
+
+	// create the usage service (recording token usage reported by runners)
+	usgSvc, err := services.NewUsageService(s, qtaSvc)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create usage service")
+	}
+
 	// create gateway service
-	gtwySvc := services.NewGatewayService(s)
+	gtwySvc := services.NewGatewayService(s, usgSvc)
+
+	// create the catalog service and begin polling runners for their models
+	ctlgSvc := services.NewCatalogService(s)
+	if s.ModelRouting.Path != "" {
+		ctlgSvc.Start()
+	}
+
+	// create the readiness service (reporting on keys, TLS and runner health)
+	tlsSvc := services.NewTLSService(s)
+	rdySvc := services.NewReadinessService(s, authSvc, gtwySvc, tlsSvc)
 
 	// register routes
-	hndlr, err := routers.Register(s, authSvc, gtwySvc)
+	hndlr, err := routers.Register(s, routers.Services{
+		AccessLog:     alSvc,
+		Authorization: authSvc,
+		Catalog:       ctlgSvc,
+		Gateway:       gtwySvc,
+		Quota:         qtaSvc,
+		RateLimit:     rtlSvc,
+		Readiness:     rdySvc,
+		Tracing:       trcSvc,
+		Usage:         usgSvc,
+	})
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to register routes")
 	}
 
+	// begin probing runner hosts, now that the routes have been registered
+	if s.HealthCheck.Path != "" {
+		gtwySvc.StartHealthChecks()
+	}
+
+	// serve metrics on a separate admin listener, when configured
+	if addr := s.Metrics.Address; addr != "" {
+		mtrcSvc := services.NewMetricsService(s, gtwySvc)
+
+		log.Info().
+			Str("address", addr).
+			Msg("Starting metrics server...")
+
+		go func() {
+			if err := fasthttp.ListenAndServe(addr, mtrcSvc.Handler()); err != nil {
+				log.Fatal().Err(err).Msg("Failed to start metrics server")
+			}
+		}()
+	}
+
 	// start server
 	log.Info().
 		Str("address", s.Server.Address).
 		Msg("Starting server...")
 
+	// create a TCP listener on the specified port
+	lstnr, err := net.Listen("tcp", s.Server.Address)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to listen on address")
+	}
+	defer lstnr.Close()
+
 	if s.Server.CertificatePath == "" {
-		// start HTTP server
-		if err := fasthttp.ListenAndServe(s.Server.Address, hndlr); err != nil {
+		// start HTTP server (client listener detects client disconnects)
+		if err := fasthttp.Serve(services.NewClientListener(lstnr), hndlr); err != nil {
 			log.Fatal().Err(err).Msg("Failed to start HTTP server")
 		}
 
@@ -74,21 +156,13 @@ func main() {
 	}
 
 	// load tls configuration
-	tlsSvc := services.NewTLSService(s)
 	tlsCfg, err := tlsSvc.Configuration()
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to load TLS configuration")
 	}
 
-	// create a TCP listener on the specified port
-	lstnr, err := net.Listen("tcp", s.Server.Address)
-	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to listen on address")
-	}
-	defer lstnr.Close()
-
 	// create a TLS listener on top of the TCP listener
-	tlsLstnr := tls.NewListener(lstnr, tlsCfg)
+	tlsLstnr := services.NewClientListener(tls.NewListener(lstnr, tlsCfg))
 	defer tlsLstnr.Close()
 
 	// create a fasthttp server with the registered routes
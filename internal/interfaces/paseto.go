@@ -7,5 +7,6 @@ type PASETOProvider interface {
 	GenerateSymmetricKey() string
 	GenerateAsymmetricKeyPair() (string, string, error)
 	SignToken(paseto.Token) (string, error)
-	ValidateToken(token string) error
+	ValidateToken(token string) (*paseto.Token, error)
+	VerifyKeys() error
 }
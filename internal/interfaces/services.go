@@ -1,16 +1,62 @@
 package interfaces
 
-import "github.com/valyala/fasthttp"
+import (
+	"aidanwoods.dev/go-paseto"
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+type AccessLogService interface {
+	Close() error
+	LogRequest(next fasthttp.RequestHandler) fasthttp.RequestHandler
+}
 
 type AuthorizationService interface {
-	AuthorizeRequest(next fasthttp.RequestHandler) fasthttp.RequestHandler
+	AuthorizeRequest(req models.ClaimRequirements, next fasthttp.RequestHandler) fasthttp.RequestHandler
 	GenerateAsymmetricKeyPair() (string, string, error)
 	GeneratePublicPASETO() (string, error)
 	GeneratePrivatePASETO() (string, error)
 	GenerateSymmetricKey() string
-	ValidateToken(token string) error
+	ValidateToken(token string) (*paseto.Token, error)
+	VerifyKeys() error
+}
+
+type CatalogService interface {
+	Collect(pth string, rnrs ...models.Runner) []models.RunnerModels
+	Models(rnrs ...models.Runner) []string
+	Refresh()
+	Runners(mdl string) []models.Runner
+	Start()
 }
 
 type GatewayService interface {
-	ForwardRequest(hst string, pth string, schm string) func(*fasthttp.RequestCtx)
+	ForwardRequest(rnr models.Runner, pthPfx string) fasthttp.RequestHandler
+	Health() []models.RunnerHealth
+	StartHealthChecks()
+	TranslateFailures(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler
+}
+
+type QuotaService interface {
+	Count(u models.Usage)
+	EnforceQuotas(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler
+	Quotas(acct string) []models.QuotaUsage
+}
+
+type RateLimitService interface {
+	LimitClients(next fasthttp.RequestHandler) fasthttp.RequestHandler
+	LimitRunner(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler
+}
+
+type ReadinessService interface {
+	Readiness() models.Readiness
+}
+
+type TracingService interface {
+	Shutdown() error
+	TraceRequest(next fasthttp.RequestHandler) fasthttp.RequestHandler
+}
+
+type UsageService interface {
+	Record(u models.Usage)
+	Totals(sbj string) []models.UsageTotals
 }
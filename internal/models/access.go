@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+const (
+	AccessLogCombined = "combined"
+	AccessLogCommon   = "common"
+	AccessLogJSON     = "json"
+)
+
+// AccessLogStdout is the access log path that writes records to stdout
+const AccessLogStdout = "stdout"
+
+// AccessRecord is the access log record of a single request... the fields
+// (and their names) are stable, as records are ingested by other systems,
+// and each field is present in every record
+type AccessRecord struct {
+	BytesIn            int       `json:"bytesIn"`
+	BytesOut           int       `json:"bytesOut"`
+	ClientIP           string    `json:"clientIp"`
+	DurationMs         float64   `json:"durationMs"`
+	Method             string    `json:"method"`
+	Model              string    `json:"model"`
+	Path               string    `json:"path"`
+	Protocol           string    `json:"protocol"`
+	Referer            string    `json:"referer"`
+	RequestID          string    `json:"requestId"`
+	Runner             string    `json:"runner"`
+	Status             int       `json:"status"`
+	Subject            string    `json:"subject"`
+	Time               time.Time `json:"time"`
+	UpstreamDurationMs float64   `json:"upstreamDurationMs"`
+	UpstreamHost       string    `json:"upstreamHost"`
+	UserAgent          string    `json:"userAgent"`
+}
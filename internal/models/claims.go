@@ -0,0 +1,143 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/valyala/fasthttp"
+)
+
+const claimsKey = "claims"
+
+// Claims are the claims of a validated PASETO token
+type Claims map[string]any
+
+// ClaimRequirements maps a claim name to the values that satisfy it... a token
+// must hold at least one of the listed values for every claim named
+type ClaimRequirements map[string][]string
+
+func NewClaims(tkn *paseto.Token) Claims {
+	if tkn == nil {
+		return Claims{}
+	}
+
+	return Claims(tkn.Claims())
+}
+
+// ContextClaims returns the claims of the token used to authorize the request
+func ContextClaims(ctx *fasthttp.RequestCtx) Claims {
+	if clms, ok := ctx.UserValue(claimsKey).(Claims); ok {
+		return clms
+	}
+
+	return Claims{}
+}
+
+func SetContextClaims(ctx *fasthttp.RequestCtx, clms Claims) {
+	ctx.SetUserValue(claimsKey, clms)
+}
+
+// Validate ensures each required claim lists at least one accepted value,
+// as a claim without any could never be satisfied
+func (req ClaimRequirements) Validate() error {
+	for _, name := range req.names() {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("claim name is required")
+		}
+
+		if len(req[name]) == 0 {
+			return fmt.Errorf("no accepted values listed for claim %s", name)
+		}
+	}
+
+	return nil
+}
+
+// names returns the names of the required claims in order, so that the
+// claims are always evaluated (and reported) in the same order
+func (req ClaimRequirements) names() []string {
+	nms := make([]string, 0, len(req))
+	for name := range req {
+		nms = append(nms, name)
+	}
+	slices.Sort(nms)
+
+	return nms
+}
+
+// Satisfies reports whether the claims meet each of the requirements, and
+// returns the name of the first claim (by name) that does not
+func (c Claims) Satisfies(req ClaimRequirements) (string, bool) {
+	for _, name := range req.names() {
+		if !c.HasAny(name, req[name]) {
+			return name, false
+		}
+	}
+
+	return "", true
+}
+
+// HasAny reports whether the claim holds at least one of the provided values
+func (c Claims) HasAny(name string, vals []string) bool {
+	for _, have := range c.Values(name) {
+		for _, want := range vals {
+			if have == want {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Key identifies the token holding the claims, by its subject or (for tokens
+// without one) a digest of its claims, so that tokens without a subject are
+// not mistaken for one another
+func (c Claims) Key() string {
+	if sub := c.Subject(); sub != "" {
+		return "sub:" + sub
+	}
+
+	// claims are marshaled with their keys sorted, so the digest is stable
+	b, _ := json.Marshal(c)
+	sum := sha256.Sum256(b)
+
+	return "token:" + hex.EncodeToString(sum[:])
+}
+
+func (c Claims) Subject() string {
+	if sub, ok := c["sub"].(string); ok {
+		return sub
+	}
+
+	return ""
+}
+
+// Values returns the values of a claim as strings... array claims return each
+// element, and the scope claim may also be a space-delimited string (RFC 8693)
+func (c Claims) Values(name string) []string {
+	switch val := c[name].(type) {
+	case nil:
+		return nil
+	case string:
+		if name == "scope" {
+			return strings.Fields(val)
+		}
+
+		return []string{val}
+	case []any:
+		vals := make([]string, 0, len(val))
+		for _, v := range val {
+			vals = append(vals, fmt.Sprint(v))
+		}
+
+		return vals
+	default:
+		return []string{fmt.Sprint(val)}
+	}
+}
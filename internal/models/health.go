@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// HostHealth is the health of one of the hosts serving a runner
+type HostHealth struct {
+	Drained   bool      `json:"drained,omitempty"`
+	Failures  int       `json:"consecutiveFailures"`
+	Healthy   bool      `json:"healthy"`
+	Host      string    `json:"host"`
+	InFlight  int64     `json:"inFlight"`
+	LastCheck time.Time `json:"lastCheck,omitzero"`
+	LastError string    `json:"lastError,omitempty"`
+	Successes int       `json:"consecutiveSuccesses"`
+}
+
+// RunnerHealth is the health of a runner... a runner is healthy while at least
+// one of its hosts (that is not drained) is
+type RunnerHealth struct {
+	Healthy bool         `json:"healthy"`
+	Hosts   []HostHealth `json:"hosts"`
+	Name    string       `json:"name"`
+	Path    string       `json:"path"`
+	Queue   *RunnerQueue `json:"queue,omitempty"`
+}
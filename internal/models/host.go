@@ -0,0 +1,39 @@
+package models
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Key uniquely identifies a runner by the hostnames, path and match type it
+// is served at (runners may share a path when their match types differ)
+func (r Runner) Key() string {
+	mtch := r.Match
+	if mtch == "" {
+		mtch = MatchPrefix
+	}
+
+	return mtch + ":" + strings.Join(r.Hostnames, ",") + r.Path
+}
+
+// NormalizeHostname lowercases a hostname and removes any port and trailing dot
+// (i.e. from a Host header)
+func NormalizeHostname(hst string) string {
+	if h, _, err := net.SplitHostPort(hst); err == nil {
+		hst = h
+	}
+
+	return strings.TrimSuffix(strings.ToLower(hst), ".")
+}
+
+// validateHostname ensures a runner hostname is a name or a single leading
+// wildcard label
+func validateHostname(hst string) error {
+	name := strings.TrimPrefix(hst, "*.")
+	if name == "" || strings.ContainsAny(name, "*/: ") {
+		return fmt.Errorf("invalid hostname %q (expected a name such as ollama.example.com or *.example.com)", hst)
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+const modelKey = "model"
+
+// modelEndpoints are the runner API endpoints (and front-end protocol
+// endpoints) that specify the target model in the JSON request body
+var modelEndpoints = map[string]bool{
+	"/api/chat":            true,
+	"/api/embed":           true,
+	"/api/embeddings":      true,
+	"/api/generate":        true,
+	"/api/show":            true,
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+	"/v1/messages":         true,
+}
+
+// RunnerModels are the models listed by a runner endpoint (i.e. /api/tags)
+type RunnerModels struct {
+	Err    error
+	Models []map[string]any
+	Runner Runner
+}
+
+// ModelPolicy restricts which models may be used on a runner. Each entry is a
+// pattern where * matches any sequence of characters (i.e. "llama3.2:*"). When
+// a claim is named, tokens holding that claim may only use the models matching
+// the patterns it lists (in addition to the runner allow list).
+type ModelPolicy struct {
+	Allow []string `json:"allow" yaml:"allow"`
+	Claim string   `json:"claim" yaml:"claim"`
+}
+
+// Permits reports whether the model may be used with the provided claims
+func (p ModelPolicy) Permits(mdl string, clms Claims) bool {
+	if len(p.Allow) > 0 && !MatchModel(p.Allow, mdl) {
+		return false
+	}
+
+	if p.Claim != "" {
+		if ptrns := clms.Values(p.Claim); len(ptrns) > 0 && !MatchModel(ptrns, mdl) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// ContextModel returns the model requested, if it has been read from the
+// request body
+func ContextModel(ctx *fasthttp.RequestCtx) string {
+	if mdl, ok := ctx.UserValue(modelKey).(string); ok {
+		return mdl
+	}
+
+	return ""
+}
+
+// MatchModel reports whether the model name matches any of the patterns...
+// model names without a tag are treated as the "latest" tag, as Ollama does
+func MatchModel(ptrns []string, mdl string) bool {
+	nrml := mdl
+	if !strings.Contains(nrml, ":") {
+		nrml += ":latest"
+	}
+
+	for _, ptrn := range ptrns {
+		if matchGlob(ptrn, mdl) || matchGlob(ptrn, nrml) {
+			return true
+		}
+
+		if !strings.Contains(ptrn, ":") && matchGlob(ptrn+":latest", nrml) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ModelName returns the name of a model listed by a runner endpoint
+func ModelName(mdl map[string]any) string {
+	if nm, ok := mdl["name"].(string); ok && nm != "" {
+		return nm
+	}
+
+	nm, _ := mdl["model"].(string)
+	return nm
+}
+
+// RequestModel reads the model from the request body for runner endpoints
+// that specify one... the model is cached on the context for subsequent
+// handlers and ok is false when the endpoint does not specify a model
+func RequestModel(ctx *fasthttp.RequestCtx, pth string) (string, bool) {
+	if mdl, ok := ctx.UserValue(modelKey).(string); ok {
+		return mdl, true
+	}
+
+	if !modelEndpoints[pth] {
+		return "", false
+	}
+
+	var body struct {
+		Model string `json:"model"`
+		Name  string `json:"name"`
+	}
+
+	// a body that cannot be parsed is left for the runner to reject
+	json.Unmarshal(ctx.PostBody(), &body)
+
+	mdl := body.Model
+	if mdl == "" {
+		mdl = body.Name
+	}
+
+	ctx.SetUserValue(modelKey, mdl)
+
+	return mdl, true
+}
+
+// matchGlob matches s against a pattern where * matches any sequence of
+// characters (including /, which is common in model names)
+func matchGlob(ptrn string, s string) bool {
+	for len(ptrn) > 0 {
+		if ptrn[0] == '*' {
+			ptrn = strings.TrimLeft(ptrn, "*")
+			if ptrn == "" {
+				return true
+			}
+
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(ptrn, s[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if s == "" || ptrn[0] != s[0] {
+			return false
+		}
+
+		ptrn = ptrn[1:]
+		s = s[1:]
+	}
+
+	return s == ""
+}
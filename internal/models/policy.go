@@ -0,0 +1,111 @@
+package models
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Policy controls which runner API endpoints may be called. Rules are written
+// as "METHOD /path", where either may be a glob pattern (i.e. "POST /api/*" or
+// "* /api/pull"), and paths are relative to the runner (the runner path
+// prefix is removed before evaluation). Requests to a front-end API (i.e.
+// OpenAI) are also evaluated at the Ollama API path they are translated to,
+// so that rules written for the Ollama API apply however it is reached.
+// Tokens holding the exempt claims are not subject to the policy.
+type Policy struct {
+	Allow  []string          `json:"allow" yaml:"allow"`
+	Deny   []string          `json:"deny" yaml:"deny"`
+	Exempt ClaimRequirements `json:"exempt" yaml:"exempt"`
+}
+
+// protocolPaths maps the front-end API endpoints of each protocol to the
+// Ollama API endpoints they are translated to
+var protocolPaths = map[string]map[string]string{
+	ProtocolAnthropic: {
+		"/v1/messages": "/api/chat",
+		"/v1/models":   "/api/tags",
+	},
+	ProtocolOpenAI: {
+		"/v1/chat/completions": "/api/chat",
+		"/v1/completions":      "/api/generate",
+		"/v1/embeddings":       "/api/embed",
+		"/v1/models":           "/api/tags",
+	},
+}
+
+// TranslatedPath returns the Ollama API path that a front-end API path is
+// translated to (i.e. "/api/chat" for "/v1/chat/completions"), and false when
+// the path is not translated by the protocol
+func TranslatedPath(prtcl string, pth string) (string, bool) {
+	rpth, ok := protocolPaths[prtcl][pth]
+	return rpth, ok
+}
+
+// Permits reports whether the endpoint may be called at the paths given (the
+// path requested and any path it is translated to)... endpoints denied at any
+// of the paths are never permitted and, when an allow list is provided, only
+// endpoints that match it at one of the paths are permitted
+func (p Policy) Permits(method string, clms Claims, pths ...string) bool {
+	if len(p.Exempt) > 0 {
+		if _, ok := clms.Satisfies(p.Exempt); ok {
+			return true
+		}
+	}
+
+	for _, rule := range p.Deny {
+		for _, pth := range pths {
+			if matchRule(rule, method, pth) {
+				return false
+			}
+		}
+	}
+
+	if len(p.Allow) == 0 {
+		return true
+	}
+
+	for _, rule := range p.Allow {
+		for _, pth := range pths {
+			if matchRule(rule, method, pth) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Validate ensures each of the rules (and the exempt claims) is well formed
+func (p Policy) Validate() error {
+	if err := p.Exempt.Validate(); err != nil {
+		return fmt.Errorf("invalid exempt claims: %w", err)
+	}
+
+	for _, rule := range append(append([]string{}, p.Allow...), p.Deny...) {
+		mthd, pth, ok := strings.Cut(strings.TrimSpace(rule), " ")
+		if !ok || mthd == "" || !strings.HasPrefix(strings.TrimSpace(pth), "/") {
+			return fmt.Errorf("invalid policy rule %q (expected \"METHOD /path\")", rule)
+		}
+
+		if _, err := path.Match(strings.TrimSpace(pth), "/"); err != nil {
+			return fmt.Errorf("invalid policy rule %q: %w", rule, err)
+		}
+	}
+
+	return nil
+}
+
+func matchRule(rule string, method string, pth string) bool {
+	mthd, ptrn, ok := strings.Cut(strings.TrimSpace(rule), " ")
+	if !ok {
+		return false
+	}
+
+	if mthd != "*" && !strings.EqualFold(mthd, method) {
+		return false
+	}
+
+	mtch, _ := path.Match(strings.TrimSpace(ptrn), pth)
+	return mtch
+}
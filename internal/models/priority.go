@@ -0,0 +1,24 @@
+package models
+
+import "slices"
+
+// priority classes, in the order queued requests are admitted
+const (
+	PriorityInteractive = "interactive"
+	PriorityDefault     = "default"
+	PriorityBatch       = "batch"
+)
+
+var priorities = []string{PriorityInteractive, PriorityDefault, PriorityBatch}
+
+// PriorityRank returns the rank of the priority class, where requests with a
+// lower rank are admitted first
+func PriorityRank(cls string) (int, bool) {
+	i := slices.Index(priorities, cls)
+	return i, i >= 0
+}
+
+// Priorities returns the number of priority classes
+func Priorities() int {
+	return len(priorities)
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"fmt"
+	"time"
+)
+
+// Concurrency limits the requests in flight to each of the runner hosts...
+// requests beyond the limit wait in a bounded queue (served by priority, then
+// round-robin across token subjects) for up to the queue timeout, and batch
+// requests are preempted when interactive requests wait beyond the preempt
+// threshold (when set)
+type Concurrency struct {
+	MaxInFlight  int           `json:"maxInFlight" yaml:"maxInFlight"`
+	MaxQueue     int           `json:"maxQueue" yaml:"maxQueue"`
+	PreemptAfter time.Duration `json:"preemptAfterSeconds" yaml:"preemptAfterSeconds"`
+	QueueTimeout time.Duration `json:"queueTimeoutSeconds" yaml:"queueTimeoutSeconds"`
+}
+
+// RunnerQueue reports the requests waiting for one of the runner hosts, and
+// the requests that have waited (or were turned away) since the gateway started
+type RunnerQueue struct {
+	Depth       int     `json:"depth"`
+	Limit       int     `json:"limit"`
+	Preempted   uint64  `json:"preempted"`
+	Rejected    uint64  `json:"rejected"`
+	TimedOut    uint64  `json:"timedOut"`
+	Waited      uint64  `json:"waited"`
+	WaitSeconds float64 `json:"waitSeconds"`
+}
+
+// Validate ensures the concurrency limits are not negative
+func (c Concurrency) Validate() error {
+	if c.MaxInFlight < 0 || c.MaxQueue < 0 || c.PreemptAfter < 0 || c.QueueTimeout < 0 {
+		return fmt.Errorf("concurrency limits must not be negative")
+	}
+
+	return nil
+}
@@ -0,0 +1,122 @@
+package models
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const accountKey = "account"
+
+// quota metrics, measured from the usage recorded for each request
+const (
+	MetricCompletionTokens = "completionTokens"
+	MetricGPUSeconds       = "gpuSeconds"
+	MetricPromptTokens     = "promptTokens"
+	MetricRequests         = "requests"
+	MetricTotalTokens      = "totalTokens"
+)
+
+// Quota limits the usage of an account (the token subject, or the value of
+// the quota claim) over a fixed window of time... when runners or accounts
+// are listed, the quota only applies to those
+type Quota struct {
+	Accounts []string      `json:"accounts" yaml:"accounts"`
+	Limit    float64       `json:"limit" yaml:"limit"`
+	Metric   string        `json:"metric" yaml:"metric"`
+	Name     string        `json:"name" yaml:"name"`
+	Runners  []string      `json:"runners" yaml:"runners"`
+	Window   time.Duration `json:"windowSeconds" yaml:"windowSeconds"`
+}
+
+// QuotaUsage is the usage counted toward a quota in the current window
+type QuotaUsage struct {
+	Account  string    `json:"account"`
+	Exceeded bool      `json:"exceeded"`
+	Limit    float64   `json:"limit"`
+	Metric   string    `json:"metric"`
+	Name     string    `json:"name"`
+	ResetsAt time.Time `json:"resetsAt"`
+	Used     float64   `json:"used"`
+	Window   string    `json:"window"`
+}
+
+// ContextAccount returns the account the request usage is counted toward
+func ContextAccount(ctx *fasthttp.RequestCtx) string {
+	if acct, ok := ctx.UserValue(accountKey).(string); ok {
+		return acct
+	}
+
+	return ""
+}
+
+func SetContextAccount(ctx *fasthttp.RequestCtx, acct string) {
+	ctx.SetUserValue(accountKey, acct)
+}
+
+// Amount returns the usage measured by the quota metric
+func (q Quota) Amount(u Usage) float64 {
+	switch q.Metric {
+	case MetricCompletionTokens:
+		return float64(u.CompletionTokens)
+	case MetricGPUSeconds:
+		return u.TotalDuration.Seconds()
+	case MetricPromptTokens:
+		return float64(u.PromptTokens)
+	case MetricRequests:
+		return 1
+	case MetricTotalTokens:
+		return float64(u.PromptTokens + u.CompletionTokens)
+	default:
+		return 0
+	}
+}
+
+// Applies reports whether the quota limits the account on the runner
+func (q Quota) Applies(rnr string, acct string) bool {
+	if len(q.Runners) > 0 && !slices.Contains(q.Runners, rnr) {
+		return false
+	}
+
+	if len(q.Accounts) > 0 && !slices.Contains(q.Accounts, acct) {
+		return false
+	}
+
+	return true
+}
+
+// Start returns the start of the window holding t... windows are aligned to
+// the Unix epoch (rather than the zero time, as with time.Truncate), so daily
+// quotas reset at midnight UTC and weekly quotas at midnight UTC on Thursday
+func (q Quota) Start(t time.Time) time.Time {
+	epch := time.Unix(0, 0).UTC()
+	d := t.Sub(epch)
+
+	return epch.Add(d - d%q.Window)
+}
+
+// Validate ensures the quota is named and has a known metric, a positive
+// limit and a window
+func (q Quota) Validate() error {
+	if q.Name == "" {
+		return fmt.Errorf("quota name is required")
+	}
+
+	switch q.Metric {
+	case MetricCompletionTokens, MetricGPUSeconds, MetricPromptTokens, MetricRequests, MetricTotalTokens:
+	default:
+		return fmt.Errorf("invalid metric %q for quota %s (expected %s, %s, %s, %s or %s)", q.Metric, q.Name, MetricCompletionTokens, MetricPromptTokens, MetricTotalTokens, MetricGPUSeconds, MetricRequests)
+	}
+
+	if q.Limit <= 0 {
+		return fmt.Errorf("limit for quota %s must be greater than zero", q.Name)
+	}
+
+	if q.Window <= 0 {
+		return fmt.Errorf("window for quota %s must be greater than zero", q.Name)
+	}
+
+	return nil
+}
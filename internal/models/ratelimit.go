@@ -0,0 +1,88 @@
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit permits a number of requests per window, refilled continuously (a
+// token bucket)... the burst is the most requests permitted at once, which is
+// the number of requests when not set
+type RateLimit struct {
+	Burst    int           `json:"burst" yaml:"burst"`
+	Requests int           `json:"requests" yaml:"requests"`
+	Window   time.Duration `json:"windowSeconds" yaml:"windowSeconds"`
+}
+
+// ParseRateLimit reads a rate limit in the form "requests/window" with an
+// optional burst (i.e. "600/1m" or "600/1m/20"), as held by a token claim...
+// unlike a configured rate limit, 0 requests permits none (rather than
+// disabling the limit), so the window is required regardless
+func ParseRateLimit(val string) (RateLimit, error) {
+	prts := strings.Split(val, "/")
+	if len(prts) < 2 || len(prts) > 3 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %q (expected requests/window[/burst])", val)
+	}
+
+	rl := RateLimit{}
+	var err error
+	if rl.Requests, err = strconv.Atoi(prts[0]); err != nil {
+		return RateLimit{}, fmt.Errorf("invalid requests for rate limit %q: %w", val, err)
+	}
+
+	if rl.Window, err = time.ParseDuration(prts[1]); err != nil {
+		return RateLimit{}, fmt.Errorf("invalid window for rate limit %q: %w", val, err)
+	}
+
+	if len(prts) == 3 {
+		if rl.Burst, err = strconv.Atoi(prts[2]); err != nil {
+			return RateLimit{}, fmt.Errorf("invalid burst for rate limit %q: %w", val, err)
+		}
+	}
+
+	if rl.Window <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid window for rate limit %q: must be greater than zero", val)
+	}
+
+	return rl, rl.Validate()
+}
+
+// Capacity returns the most requests permitted at once
+func (rl RateLimit) Capacity() float64 {
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+
+	return float64(rl.Requests)
+}
+
+// Denies reports whether the rate limit permits no requests at all (i.e. a
+// claim of "0/1m")
+func (rl RateLimit) Denies() bool {
+	return rl.Requests == 0 && rl.Window > 0
+}
+
+// Enabled reports whether the rate limit is configured
+func (rl RateLimit) Enabled() bool {
+	return rl.Requests > 0
+}
+
+// Rate returns the number of requests permitted per second
+func (rl RateLimit) Rate() float64 {
+	return float64(rl.Requests) / rl.Window.Seconds()
+}
+
+// Validate ensures a configured rate limit has a window and no negative burst
+func (rl RateLimit) Validate() error {
+	if rl.Requests < 0 || rl.Burst < 0 {
+		return fmt.Errorf("rate limit requests and burst must not be negative")
+	}
+
+	if rl.Enabled() && rl.Window <= 0 {
+		return fmt.Errorf("rate limit window must be greater than zero")
+	}
+
+	return nil
+}
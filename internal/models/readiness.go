@@ -0,0 +1,10 @@
+package models
+
+// Readiness reports whether the gateway is ready to serve requests, along with
+// the outcome of each check ("ok" or the reason it failed) and the health of
+// each runner
+type Readiness struct {
+	Checks  map[string]string `json:"checks"`
+	Ready   bool              `json:"ready"`
+	Runners []RunnerHealth    `json:"runners"`
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/valyala/fasthttp"
+)
+
+const requestIDKey = "requestId"
+
+// HeaderRequestID identifies a request in the gateway logs, and is forwarded
+// to the runner and returned to the client
+const HeaderRequestID = "X-Request-ID"
+
+// ContextRequestID returns the ID of the request
+func ContextRequestID(ctx *fasthttp.RequestCtx) string {
+	if id, ok := ctx.UserValue(requestIDKey).(string); ok {
+		return id
+	}
+
+	return ""
+}
+
+func SetContextRequestID(ctx *fasthttp.RequestCtx, id string) {
+	ctx.SetUserValue(requestIDKey, id)
+}
+
+// RequestLogger returns the logger with the ID of the request added to each
+// of its events
+func RequestLogger(ctx *fasthttp.RequestCtx, l zerolog.Logger) *zerolog.Logger {
+	if id := ContextRequestID(ctx); id != "" {
+		l = l.With().Str("requestId", id).Logger()
+	}
+
+	return &l
+}
@@ -1,6 +1,7 @@
 package models
 
 import (
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -8,9 +9,36 @@ import (
 )
 
 type Settings struct {
+	AccessLog struct {
+		Format         string        `json:"format" yaml:"format"`
+		MaxBackups     int           `json:"maxBackups" yaml:"maxBackups"`
+		MaxSize        int           `json:"maxSizeMB" yaml:"maxSizeMB"`
+		Path           string        `json:"path" yaml:"path"`
+		RotateInterval time.Duration `json:"rotateIntervalSeconds" yaml:"rotateIntervalSeconds"`
+	} `json:"accessLog" yaml:"accessLog"`
+	Admin struct {
+		Claims ClaimRequirements `json:"claims" yaml:"claims"`
+		Path   string            `json:"path" yaml:"path"`
+	} `json:"admin" yaml:"admin"`
+	HealthCheck struct {
+		Ejection           time.Duration `json:"ejectionSeconds" yaml:"ejectionSeconds"`
+		HealthyThreshold   int           `json:"healthyThreshold" yaml:"healthyThreshold"`
+		Interval           time.Duration `json:"intervalSeconds" yaml:"intervalSeconds"`
+		Path               string        `json:"path" yaml:"path"`
+		Timeout            time.Duration `json:"timeoutSeconds" yaml:"timeoutSeconds"`
+		UnhealthyThreshold int           `json:"unhealthyThreshold" yaml:"unhealthyThreshold"`
+	} `json:"healthCheck" yaml:"healthCheck"`
 	Logging struct {
 		Level string `json:"level" yaml:"level"`
 	} `json:"logging" yaml:"logging"`
+	Metrics struct {
+		Address string `json:"address" yaml:"address"`
+		Path    string `json:"path" yaml:"path"`
+	} `json:"metrics" yaml:"metrics"`
+	ModelRouting struct {
+		Path            string        `json:"path" yaml:"path"`
+		RefreshInterval time.Duration `json:"refreshIntervalSeconds" yaml:"refreshIntervalSeconds"`
+	} `json:"modelRouting" yaml:"modelRouting"`
 	PASETO struct {
 		Expiration time.Duration `json:"expiration" yaml:"expiration"`
 		KeyPath    string        `json:"keyPath" yaml:"keyPath"`
@@ -18,19 +46,121 @@ type Settings struct {
 		SecretKey  string        `json:"secretKey" yaml:"secretKey"`
 		Version    string        `json:"version" yaml:"version"`
 	} `json:"paseto" yaml:"paseto"`
-	Runners []struct {
-		Host   string `json:"host" yaml:"host"`
-		Name   string `json:"name" yaml:"name"`
-		Path   string `json:"path" yaml:"path"`
-		Scheme string `json:"scheme" yaml:"scheme"`
-	} `json:"runners" yaml:"runners"`
-	Server struct {
-		Address         string        `json:"address" yaml:"address"`
-		CertificatePath string        `json:"certificatePath" yaml:"certificatePath"`
-		KeyPath         string        `json:"keyPath" yaml:"keyPath"`
-		ReadTimeout     time.Duration `json:"readTimeoutSeconds" yaml:"readTimeoutSeconds"`
-		WriteTimeout    time.Duration `json:"writeTimeoutSeconds" yaml:"writeTimeoutSeconds"`
+	Probes struct {
+		LivenessPath  string `json:"livenessPath" yaml:"livenessPath"`
+		ReadinessPath string `json:"readinessPath" yaml:"readinessPath"`
+	} `json:"probes" yaml:"probes"`
+	Priority struct {
+		Claim  string `json:"claim" yaml:"claim"`
+		Header string `json:"header" yaml:"header"`
+	} `json:"priority" yaml:"priority"`
+	Quotas struct {
+		Claim  string  `json:"claim" yaml:"claim"`
+		Limits []Quota `json:"limits" yaml:"limits"`
+		Path   string  `json:"path" yaml:"path"`
+	} `json:"quotas" yaml:"quotas"`
+	RateLimits struct {
+		Claim          string    `json:"claim" yaml:"claim"`
+		Global         RateLimit `json:"global" yaml:"global"`
+		IP             RateLimit `json:"ip" yaml:"ip"`
+		IPHeader       string    `json:"ipHeader" yaml:"ipHeader"`
+		Runner         RateLimit `json:"runner" yaml:"runner"`
+		Subject        RateLimit `json:"subject" yaml:"subject"`
+		TrustedProxies int       `json:"trustedProxies" yaml:"trustedProxies"`
+	} `json:"rateLimits" yaml:"rateLimits"`
+	RunnerSelection struct {
+		Claim  string `json:"claim" yaml:"claim"`
+		Header string `json:"header" yaml:"header"`
+	} `json:"runnerSelection" yaml:"runnerSelection"`
+	Runners []Runner `json:"runners" yaml:"runners"`
+	Server  struct {
+		Address           string        `json:"address" yaml:"address"`
+		CertificatePath   string        `json:"certificatePath" yaml:"certificatePath"`
+		Certificates      []Certificate `json:"certificates" yaml:"certificates"`
+		KeyPath           string        `json:"keyPath" yaml:"keyPath"`
+		ReadTimeout       time.Duration `json:"readTimeoutSeconds" yaml:"readTimeoutSeconds"`
+		StreamIdleTimeout time.Duration `json:"streamIdleTimeoutSeconds" yaml:"streamIdleTimeoutSeconds"`
+		WriteTimeout      time.Duration `json:"writeTimeoutSeconds" yaml:"writeTimeoutSeconds"`
 	} `json:"server" yaml:"server"`
+	Tracing struct {
+		Endpoint    string            `json:"endpoint" yaml:"endpoint"`
+		Exporter    string            `json:"exporter" yaml:"exporter"`
+		Headers     map[string]string `json:"headers" yaml:"headers"`
+		Path        string            `json:"path" yaml:"path"`
+		SampleRatio float64           `json:"sampleRatio" yaml:"sampleRatio"`
+		ServiceName string            `json:"serviceName" yaml:"serviceName"`
+	} `json:"tracing" yaml:"tracing"`
+	Usage struct {
+		Path string `json:"path" yaml:"path"`
+	} `json:"usage" yaml:"usage"`
+}
+
+// Certificate is an additional TLS certificate, presented to clients that
+// request one of the names it is valid for (using SNI)
+type Certificate struct {
+	CertificatePath string `json:"certificatePath" yaml:"certificatePath"`
+	KeyPath         string `json:"keyPath" yaml:"keyPath"`
+}
+
+const (
+	MatchExact  = "exact"
+	MatchPrefix = "prefix"
+	MatchRegex  = "regex"
+)
+
+const (
+	ProtocolAnthropic = "anthropic"
+	ProtocolOllama    = "ollama"
+	ProtocolOpenAI    = "openai"
+)
+
+const (
+	RunnerTypeLlamaCpp = "llamacpp"
+	RunnerTypeOllama   = "ollama"
+	RunnerTypeTGI      = "tgi"
+	RunnerTypeVLLM     = "vllm"
+)
+
+type Runner struct {
+	Balancer    string            `json:"balancer" yaml:"balancer"`
+	Claims      ClaimRequirements `json:"claims" yaml:"claims"`
+	Concurrency Concurrency       `json:"concurrency" yaml:"concurrency"`
+	Host        string            `json:"host" yaml:"host"`
+	Hostnames   []string          `json:"hostnames" yaml:"hostnames"`
+	Hosts       []Upstream        `json:"hosts" yaml:"hosts"`
+	Match       string            `json:"match" yaml:"match"`
+	Models      ModelPolicy       `json:"models" yaml:"models"`
+	Name        string            `json:"name" yaml:"name"`
+	Path        string            `json:"path" yaml:"path"`
+	Policy      Policy            `json:"policy" yaml:"policy"`
+	Protocol    string            `json:"protocol" yaml:"protocol"`
+	RateLimit   RateLimit         `json:"rateLimit" yaml:"rateLimit"`
+	Scheme      string            `json:"scheme" yaml:"scheme"`
+	Type        string            `json:"type" yaml:"type"`
+}
+
+// Prefix returns the path prefix removed from inbound requests... only prefix
+// matched runners (the default) have one, as exact and regex matched runners
+// forward the request path unchanged
+func (r Runner) Prefix() string {
+	if r.Match != "" && r.Match != MatchPrefix {
+		return ""
+	}
+
+	return r.Path
+}
+
+// RelativePath removes the runner path prefix from an inbound request path
+func (r Runner) RelativePath(pth string) string {
+	if pfx := strings.TrimSuffix(r.Prefix(), "/"); pfx != "" {
+		pth = strings.TrimPrefix(pth, pfx)
+	}
+
+	if pth == "" {
+		return "/"
+	}
+
+	return pth
 }
 
 func (s *Settings) globalLogLevel() zerolog.Level {
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"context"
+
+	"github.com/valyala/fasthttp"
+)
+
+const traceKey = "trace"
+
+const (
+	TraceExporterFile   = "file"
+	TraceExporterOTLP   = "otlp"
+	TraceExporterStdout = "stdout"
+)
+
+// ContextTrace returns the context holding the span of the request, which
+// spans for each step of the request are created from
+func ContextTrace(ctx *fasthttp.RequestCtx) context.Context {
+	if tc, ok := ctx.UserValue(traceKey).(context.Context); ok {
+		return tc
+	}
+
+	return context.Background()
+}
+
+func SetContextTrace(ctx *fasthttp.RequestCtx, tc context.Context) {
+	ctx.SetUserValue(traceKey, tc)
+}
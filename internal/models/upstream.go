@@ -0,0 +1,112 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	LeastOutstanding = "least-outstanding"
+	RandomTwoChoices = "random-two-choices"
+	RoundRobin       = "round-robin"
+)
+
+// Upstream is one of the hosts serving a runner... requests are distributed
+// across hosts in proportion to their weight (1 when not set), and a host
+// with a weight of 0 is drained and receives no requests
+type Upstream struct {
+	Host   string `json:"host" yaml:"host"`
+	Weight *int   `json:"weight" yaml:"weight"`
+}
+
+// Share returns the weight of the upstream host, which defaults to 1
+func (u Upstream) Share() int {
+	if u.Weight == nil {
+		return 1
+	}
+
+	return *u.Weight
+}
+
+// Upstreams returns the hosts serving the runner, falling back to the single
+// runner host when no hosts are listed
+func (r Runner) Upstreams() []Upstream {
+	if len(r.Hosts) > 0 {
+		return r.Hosts
+	}
+
+	return []Upstream{{Host: r.Host}}
+}
+
+// Validate ensures the runner hosts, balancer, hostnames, path match,
+// protocol, type, claims, policy and limits are well formed
+func (r Runner) Validate() error {
+	switch r.Balancer {
+	case "", LeastOutstanding, RandomTwoChoices, RoundRobin:
+	default:
+		return fmt.Errorf("invalid balancer %q (expected %s, %s or %s)", r.Balancer, RoundRobin, LeastOutstanding, RandomTwoChoices)
+	}
+
+	tot := 0
+	for _, u := range r.Upstreams() {
+		if strings.TrimSpace(u.Host) == "" {
+			return fmt.Errorf("upstream host is required")
+		}
+
+		if u.Share() < 0 {
+			return fmt.Errorf("invalid weight %d for upstream host %s", u.Share(), u.Host)
+		}
+		tot += u.Share()
+	}
+
+	if tot == 0 {
+		return fmt.Errorf("at least one upstream host must have a weight greater than 0")
+	}
+
+	for _, hst := range r.Hostnames {
+		if err := validateHostname(hst); err != nil {
+			return err
+		}
+	}
+
+	switch r.Match {
+	case "", MatchExact, MatchPrefix:
+	case MatchRegex:
+		if _, err := regexp.Compile(r.Path); err != nil {
+			return fmt.Errorf("invalid path pattern %q: %w", r.Path, err)
+		}
+	default:
+		return fmt.Errorf("invalid match %q (expected %s, %s or %s)", r.Match, MatchPrefix, MatchExact, MatchRegex)
+	}
+
+	switch r.Protocol {
+	case "", ProtocolAnthropic, ProtocolOllama, ProtocolOpenAI:
+	default:
+		return fmt.Errorf("invalid protocol %q (expected %s, %s or %s)", r.Protocol, ProtocolOllama, ProtocolOpenAI, ProtocolAnthropic)
+	}
+
+	switch r.Type {
+	case "", RunnerTypeLlamaCpp, RunnerTypeOllama, RunnerTypeTGI, RunnerTypeVLLM:
+	default:
+		return fmt.Errorf("invalid type %q (expected %s, %s, %s or %s)", r.Type, RunnerTypeOllama, RunnerTypeLlamaCpp, RunnerTypeVLLM, RunnerTypeTGI)
+	}
+
+	if err := r.Claims.Validate(); err != nil {
+		return fmt.Errorf("invalid claims: %w", err)
+	}
+
+	if err := r.Policy.Validate(); err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+
+	if err := r.Concurrency.Validate(); err != nil {
+		return fmt.Errorf("invalid concurrency: %w", err)
+	}
+
+	if err := r.RateLimit.Validate(); err != nil {
+		return fmt.Errorf("invalid rate limit: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package models
+
+import "time"
+
+// Usage is the token usage and runner time reported for a single request
+// (read from the final chunk of an Ollama response)... durations are in
+// nanoseconds, as reported by Ollama
+type Usage struct {
+	Account          string        `json:"account,omitempty"`
+	CompletionTokens int           `json:"completionTokens"`
+	EvalDuration     time.Duration `json:"evalDuration"`
+	Host             string        `json:"host"`
+	Model            string        `json:"model"`
+	Path             string        `json:"path"`
+	PromptTokens     int           `json:"promptTokens"`
+	RequestID        string        `json:"requestId,omitempty"`
+	Runner           string        `json:"runner"`
+	Subject          string        `json:"subject"`
+	Time             time.Time     `json:"time"`
+	TotalDuration    time.Duration `json:"totalDuration"`
+}
+
+// UsageTotals is the usage accumulated for a subject on a runner model
+type UsageTotals struct {
+	CompletionTokens int           `json:"completionTokens"`
+	EvalDuration     time.Duration `json:"evalDuration"`
+	LastRequest      time.Time     `json:"lastRequest"`
+	Model            string        `json:"model"`
+	PromptTokens     int           `json:"promptTokens"`
+	Requests         int           `json:"requests"`
+	Runner           string        `json:"runner"`
+	Subject          string        `json:"subject"`
+	TotalDuration    time.Duration `json:"totalDuration"`
+}
+
+// Add accumulates the usage of a single request
+func (t *UsageTotals) Add(u Usage) {
+	t.CompletionTokens += u.CompletionTokens
+	t.EvalDuration += u.EvalDuration
+	t.LastRequest = u.Time
+	t.PromptTokens += u.PromptTokens
+	t.Requests++
+	t.TotalDuration += u.TotalDuration
+}
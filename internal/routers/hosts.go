@@ -0,0 +1,83 @@
+package routers
+
+import (
+	"strings"
+
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// hostTable holds a route table for each virtual host... requests with a Host
+// (or TLS SNI name) matching a virtual host are routed using its table, and
+// fall back to the default table for paths it does not match
+type hostTable struct {
+	dflt  *routeTable
+	exact map[string]*routeTable
+	wild  map[string]*routeTable
+}
+
+func newHostTable() *hostTable {
+	return &hostTable{
+		dflt:  newRouteTable(),
+		exact: map[string]*routeTable{},
+		wild:  map[string]*routeTable{},
+	}
+}
+
+// lookup returns the table for the virtual host matching the hostname... an
+// exact hostname is preferred to a wildcard, where a leading "*." matches
+// exactly one label (i.e. "*.example.com" matches "ollama.example.com" but
+// not "example.com" or "a.b.example.com")
+func (h *hostTable) lookup(hst string) *routeTable {
+	hst = models.NormalizeHostname(hst)
+	if hst == "" {
+		return nil
+	}
+
+	if rt, ok := h.exact[hst]; ok {
+		return rt
+	}
+
+	if _, sfx, ok := strings.Cut(hst, "."); ok {
+		return h.wild[sfx]
+	}
+
+	return nil
+}
+
+// route returns the route for the inbound request hostname and path
+func (h *hostTable) route(hst string, pth string) (prefixRoute, bool) {
+	if rt := h.lookup(hst); rt != nil {
+		if r, ok := rt.route(pth); ok {
+			return r, true
+		}
+	}
+
+	return h.dflt.route(pth)
+}
+
+// tables returns the route table for each of the hostnames (creating them as
+// needed), or the default table when there are no hostnames
+func (h *hostTable) tables(hsts []string) []*routeTable {
+	if len(hsts) == 0 {
+		return []*routeTable{h.dflt}
+	}
+
+	rts := make([]*routeTable, 0, len(hsts))
+	for _, hst := range hsts {
+		hst = models.NormalizeHostname(hst)
+
+		vhs := h.exact
+		if sfx, ok := strings.CutPrefix(hst, "*."); ok {
+			hst = sfx
+			vhs = h.wild
+		}
+
+		if _, ok := vhs[hst]; !ok {
+			vhs[hst] = newRouteTable()
+		}
+
+		rts = append(rts, vhs[hst])
+	}
+
+	return rts
+}
@@ -0,0 +1,83 @@
+package routers
+
+import "testing"
+
+func TestHostTableRoute(t *testing.T) {
+	ht := newHostTable()
+	add := func(hsts []string, pth string, nm string) {
+		for _, rt := range ht.tables(hsts) {
+			if err := rt.add("", pth, named(nm)); err != nil {
+				t.Fatalf("add(%v, %q) error = %v", hsts, pth, err)
+			}
+		}
+	}
+
+	add(nil, "/", "default")
+	add(nil, "/corp-ollama", "corp")
+	add([]string{"ollama.internal.example.com"}, "/", "ollama")
+	add([]string{"embed.internal.example.com"}, "/", "embed")
+	add([]string{"embed.internal.example.com"}, "/admin", "embed-admin")
+	add([]string{"*.teams.example.com"}, "/", "teams")
+	add([]string{"special.teams.example.com"}, "/special", "special")
+
+	tests := []struct {
+		name string
+		hst  string
+		pth  string
+		want string
+	}{
+		{name: "no host", pth: "/api/tags", want: "default"},
+		{name: "unknown host", hst: "gateway.example.com", pth: "/api/tags", want: "default"},
+		{name: "virtual host", hst: "ollama.internal.example.com", pth: "/api/tags", want: "ollama"},
+		{name: "virtual host with port", hst: "ollama.internal.example.com:8443", pth: "/api/tags", want: "ollama"},
+		{name: "virtual host is case insensitive", hst: "Embed.Internal.Example.COM", pth: "/api/embed", want: "embed"},
+		{name: "virtual host longest prefix", hst: "embed.internal.example.com", pth: "/admin/api/ps", want: "embed-admin"},
+		{name: "wildcard virtual host", hst: "a.teams.example.com", pth: "/api/tags", want: "teams"},
+		{name: "wildcard matches a single label", hst: "a.b.teams.example.com", pth: "/api/tags", want: "default"},
+		{name: "wildcard does not match the domain", hst: "teams.example.com", pth: "/api/tags", want: "default"},
+		{name: "exact host preferred to wildcard", hst: "special.teams.example.com", pth: "/special/api/tags", want: "special"},
+		{name: "unmatched path falls back to default", hst: "special.teams.example.com", pth: "/corp-ollama/api/tags", want: "corp"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routed(ht.route(tt.hst, tt.pth)); got != tt.want {
+				t.Errorf("route(%q, %q) = %q, want %q", tt.hst, tt.pth, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostTableLookup(t *testing.T) {
+	ht := newHostTable()
+	vhs := map[string]*routeTable{}
+	for _, hst := range []string{"ollama.example.com", "*.teams.example.com", "special.teams.example.com"} {
+		vhs[hst] = ht.tables([]string{hst})[0]
+	}
+
+	// requests for hosts without a virtual host (nil) use the default table,
+	// and the table found for the Host and TLS SNI names must be the same
+	tests := []struct {
+		name string
+		hst  string
+		want string
+	}{
+		{name: "no host", hst: ""},
+		{name: "unknown host", hst: "gateway.example.com"},
+		{name: "single label", hst: "localhost"},
+		{name: "exact host", hst: "ollama.example.com", want: "ollama.example.com"},
+		{name: "exact host with port and trailing dot", hst: "Ollama.Example.com.:443", want: "ollama.example.com"},
+		{name: "wildcard host", hst: "a.teams.example.com", want: "*.teams.example.com"},
+		{name: "wildcard matches a single label", hst: "a.b.teams.example.com"},
+		{name: "wildcard does not match the domain", hst: "teams.example.com"},
+		{name: "exact host preferred to wildcard", hst: "special.teams.example.com", want: "special.teams.example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ht.lookup(tt.hst); got != vhs[tt.want] {
+				t.Errorf("lookup(%q) returned the wrong table, want %q", tt.hst, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package routers
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// maxRequestIDLength is the longest request ID accepted from clients
+const maxRequestIDLength = 128
+
+// identifyRequest accepts the request ID provided by the client (or generates
+// one when it is missing or unsuitable) before calling next... the ID is
+// forwarded to the runner, returned to the client and added to the body of
+// error responses so that it can be quoted when reporting a problem
+func identifyRequest(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		id := string(ctx.Request.Header.Peek(models.HeaderRequestID))
+		if !validRequestID(id) {
+			id = newRequestID()
+			ctx.Request.Header.Set(models.HeaderRequestID, id)
+		}
+
+		models.SetContextRequestID(ctx, id)
+
+		next(ctx)
+
+		// the response headers may have been replaced (i.e. by those of the
+		// runner), so the ID is set once the request has been handled
+		ctx.Response.Header.Set(models.HeaderRequestID, id)
+		if ctx.Response.StatusCode() >= fasthttp.StatusBadRequest {
+			tagErrorBody(&ctx.Response, id)
+		}
+	}
+}
+
+// newRequestID returns a random 128-bit request ID
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// requestLog returns the logger for events of the request
+func requestLog(ctx *fasthttp.RequestCtx) *zerolog.Logger {
+	return models.RequestLogger(ctx, log.Logger)
+}
+
+// tagErrorBody adds the request ID to the body of an error response, as a
+// requestId field of JSON objects or following plain text... streamed
+// and encoded bodies are left as they are
+func tagErrorBody(resp *fasthttp.Response, id string) {
+	if resp.IsBodyStream() || len(resp.Header.ContentEncoding()) > 0 {
+		return
+	}
+
+	body := bytes.TrimSpace(resp.Body())
+	ct := resp.Header.ContentType()
+	if bytes.HasPrefix(ct, []byte("text/plain")) {
+		resp.SetBodyString(string(body) + " (request ID: " + id + ")")
+		return
+	}
+
+	if !bytes.Contains(ct, []byte("json")) {
+		return
+	}
+
+	if len(body) < 2 || body[0] != '{' || !json.Valid(body) {
+		return
+	}
+
+	var flds map[string]json.RawMessage
+	if json.Unmarshal(body, &flds) != nil {
+		return
+	}
+
+	if _, ok := flds["requestId"]; ok {
+		return
+	}
+
+	// the field is added ahead of the existing fields, leaving them in order
+	val, _ := json.Marshal(id)
+	tgd := append([]byte(`{"requestId":`), val...)
+	if len(flds) > 0 {
+		tgd = append(tgd, ',')
+	}
+	tgd = append(tgd, bytes.TrimSpace(body[1:])...)
+
+	resp.SetBodyRaw(tgd)
+}
+
+// validRequestID reports whether the request ID provided by the client can be
+// used (and logged) as it is
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '/', c == ':', c == '+', c == '=', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
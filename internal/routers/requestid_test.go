@@ -0,0 +1,90 @@
+package routers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+func TestIdentifyRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		generate bool
+	}{
+		{name: "accepts client ID", id: "3f2c9a1e-7b4d-4c1a-9e2f-8d6b5a4c3b2a"},
+		{name: "generates missing ID", generate: true},
+		{name: "replaces ID with unsafe characters", id: `abc" injected="1`, generate: true},
+		{name: "replaces ID that is too long", id: strings.Repeat("a", maxRequestIDLength+1), generate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fwd, ctxID string
+			hndlr := identifyRequest(func(ctx *fasthttp.RequestCtx) {
+				fwd = string(ctx.Request.Header.Peek(models.HeaderRequestID))
+				ctxID = models.ContextRequestID(ctx)
+
+				// runner response headers replace those set ahead of next
+				ctx.Response.Header.Reset()
+			})
+
+			ctx := &fasthttp.RequestCtx{}
+			if tt.id != "" {
+				ctx.Request.Header.Set(models.HeaderRequestID, tt.id)
+			}
+			hndlr(ctx)
+
+			got := string(ctx.Response.Header.Peek(models.HeaderRequestID))
+			if tt.generate && (got == tt.id || len(got) != 32) {
+				t.Errorf("identifyRequest() response ID = %q, want a generated ID", got)
+			}
+
+			if !tt.generate && got != tt.id {
+				t.Errorf("identifyRequest() response ID = %q, want %q", got, tt.id)
+			}
+
+			if fwd != got || ctxID != got {
+				t.Errorf("identifyRequest() forwarded ID = %q, context ID = %q, want %q", fwd, ctxID, got)
+			}
+		})
+	}
+}
+
+func TestTagErrorBody(t *testing.T) {
+	tests := []struct {
+		name string
+		ct   string
+		enc  string
+		body string
+		want string
+	}{
+		{name: "plain text", ct: "text/plain; charset=utf-8", body: "Not Found", want: "Not Found (request ID: abc123)"},
+		{name: "json object", ct: "application/json", body: `{"error":"rate limit exceeded","scope":"ip"}`, want: `{"requestId":"abc123","error":"rate limit exceeded","scope":"ip"}`},
+		{name: "empty json object", ct: "application/json", body: `{ }`, want: `{"requestId":"abc123"}`},
+		{name: "json object with request ID", ct: "application/json", body: `{"requestId":"other"}`, want: `{"requestId":"other"}`},
+		{name: "json array", ct: "application/json", body: `[{"error":"x"}]`, want: `[{"error":"x"}]`},
+		{name: "invalid json", ct: "application/json", body: `{"error":`, want: `{"error":`},
+		{name: "encoded body", ct: "application/json", enc: "gzip", body: `{"error":"x"}`, want: `{"error":"x"}`},
+		{name: "html", ct: "text/html", body: "<h1>Bad Gateway</h1>", want: "<h1>Bad Gateway</h1>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &fasthttp.Response{}
+			resp.Header.SetContentType(tt.ct)
+			if tt.enc != "" {
+				resp.Header.SetContentEncoding(tt.enc)
+			}
+			resp.SetBodyString(tt.body)
+
+			tagErrorBody(resp, "abc123")
+
+			if got := string(resp.Body()); got != tt.want {
+				t.Errorf("tagErrorBody(%q) = %q, want %q", tt.body, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,10 @@
 package routers
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
+	"sync/atomic"
 
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
@@ -11,39 +12,525 @@ import (
 	"go.jtlabs.io/runner-gateway/internal/models"
 )
 
-func Register(s *models.Settings, as interfaces.AuthorizationService, gs interfaces.GatewayService) (fasthttp.RequestHandler, error) {
+// Services are the services the gateway routes are registered with
+type Services struct {
+	AccessLog     interfaces.AccessLogService
+	Authorization interfaces.AuthorizationService
+	Catalog       interfaces.CatalogService
+	Gateway       interfaces.GatewayService
+	Quota         interfaces.QuotaService
+	RateLimit     interfaces.RateLimitService
+	Readiness     interfaces.ReadinessService
+	Tracing       interfaces.TracingService
+	Usage         interfaces.UsageService
+}
+
+func Register(s *models.Settings, svcs Services) (fasthttp.RequestHandler, error) {
 	log.Trace().
 		Str("package", "routers").
 		Int("models", len(s.Runners)).
 		Msg("Registering routes")
 
-	pths := map[string]fasthttp.RequestHandler{}
+	ht := newHostTable()
+	rt := ht.dflt
 	for _, rnr := range s.Runners {
-		if _, ok := pths[rnr.Path]; ok {
-			return nil, fmt.Errorf("duplicate runner path detected in settings: %s (runner: %s)", rnr.Path, rnr.Name)
+		if err := rnr.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid settings for runner %s: %w", rnr.Name, err)
+		}
+
+		// runners with hostnames are added to the table of each virtual host
+		vts := ht.tables(rnr.Hostnames)
+		for _, vt := range vts {
+			if vt.has(rnr.Match, rnr.Path) {
+				return nil, fmt.Errorf("duplicate runner path detected in settings: %s (runner: %s)", rnr.Path, rnr.Name)
+			}
+		}
+
+		hsts := []string{}
+		for _, u := range rnr.Upstreams() {
+			hsts = append(hsts, u.Host)
 		}
 
 		log.Debug().
-			Str("host", rnr.Host).
+			Str("balancer", rnr.Balancer).
+			Strs("hostnames", rnr.Hostnames).
+			Strs("hosts", hsts).
+			Str("match", rnr.Match).
 			Str("path", rnr.Path).
 			Str("scheme", rnr.Scheme).
 			Msgf("Registering handler for model %s", rnr.Name)
 
-		pths[rnr.Path] = as.AuthorizeRequest(gs.ForwardRequest(rnr.Host, rnr.Path, rnr.Scheme))
+		hndlr := svcs.forwarder(rnr, rnr, rnr.Prefix(), true)
+		for _, vt := range vts {
+			if err := vt.add(rnr.Match, rnr.Path, hndlr); err != nil {
+				return nil, fmt.Errorf("invalid path for runner %s: %w", rnr.Name, err)
+			}
+		}
 	}
 
-	return func(ctx *fasthttp.RequestCtx) {
+	// register model-aware routing across all runners, when configured
+	if pth := s.ModelRouting.Path; pth != "" {
+		if rt.has(models.MatchPrefix, pth) {
+			return nil, fmt.Errorf("model routing path conflicts with a runner path in settings: %s", pth)
+		}
+
+		log.Debug().
+			Str("path", pth).
+			Msg("Registering handler for model routing")
+
+		// each runner is forwarded to with the model routing path removed
+		fwds := map[string]fasthttp.RequestHandler{}
+		for _, rnr := range s.Runners {
+			vr := rnr
+			vr.Match = models.MatchPrefix
+			vr.Path = pth
+			fwds[rnr.Key()] = svcs.forwarder(rnr, vr, pth, false)
+		}
+
+		// runner listings are aggregated across all runners
+		aggrs := map[string]fasthttp.RequestHandler{
+			"/api/ps":   aggregateModels(s.Runners, svcs.Catalog, "/api/ps"),
+			"/api/tags": aggregateModels(s.Runners, svcs.Catalog, "/api/tags"),
+		}
+
+		rbm := routeByModel(s.Runners, svcs.Catalog, pth, fwds)
+		rt.addPrefix(pth, svcs.Authorization.AuthorizeRequest(nil, func(ctx *fasthttp.RequestCtx) {
+			rel := models.Runner{Path: pth}.RelativePath(string(ctx.URI().Path()))
+			if aggr, ok := aggrs[rel]; ok && ctx.IsGet() {
+				aggr(ctx)
+				return
+			}
+
+			rbm(ctx)
+		}))
+	}
+
+	// register the admin endpoints, when configured
+	if pth := s.Admin.Path; pth != "" {
+		if rt.has(models.MatchPrefix, pth) {
+			return nil, fmt.Errorf("admin path conflicts with another path in settings: %s", pth)
+		}
+
+		if err := s.Admin.Claims.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid settings for admin: %w", err)
+		}
+
+		log.Debug().
+			Str("path", pth).
+			Msg("Registering handler for admin endpoints")
+
+		rt.addPrefix(pth, svcs.Authorization.AuthorizeRequest(s.Admin.Claims, adminHandler(pth, svcs.Gateway, svcs.Quota, svcs.Usage)))
+	}
+
+	// register the liveness and readiness probes, which are not authorized so
+	// that they can be called by orchestrators
+	prbs := map[string]fasthttp.RequestHandler{}
+	if pth := s.Probes.LivenessPath; pth != "" {
+		prbs[pth] = func(ctx *fasthttp.RequestCtx) {
+			respondJSON(ctx, fasthttp.StatusOK, map[string]string{"status": "ok"})
+		}
+	}
+
+	if pth := s.Probes.ReadinessPath; pth != "" {
+		prbs[pth] = readinessHandler(svcs.Readiness)
+	}
+
+	for pth, prb := range prbs {
+		if rt.has(models.MatchPrefix, pth) || rt.has(models.MatchExact, pth) {
+			return nil, fmt.Errorf("probe path conflicts with another path in settings: %s", pth)
+		}
+
+		log.Debug().
+			Str("path", pth).
+			Msg("Registering handler for probe")
+
+		rt.addExact(pth, prb)
+	}
+
+	// register runner selection by header (matched against runner names),
+	// when configured
+	var sel fasthttp.RequestHandler
+	if hdr := s.RunnerSelection.Header; hdr != "" {
+		nms := map[string]namedRunner{}
+		for _, rnr := range s.Runners {
+			if rnr.Name == "" {
+				return nil, fmt.Errorf("runner name is required to select runners by header (path: %s)", rnr.Path)
+			}
+
+			if _, ok := nms[rnr.Name]; ok {
+				return nil, fmt.Errorf("duplicate runner name detected in settings: %s", rnr.Name)
+			}
+
+			// the request path is made relative to the route it matched
+			// before it is forwarded to the runner selected
+			vr := rnr
+			vr.Match = models.MatchPrefix
+			vr.Path = ""
+			nms[rnr.Name] = namedRunner{
+				hndlr: svcs.forwarder(rnr, vr, "", false),
+				rnr:   rnr,
+			}
+		}
+
+		log.Debug().
+			Str("claim", s.RunnerSelection.Claim).
+			Str("header", hdr).
+			Msg("Registering handler for runner selection")
+
+		sel = svcs.Authorization.AuthorizeRequest(nil, selectRunner(hdr, s.RunnerSelection.Claim, nms))
+	}
+
+	rte := func(ctx *fasthttp.RequestCtx) {
 		in := string(ctx.URI().Path())
-		for pth := range pths {
-			if strings.HasPrefix(in, pth) {
-				pths[pth](ctx)
+		hst := string(ctx.Host())
+
+		// the TLS SNI name is used when no Host is provided, and requests for
+		// a virtual host other than the one negotiated are rejected
+		if ctx.IsTLS() {
+			if sni := ctx.TLSConnectionState().ServerName; sni != "" {
+				if hst == "" {
+					hst = sni
+				}
+
+				if ht.lookup(hst) != ht.lookup(sni) {
+					requestLog(ctx).Warn().
+						Str("host", hst).
+						Str("path", in).
+						Str("sni", sni).
+						Msg("Host does not match TLS server name")
+					ctx.SetStatusCode(fasthttp.StatusMisdirectedRequest)
+					ctx.SetBodyString("Misdirected Request")
+					return
+				}
+			}
+		}
+
+		r, ok := ht.route(hst, in)
+
+		// a runner selected by header takes the place of the runner matched
+		// by path (other than for probes)
+		if sel != nil && len(ctx.Request.Header.Peek(s.RunnerSelection.Header)) > 0 {
+			if _, prb := prbs[in]; !prb {
+				if ok && len(r.pfx) > 1 {
+					ctx.URI().SetPath(models.Runner{Path: r.pfx}.RelativePath(in))
+				}
+
+				sel(ctx)
 				return
 			}
 		}
 
+		if ok {
+			r.hndlr(ctx)
+			return
+		}
+
 		// handle the multiple scenarios (multiple runners)
-		log.Warn().Str("path", in).Msg("No handler found for path")
+		requestLog(ctx).Warn().Str("host", hst).Str("path", in).Msg("No handler found for path")
 		ctx.SetStatusCode(http.StatusNotFound)
 		ctx.SetBodyString("Not Found")
-	}, nil
+	}
+
+	// requests are traced and limited per client IP address and across the
+	// gateway ahead of authorization (other than probes)... every request is
+	// written to the access log once identified
+	lmtd := svcs.Tracing.TraceRequest(svcs.RateLimit.LimitClients(rte))
+	return svcs.AccessLog.LogRequest(identifyRequest(func(ctx *fasthttp.RequestCtx) {
+		if _, prb := prbs[string(ctx.URI().Path())]; prb {
+			rte(ctx)
+			return
+		}
+
+		lmtd(ctx)
+	})), nil
+}
+
+// forwarder returns the handler forwarding requests to the runner, where vr
+// is the runner as the request reached it (i.e. at the model routing path)
+// and pth is the prefix removed before forwarding... the runner required
+// claims are authorized only when authorize is set, as routes that choose
+// the runner from the request check the claims themselves. Errors of the
+// gateway itself are reported in the form of the runner front-end API (i.e.
+// Anthropic), as the runner errors are
+func (svcs Services) forwarder(rnr models.Runner, vr models.Runner, pth string, authorize bool) fasthttp.RequestHandler {
+	hndlr := svcs.RateLimit.LimitRunner(rnr, enforcePolicy(vr, enforceModels(vr, svcs.Quota.EnforceQuotas(rnr, svcs.Gateway.ForwardRequest(rnr, pth)))))
+	if authorize {
+		hndlr = svcs.Authorization.AuthorizeRequest(rnr.Claims, hndlr)
+	}
+
+	return svcs.Gateway.TranslateFailures(vr, hndlr)
+}
+
+// adminHandler serves the gateway admin endpoints (i.e. runner host health,
+// quota usage and the usage totals of this gateway instance, optionally for a
+// single account or subject)
+func adminHandler(pth string, gs interfaces.GatewayService, qs interfaces.QuotaService, us interfaces.UsageService) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		rel := models.Runner{Path: pth}.RelativePath(string(ctx.URI().Path()))
+
+		switch {
+		case rel == "/health" && ctx.IsGet():
+			respondJSON(ctx, fasthttp.StatusOK, map[string]any{"runners": gs.Health()})
+		case rel == "/quotas" && ctx.IsGet():
+			acct := string(ctx.QueryArgs().Peek("account"))
+			respondJSON(ctx, fasthttp.StatusOK, map[string]any{"quotas": qs.Quotas(acct)})
+		case rel == "/usage" && ctx.IsGet():
+			sbj := string(ctx.QueryArgs().Peek("subject"))
+			respondJSON(ctx, fasthttp.StatusOK, map[string]any{"usage": us.Totals(sbj)})
+		default:
+			respondJSON(ctx, fasthttp.StatusNotFound, map[string]string{
+				"error": "admin endpoint not found: " + string(ctx.Method()) + " " + rel,
+			})
+		}
+	}
+}
+
+// aggregateModels responds with the models listed by the runner endpoint (i.e.
+// /api/tags or /api/ps) merged across each of the runners the token is
+// permitted to use, with the runner name added to each model
+func aggregateModels(rnrs []models.Runner, cs interfaces.CatalogService, ep string) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		clms := models.ContextClaims(ctx)
+
+		avl := []models.Runner{}
+		for _, rnr := range rnrs {
+			if _, ok := clms.Satisfies(rnr.Claims); ok && rnr.Policy.Permits(fasthttp.MethodGet, clms, ep) {
+				avl = append(avl, rnr)
+			}
+		}
+
+		mdls := []map[string]any{}
+		errs := []map[string]string{}
+		for _, rslt := range cs.Collect(ep, avl...) {
+			if rslt.Err != nil {
+				errs = append(errs, map[string]string{
+					"error":  rslt.Err.Error(),
+					"runner": rslt.Runner.Name,
+				})
+				continue
+			}
+
+			for _, mdl := range rslt.Models {
+				// only list the models the token is permitted to use
+				if !rslt.Runner.Models.Permits(models.ModelName(mdl), clms) {
+					continue
+				}
+
+				mdl["runner"] = rslt.Runner.Name
+				mdls = append(mdls, mdl)
+			}
+		}
+
+		body := map[string]any{"models": mdls}
+		if len(errs) > 0 {
+			body["errors"] = errs
+		}
+
+		respondJSON(ctx, fasthttp.StatusOK, body)
+	}
+}
+
+// routeByModel forwards the request to a runner that has the model requested
+// available (and that the token is permitted to use), alternating between
+// runners when more than one is suitable
+func routeByModel(rnrs []models.Runner, cs interfaces.CatalogService, pth string, fwds map[string]fasthttp.RequestHandler) fasthttp.RequestHandler {
+	var nxt uint32
+
+	return func(ctx *fasthttp.RequestCtx) {
+		clms := models.ContextClaims(ctx)
+		rel := models.Runner{Path: pth}.RelativePath(string(ctx.URI().Path()))
+
+		mdl, ok := models.RequestModel(ctx, rel)
+		if !ok || mdl == "" {
+			respondJSON(ctx, fasthttp.StatusBadRequest, map[string]string{
+				"error": "a model must be specified in the request body to route the request",
+			})
+			return
+		}
+
+		// determine which runners the token is permitted to use
+		prmt := map[string]bool{}
+		avl := []models.Runner{}
+		for _, rnr := range rnrs {
+			if _, ok := clms.Satisfies(rnr.Claims); ok {
+				prmt[rnr.Key()] = true
+				avl = append(avl, rnr)
+			}
+		}
+
+		cnds := []models.Runner{}
+		for _, rnr := range cs.Runners(mdl) {
+			if prmt[rnr.Key()] {
+				cnds = append(cnds, rnr)
+			}
+		}
+
+		if len(cnds) == 0 {
+			requestLog(ctx).Warn().
+				Str("model", mdl).
+				Str("subject", clms.Subject()).
+				Msg("No runner found for model")
+			respondJSON(ctx, fasthttp.StatusNotFound, map[string]any{
+				"available": cs.Models(avl...),
+				"error":     fmt.Sprintf("model %q not found on any runner", mdl),
+				"model":     mdl,
+			})
+			return
+		}
+
+		rnr := cnds[int(atomic.AddUint32(&nxt, 1)-1)%len(cnds)]
+
+		requestLog(ctx).Debug().
+			Str("model", mdl).
+			Str("runner", rnr.Name).
+			Msg("Routing request by model")
+
+		fwds[rnr.Key()](ctx)
+	}
+}
+
+// enforcePolicy ensures the runner endpoint requested (and the Ollama API
+// endpoint it is translated to, for front-end protocols) is permitted by the
+// runner policy before calling next
+func enforcePolicy(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		mthd := string(ctx.Method())
+		pth := rnr.RelativePath(string(ctx.URI().Path()))
+		clms := models.ContextClaims(ctx)
+
+		// rules written for the Ollama API apply however it is reached
+		pths := []string{pth}
+		if rpth, ok := models.TranslatedPath(rnr.Protocol, pth); ok {
+			pths = append(pths, rpth)
+		}
+
+		if !rnr.Policy.Permits(mthd, clms, pths...) {
+			requestLog(ctx).Warn().
+				Str("method", mthd).
+				Str("path", pth).
+				Str("runner", rnr.Name).
+				Str("subject", clms.Subject()).
+				Msg("Endpoint not permitted by runner policy")
+			ctx.Error("Endpoint is not permitted: "+mthd+" "+pth, fasthttp.StatusForbidden)
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// enforceModels ensures the model requested (for endpoints that specify one in
+// the request body) is permitted by the runner model policy before calling next
+func enforceModels(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if len(rnr.Models.Allow) == 0 && rnr.Models.Claim == "" {
+		return next
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		clms := models.ContextClaims(ctx)
+		mdl, ok := models.RequestModel(ctx, rnr.RelativePath(string(ctx.URI().Path())))
+
+		if ok && !rnr.Models.Permits(mdl, clms) {
+			requestLog(ctx).Warn().
+				Str("model", mdl).
+				Str("runner", rnr.Name).
+				Str("subject", clms.Subject()).
+				Msg("Model not permitted by runner policy")
+			respondJSON(ctx, fasthttp.StatusForbidden, map[string]string{
+				"error": fmt.Sprintf("model %q is not permitted", mdl),
+				"model": mdl,
+			})
+			return
+		}
+
+		next(ctx)
+	}
+}
+
+// namedRunner is a runner that may be selected by name
+type namedRunner struct {
+	hndlr fasthttp.RequestHandler
+	rnr   models.Runner
+}
+
+// selectRunner forwards the request to the runner named in the header, when
+// the token is permitted to use it... the claim (when configured) lists the
+// runner names the token may select, where "*" permits any runner
+func selectRunner(hdr string, clm string, rnrs map[string]namedRunner) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		clms := models.ContextClaims(ctx)
+		nm := string(ctx.Request.Header.Peek(hdr))
+
+		nr, ok := rnrs[nm]
+		if !ok {
+			requestLog(ctx).Warn().
+				Str("runner", nm).
+				Str("subject", clms.Subject()).
+				Msg("No runner found for name")
+			respondJSON(ctx, fasthttp.StatusNotFound, map[string]string{
+				"error":  fmt.Sprintf("runner %q not found", nm),
+				"runner": nm,
+			})
+			return
+		}
+
+		if clm != "" && !clms.HasAny(clm, []string{nm, "*"}) {
+			requestLog(ctx).Warn().
+				Str("claim", clm).
+				Str("runner", nm).
+				Str("subject", clms.Subject()).
+				Msg("Runner not permitted by token claim")
+			respondJSON(ctx, fasthttp.StatusForbidden, map[string]string{
+				"error":  fmt.Sprintf("runner %q is not permitted", nm),
+				"runner": nm,
+			})
+			return
+		}
+
+		if name, ok := clms.Satisfies(nr.rnr.Claims); !ok {
+			requestLog(ctx).Warn().
+				Str("claim", name).
+				Str("runner", nm).
+				Str("subject", clms.Subject()).
+				Msg("Token is missing a required claim")
+			ctx.Error("Token is missing required claim: "+name, fasthttp.StatusForbidden)
+			return
+		}
+
+		// the selection is not passed on to the runner
+		ctx.Request.Header.Del(hdr)
+
+		requestLog(ctx).Debug().
+			Str("runner", nm).
+			Msg("Routing request by runner name")
+
+		nr.hndlr(ctx)
+	}
+}
+
+// readinessHandler responds with the gateway readiness, using 503 Service
+// Unavailable when the gateway is not ready
+func readinessHandler(rs interfaces.ReadinessService) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		rdy := rs.Readiness()
+
+		code := fasthttp.StatusOK
+		if !rdy.Ready {
+			code = fasthttp.StatusServiceUnavailable
+		}
+
+		respondJSON(ctx, code, rdy)
+	}
+}
+
+func respondJSON(ctx *fasthttp.RequestCtx, code int, v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetStatusCode(code)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
 }
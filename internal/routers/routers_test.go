@@ -0,0 +1,116 @@
+package routers
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/interfaces"
+	"go.jtlabs.io/runner-gateway/internal/models"
+	"go.jtlabs.io/runner-gateway/internal/services"
+)
+
+// testAuthorization authorizes every request, so that routes can be tested
+// without tokens
+type testAuthorization struct {
+	interfaces.AuthorizationService
+}
+
+func (testAuthorization) AuthorizeRequest(_ models.ClaimRequirements, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return next
+}
+
+// serve serves the handler on a loopback address, returning the address
+func serve(t *testing.T, hndlr fasthttp.RequestHandler) string {
+	t.Helper()
+
+	lstnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svr := &fasthttp.Server{Handler: hndlr}
+	go svr.Serve(lstnr)
+	t.Cleanup(func() { svr.Shutdown() })
+
+	return lstnr.Addr().String()
+}
+
+// testServices returns the gateway services for the settings, with requests
+// authorized by testAuthorization
+func testServices(t *testing.T, s *models.Settings) Services {
+	t.Helper()
+
+	al, err := services.NewAccessLogService(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qs, err := services.NewQuotaService(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ls, err := services.NewRateLimitService(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := services.NewTracingService(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Services{
+		AccessLog:     al,
+		Authorization: testAuthorization{},
+		Gateway:       services.NewGatewayService(s, nil),
+		Quota:         qs,
+		RateLimit:     ls,
+		Tracing:       ts,
+	}
+}
+
+func TestRegisterSharedPath(t *testing.T) {
+	// each runner host responds with the name of the runner it serves
+	upstream := func(nm string) string {
+		return serve(t, func(ctx *fasthttp.RequestCtx) {
+			ctx.SetBodyString(nm)
+		})
+	}
+
+	s := &models.Settings{}
+	s.Runners = []models.Runner{
+		{Host: upstream("exact"), Match: models.MatchExact, Name: "exact", Path: "/ollama", Scheme: "http"},
+		{Host: upstream("prefix"), Name: "prefix", Path: "/ollama", Scheme: "http"},
+	}
+
+	hndlr, err := Register(s, testServices(t, s))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	addr := serve(t, hndlr)
+
+	tests := []struct {
+		name string
+		pth  string
+		want string
+	}{
+		{name: "exact runner", pth: "/ollama", want: "exact"},
+		{name: "prefix runner", pth: "/ollama/api/tags", want: "prefix"},
+		{name: "exact runner again", pth: "/ollama", want: "exact"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, body, err := fasthttp.Get(nil, "http://"+addr+tt.pth)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if code != fasthttp.StatusOK || string(body) != tt.want {
+				t.Errorf("response = %d %q, want 200 %q", code, body, tt.want)
+			}
+		})
+	}
+}
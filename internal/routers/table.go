@@ -0,0 +1,157 @@
+package routers
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// routeTable matches inbound request paths to handlers deterministically...
+// exact routes are matched first, then regex routes (in the order they were
+// added) and finally the longest prefix route, where prefixes only match on
+// path segment boundaries (i.e. /ollama matches /ollama/api/tags but not
+// /ollama2/api/tags)
+type routeTable struct {
+	exact    map[string]fasthttp.RequestHandler
+	prefixes []prefixRoute
+	regexes  []regexRoute
+}
+
+type prefixRoute struct {
+	hndlr fasthttp.RequestHandler
+	pfx   string
+}
+
+type regexRoute struct {
+	hndlr fasthttp.RequestHandler
+	re    *regexp.Regexp
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{
+		exact: map[string]fasthttp.RequestHandler{},
+	}
+}
+
+// add registers a handler for the path using the match type (prefix when
+// empty)
+func (t *routeTable) add(mtch string, pth string, hndlr fasthttp.RequestHandler) error {
+	switch mtch {
+	case "", models.MatchPrefix:
+		return t.addPrefix(pth, hndlr)
+	case models.MatchExact:
+		return t.addExact(pth, hndlr)
+	case models.MatchRegex:
+		return t.addRegex(pth, hndlr)
+	default:
+		return fmt.Errorf("unsupported match type %q for path %s", mtch, pth)
+	}
+}
+
+func (t *routeTable) addExact(pth string, hndlr fasthttp.RequestHandler) error {
+	if _, ok := t.exact[pth]; ok {
+		return fmt.Errorf("duplicate exact path: %s", pth)
+	}
+
+	t.exact[pth] = hndlr
+
+	return nil
+}
+
+func (t *routeTable) addPrefix(pth string, hndlr fasthttp.RequestHandler) error {
+	pfx := normalizePrefix(pth)
+	if t.hasPrefix(pfx) {
+		return fmt.Errorf("duplicate path: %s", pth)
+	}
+
+	t.prefixes = append(t.prefixes, prefixRoute{hndlr: hndlr, pfx: pfx})
+
+	// longest prefixes are evaluated first
+	sort.SliceStable(t.prefixes, func(i, j int) bool {
+		return len(t.prefixes[i].pfx) > len(t.prefixes[j].pfx)
+	})
+
+	return nil
+}
+
+func (t *routeTable) addRegex(ptrn string, hndlr fasthttp.RequestHandler) error {
+	for _, r := range t.regexes {
+		if r.re.String() == ptrn {
+			return fmt.Errorf("duplicate path pattern: %s", ptrn)
+		}
+	}
+
+	re, err := regexp.Compile(ptrn)
+	if err != nil {
+		return fmt.Errorf("invalid path pattern %q: %w", ptrn, err)
+	}
+
+	t.regexes = append(t.regexes, regexRoute{hndlr: hndlr, re: re})
+
+	return nil
+}
+
+// has reports whether a route has been registered for the path using the match
+// type (prefix when empty)
+func (t *routeTable) has(mtch string, pth string) bool {
+	switch mtch {
+	case "", models.MatchPrefix:
+		return t.hasPrefix(normalizePrefix(pth))
+	case models.MatchExact:
+		_, ok := t.exact[pth]
+		return ok
+	case models.MatchRegex:
+		for _, r := range t.regexes {
+			if r.re.String() == pth {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (t *routeTable) hasPrefix(pfx string) bool {
+	for _, r := range t.prefixes {
+		if r.pfx == pfx {
+			return true
+		}
+	}
+
+	return false
+}
+
+// route returns the route for the inbound request path, along with the prefix
+// matched (which is empty for exact and regex routes)
+func (t *routeTable) route(pth string) (prefixRoute, bool) {
+	if hndlr, ok := t.exact[pth]; ok {
+		return prefixRoute{hndlr: hndlr}, true
+	}
+
+	for _, r := range t.regexes {
+		if r.re.MatchString(pth) {
+			return prefixRoute{hndlr: r.hndlr}, true
+		}
+	}
+
+	for _, r := range t.prefixes {
+		if r.pfx == "/" || pth == r.pfx || strings.HasPrefix(pth, r.pfx+"/") {
+			return r, true
+		}
+	}
+
+	return prefixRoute{}, false
+}
+
+// normalizePrefix removes any trailing slash from a prefix (other than the root)
+func normalizePrefix(pth string) string {
+	if pfx := strings.TrimSuffix(pth, "/"); pfx != "" {
+		return pfx
+	}
+
+	return "/"
+}
@@ -0,0 +1,224 @@
+package routers
+
+import (
+	"math/rand/v2"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+type testRoute struct {
+	mtch string
+	name string
+	pth  string
+}
+
+func named(nm string) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString(nm)
+	}
+}
+
+// routed returns the name of the route for the path ("" when none)
+func routed(r prefixRoute, ok bool) string {
+	if !ok {
+		return ""
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	r.hndlr(ctx)
+
+	return string(ctx.Response.Body())
+}
+
+func TestRouteTableRoute(t *testing.T) {
+	rts := []testRoute{
+		{name: "root", pth: "/"},
+		{name: "corp", pth: "/corp-ollama"},
+		{name: "ollama", pth: "/ollama"},
+		{name: "ollama-gpu", pth: "/ollama/gpu/"},
+		{mtch: models.MatchExact, name: "version", pth: "/ollama/api/version"},
+		{mtch: models.MatchRegex, name: "embed", pth: `^/v[0-9]+/embeddings$`},
+		{mtch: models.MatchRegex, name: "versioned", pth: `^/v[0-9]+/`},
+	}
+
+	tests := []struct {
+		name string
+		pth  string
+		want string
+	}{
+		{name: "root", pth: "/", want: "root"},
+		{name: "root catches unmatched paths", pth: "/api/tags", want: "root"},
+		{name: "prefix matches itself", pth: "/corp-ollama", want: "corp"},
+		{name: "prefix matches child path", pth: "/corp-ollama/api/tags", want: "corp"},
+		{name: "longest prefix wins", pth: "/ollama/gpu/api/chat", want: "ollama-gpu"},
+		{name: "prefix with trailing slash matches itself", pth: "/ollama/gpu", want: "ollama-gpu"},
+		{name: "prefix matches on segment boundary", pth: "/ollama/api/tags", want: "ollama"},
+		{name: "prefix does not match partial segment", pth: "/ollama2/api/tags", want: "root"},
+		{name: "prefix does not match partial nested segment", pth: "/ollama/gpu2/api/tags", want: "ollama"},
+		{name: "exact match wins over prefix", pth: "/ollama/api/version", want: "version"},
+		{name: "exact match requires the full path", pth: "/ollama/api/version/", want: "ollama"},
+		{name: "regex match wins over prefix", pth: "/v1/chat/completions", want: "versioned"},
+		{name: "regex routes are matched in order", pth: "/v1/embeddings", want: "embed"},
+		{name: "regex does not match", pth: "/vx/embeddings", want: "root"},
+	}
+
+	// routes are added in a different order on each pass to prove that the
+	// order they are configured in does not change which route is matched
+	for pass := 0; pass < 25; pass++ {
+		order := append([]testRoute{}, rts...)
+		if pass > 0 {
+			rand.Shuffle(len(order), func(i, j int) {
+				// regex routes keep their relative order, as it is significant
+				if order[i].mtch != models.MatchRegex && order[j].mtch != models.MatchRegex {
+					order[i], order[j] = order[j], order[i]
+				}
+			})
+		}
+
+		tbl := newRouteTable()
+		for _, rt := range order {
+			if err := tbl.add(rt.mtch, rt.pth, named(rt.name)); err != nil {
+				t.Fatalf("add(%q, %q) error = %v", rt.mtch, rt.pth, err)
+			}
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				for i := 0; i < 10; i++ {
+					if got := routed(tbl.route(tt.pth)); got != tt.want {
+						t.Fatalf("route(%q) = %q, want %q", tt.pth, got, tt.want)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRouteTableNoMatch(t *testing.T) {
+	tbl := newRouteTable()
+	tbl.add("", "/ollama", named("ollama"))
+	tbl.add(models.MatchExact, "/healthz", named("healthz"))
+
+	tests := []struct {
+		name string
+		pth  string
+	}{
+		{name: "unrelated path", pth: "/api/tags"},
+		{name: "partial segment", pth: "/ollamas"},
+		{name: "exact path with suffix", pth: "/healthz/live"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := routed(tbl.route(tt.pth)); got != "" {
+				t.Errorf("route(%q) = %q, want no match", tt.pth, got)
+			}
+		})
+	}
+}
+
+func TestRouteTablePrefix(t *testing.T) {
+	tbl := newRouteTable()
+	tbl.add("", "/", named("root"))
+	tbl.add("", "/ollama/", named("ollama"))
+	tbl.add(models.MatchExact, "/ollama/api/version", named("version"))
+	tbl.add(models.MatchRegex, `^/v[0-9]+/`, named("versioned"))
+
+	// the prefix matched is removed from paths by runner selection, so exact
+	// and regex routes report none
+	tests := []struct {
+		name string
+		pth  string
+		want string
+	}{
+		{name: "root prefix", pth: "/api/tags", want: "/"},
+		{name: "prefix without trailing slash", pth: "/ollama/api/tags", want: "/ollama"},
+		{name: "exact route", pth: "/ollama/api/version", want: ""},
+		{name: "regex route", pth: "/v1/models", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, ok := tbl.route(tt.pth)
+			if !ok {
+				t.Fatalf("route(%q) found no route", tt.pth)
+			}
+
+			if r.pfx != tt.want {
+				t.Errorf("route(%q) prefix = %q, want %q", tt.pth, r.pfx, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteTableAdd(t *testing.T) {
+	tests := []struct {
+		name    string
+		rts     []testRoute
+		wantErr bool
+	}{
+		{
+			name: "distinct routes",
+			rts: []testRoute{
+				{pth: "/"},
+				{pth: "/ollama"},
+				{mtch: models.MatchExact, pth: "/ollama"},
+				{mtch: models.MatchRegex, pth: "^/ollama"},
+			},
+		},
+		{
+			name:    "duplicate prefix",
+			rts:     []testRoute{{pth: "/ollama"}, {mtch: models.MatchPrefix, pth: "/ollama"}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate prefix with trailing slash",
+			rts:     []testRoute{{pth: "/ollama"}, {pth: "/ollama/"}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate root",
+			rts:     []testRoute{{pth: "/"}, {pth: ""}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate exact",
+			rts:     []testRoute{{mtch: models.MatchExact, pth: "/healthz"}, {mtch: models.MatchExact, pth: "/healthz"}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate regex",
+			rts:     []testRoute{{mtch: models.MatchRegex, pth: "^/v1/"}, {mtch: models.MatchRegex, pth: "^/v1/"}},
+			wantErr: true,
+		},
+		{
+			name:    "invalid regex",
+			rts:     []testRoute{{mtch: models.MatchRegex, pth: "^/v1/("}},
+			wantErr: true,
+		},
+		{
+			name:    "unsupported match",
+			rts:     []testRoute{{mtch: "glob", pth: "/ollama/*"}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tbl := newRouteTable()
+
+			var err error
+			for _, rt := range tt.rts {
+				if err = tbl.add(rt.mtch, rt.pth, named(rt.name)); err != nil {
+					break
+				}
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Errorf("add() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
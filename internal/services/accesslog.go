@@ -0,0 +1,272 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const accessKey = "access"
+
+// clfTimeFormat is the time format of the Common and Combined Log Formats
+const clfTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// accessLogService writes a record of each request to the access log, which
+// is kept apart from the diagnostic logs (in JSON, Common Log Format or
+// Combined Log Format)
+type accessLogService struct {
+	frmt string
+	log  zerolog.Logger
+	mu   sync.Mutex
+	out  io.Writer
+	rf   *rotatingFile
+	s    *models.Settings
+}
+
+// accessEntry is the access log record of a request in progress... the record
+// is written once the request has been handled and, for streamed responses,
+// once the stream has ended (whichever is last)
+type accessEntry struct {
+	rec   models.AccessRecord
+	refs  atomic.Int32
+	start time.Time
+	svc   *accessLogService
+}
+
+// NewAccessLogService opens the access log file (or uses stdout) when an
+// access log path is configured
+func NewAccessLogService(s *models.Settings) (*accessLogService, error) {
+	svc := &accessLogService{
+		frmt: s.AccessLog.Format,
+		log:  log.With().Str("service", "accessLog").Logger(),
+		s:    s,
+	}
+
+	if svc.frmt == "" {
+		svc.frmt = models.AccessLogJSON
+	}
+
+	switch svc.frmt {
+	case models.AccessLogCombined, models.AccessLogCommon, models.AccessLogJSON:
+	default:
+		return nil, fmt.Errorf("unsupported access log format: %s (supported: %s, %s and %s)", svc.frmt, models.AccessLogCombined, models.AccessLogCommon, models.AccessLogJSON)
+	}
+
+	switch pth := s.AccessLog.Path; pth {
+	case "":
+		return svc, nil
+	case models.AccessLogStdout:
+		svc.out = os.Stdout
+	default:
+		rf, err := newRotatingFile(pth, int64(s.AccessLog.MaxSize)<<20, s.AccessLog.RotateInterval, s.AccessLog.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+
+		svc.out = rf
+		svc.rf = rf
+	}
+
+	svc.log.Info().
+		Str("format", svc.frmt).
+		Str("path", s.AccessLog.Path).
+		Msg("Writing access log")
+
+	return svc, nil
+}
+
+// Close closes the access log file
+func (svc *accessLogService) Close() error {
+	if svc.rf == nil {
+		return nil
+	}
+
+	return svc.rf.Close()
+}
+
+// LogRequest writes a record of the request to the access log once it has
+// been handled by next
+func (svc *accessLogService) LogRequest(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if svc.out == nil {
+		return next
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		ae := &accessEntry{start: time.Now(), svc: svc}
+		ae.refs.Store(1)
+		ctx.SetUserValue(accessKey, ae)
+
+		next(ctx)
+
+		rec := &ae.rec
+		rec.BytesIn = len(ctx.Request.Body())
+		rec.ClientIP = clientIP(ctx, svc.s.RateLimits.IPHeader, svc.s.RateLimits.TrustedProxies)
+		rec.Method = string(ctx.Method())
+		rec.Model = models.ContextModel(ctx)
+		rec.Path = string(ctx.Path())
+		rec.Protocol = string(ctx.Request.Header.Protocol())
+		rec.Referer = string(ctx.Referer())
+		rec.RequestID = models.ContextRequestID(ctx)
+		rec.Status = ctx.Response.StatusCode()
+		rec.Subject = models.ContextClaims(ctx).Subject()
+		rec.Time = ae.start
+		rec.UserAgent = string(ctx.UserAgent())
+
+		// streamed responses are measured as the stream ends
+		if !ctx.Response.IsBodyStream() {
+			rec.BytesOut = len(ctx.Response.Body())
+			rec.DurationMs = milliseconds(time.Since(ae.start))
+		}
+
+		ae.release()
+	}
+}
+
+// write formats the record and writes it to the access log
+func (svc *accessLogService) write(rec models.AccessRecord) {
+	var ln []byte
+	switch svc.frmt {
+	case models.AccessLogJSON:
+		ln, _ = json.Marshal(rec)
+	default:
+		ln = []byte(commonLogLine(rec, svc.frmt == models.AccessLogCombined))
+	}
+
+	svc.mu.Lock()
+	_, err := svc.out.Write(append(ln, '\n'))
+	svc.mu.Unlock()
+
+	if err != nil {
+		svc.log.Error().
+			Err(err).
+			Str("path", svc.s.AccessLog.Path).
+			Msg("Failed to write access log")
+	}
+}
+
+// contextAccess returns the access log entry of the request, which is nil
+// when the access log is not written
+func contextAccess(ctx *fasthttp.RequestCtx) *accessEntry {
+	ae, _ := ctx.UserValue(accessKey).(*accessEntry)
+	return ae
+}
+
+// hold delays writing the record until the response stream has ended
+func (ae *accessEntry) hold() {
+	if ae == nil {
+		return
+	}
+
+	ae.refs.Add(1)
+}
+
+// release writes the record once both the request has been handled and the
+// response stream (if any) has ended
+func (ae *accessEntry) release() {
+	if ae.refs.Add(-1) == 0 {
+		ae.svc.write(ae.rec)
+	}
+}
+
+// streamed records the response stream once it has ended
+func (ae *accessEntry) streamed(n int) {
+	if ae == nil {
+		return
+	}
+
+	ae.rec.BytesOut = n
+	ae.rec.DurationMs = milliseconds(time.Since(ae.start))
+	ae.release()
+}
+
+// upstream records the runner call of the request
+func (ae *accessEntry) upstream(rnr string, hst string, dur time.Duration) {
+	if ae == nil {
+		return
+	}
+
+	ae.rec.Runner = rnr
+	ae.rec.UpstreamDurationMs = milliseconds(dur)
+	ae.rec.UpstreamHost = hst
+}
+
+// clientIP returns the client IP address, taken from the IP header when
+// configured (i.e. X-Forwarded-For, set by trusted proxies)... each trusted
+// proxy appends the address it received the request from, so the client is
+// the address appended by the outermost proxy (counting hops from the right)
+// and any addresses to the left of it, which the client may have sent, are
+// ignored
+func clientIP(ctx *fasthttp.RequestCtx, hdr string, hops int) string {
+	if hdr == "" {
+		return ctx.RemoteIP().String()
+	}
+
+	addrs := []string{}
+	for _, val := range ctx.Request.Header.PeekAll(hdr) {
+		for _, addr := range strings.Split(string(val), ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	if len(addrs) == 0 {
+		return ctx.RemoteIP().String()
+	}
+
+	// fewer addresses than trusted proxies means the request did not pass
+	// through each of them, so the first address is the nearest to the client
+	return addrs[max(len(addrs)-max(hops, 1), 0)]
+}
+
+// commonLogLine formats the record in the Common Log Format, with the referer
+// and user agent added for the Combined Log Format
+func commonLogLine(rec models.AccessRecord, cmbd bool) string {
+	byts := "-"
+	if rec.BytesOut > 0 {
+		byts = strconv.Itoa(rec.BytesOut)
+	}
+
+	ln := fmt.Sprintf("%s - %s [%s] %s %d %s",
+		clfField(rec.ClientIP),
+		clfField(rec.Subject),
+		rec.Time.Format(clfTimeFormat),
+		strconv.Quote(rec.Method+" "+rec.Path+" "+rec.Protocol),
+		rec.Status,
+		byts)
+
+	if cmbd {
+		ln += " " + strconv.Quote(orDash(rec.Referer)) + " " + strconv.Quote(orDash(rec.UserAgent))
+	}
+
+	return ln
+}
+
+// clfField returns a value for an unquoted field, where empty values are "-"
+// and whitespace would otherwise split the field
+func clfField(val string) string {
+	return orDash(strings.Join(strings.Fields(val), "_"))
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func orDash(val string) string {
+	if val == "" {
+		return "-"
+	}
+
+	return val
+}
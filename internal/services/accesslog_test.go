@@ -0,0 +1,50 @@
+package services
+
+import (
+	"net"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestClientIP(t *testing.T) {
+	const xff = "X-Forwarded-For"
+
+	tests := []struct {
+		name string
+		hdr  string
+		vals []string
+		hops int
+		want string
+	}{
+		{name: "no header configured", vals: []string{"1.1.1.1"}, hops: 1, want: "10.0.0.1"},
+		{name: "header not sent", hdr: xff, hops: 1, want: "10.0.0.1"},
+		{name: "header without addresses", hdr: xff, vals: []string{" , "}, hops: 1, want: "10.0.0.1"},
+		{name: "no trusted proxies counted as one", hdr: xff, vals: []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, want: "3.3.3.3"},
+		{name: "hops below addresses", hdr: xff, vals: []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, hops: 1, want: "3.3.3.3"},
+		{name: "hops below addresses by one", hdr: xff, vals: []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, hops: 2, want: "2.2.2.2"},
+		{name: "hops equal to addresses", hdr: xff, vals: []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, hops: 3, want: "1.1.1.1"},
+		{name: "hops above addresses", hdr: xff, vals: []string{"1.1.1.1, 2.2.2.2, 3.3.3.3"}, hops: 5, want: "1.1.1.1"},
+		{name: "spoofed leftmost address ignored", hdr: xff, vals: []string{"6.6.6.6, 1.1.1.1"}, hops: 1, want: "1.1.1.1"},
+		{name: "addresses across header lines", hdr: xff, vals: []string{"1.1.1.1", "2.2.2.2, 3.3.3.3"}, hops: 2, want: "2.2.2.2"},
+		{name: "empty entries skipped", hdr: xff, vals: []string{"1.1.1.1, , "}, hops: 1, want: "1.1.1.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+
+			for _, val := range tt.vals {
+				req.Header.Add(xff, val)
+			}
+
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Init(req, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 50000}, nil)
+
+			if got := clientIP(ctx, tt.hdr, tt.hops); got != tt.want {
+				t.Errorf("clientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,749 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const (
+	adapterChat       = "chat"
+	adapterEmbed      = "embed"
+	adapterEmbeddings = "embeddings"
+	adapterGenerate   = "generate"
+	adapterModels     = "models"
+)
+
+// openAIAdapter translates Ollama API requests for runners that serve the
+// OpenAI API instead (llama.cpp server, vLLM and TGI), so that clients are
+// presented with the same API regardless of the runner type
+type openAIAdapter struct {
+	typ string
+}
+
+// openAIAdapterExchange translates the runner response to a single Ollama
+// request, gathering the tool calls and usage reported while streaming
+type openAIAdapterExchange struct {
+	calls map[int]*openAIToolCall
+	done  bool
+	kind  string
+	model string
+	rsn   string
+	text  bool
+	typ   string
+	usage openAIUsage
+}
+
+// openAIChoice is a choice of a chat completion or completion response (or a
+// single chunk of one, when streamed)
+type openAIChoice struct {
+	Delta        openAIChoiceMessage `json:"delta"`
+	FinishReason string              `json:"finish_reason"`
+	Message      openAIChoiceMessage `json:"message"`
+	Text         string              `json:"text"`
+}
+
+type openAIChoiceMessage struct {
+	Content          string           `json:"content"`
+	ReasoningContent string           `json:"reasoning_content"`
+	ToolCalls        []openAIToolCall `json:"tool_calls"`
+}
+
+type openAICompletionResponse struct {
+	Choices []openAIChoice `json:"choices"`
+	Error   any            `json:"error"`
+	Model   string         `json:"model"`
+	Usage   *openAIUsage   `json:"usage"`
+}
+
+type openAIEmbeddingResponse struct {
+	Data []struct {
+		Embedding []float64 `json:"embedding"`
+		Index     int       `json:"index"`
+	} `json:"data"`
+	Model string      `json:"model"`
+	Usage openAIUsage `json:"usage"`
+}
+
+type openAIModelsResponse struct {
+	Data []struct {
+		Created int64  `json:"created"`
+		ID      string `json:"id"`
+	} `json:"data"`
+}
+
+// tgiInfoResponse is the TGI /info response, describing the single model the
+// runner serves
+type tgiInfoResponse struct {
+	ModelID string `json:"model_id"`
+}
+
+// newAdapter returns the translator for the runner type, or nil when the
+// runner serves the Ollama API
+func newAdapter(rnr models.Runner) protocol {
+	switch rnr.Type {
+	case models.RunnerTypeLlamaCpp, models.RunnerTypeTGI, models.RunnerTypeVLLM:
+		return &openAIAdapter{typ: rnr.Type}
+	default:
+		return nil
+	}
+}
+
+func (a *openAIAdapter) failure(code int, msg string) []byte {
+	b, _ := json.Marshal(map[string]string{"error": msg})
+	return b
+}
+
+func (a *openAIAdapter) translate(pth string, req *fasthttp.Request) (exchange, string, error) {
+	// other endpoints (i.e. the runner OpenAI API itself) are not translated
+	if !strings.HasPrefix(pth, "/api/") {
+		return nil, "", nil
+	}
+
+	ex := &openAIAdapterExchange{typ: a.typ}
+
+	switch pth {
+	case "/api/chat":
+		ex.kind = adapterChat
+	case "/api/embed":
+		ex.kind = adapterEmbed
+	case "/api/embeddings":
+		ex.kind = adapterEmbeddings
+	case "/api/generate":
+		ex.kind = adapterGenerate
+	case "/api/ps", "/api/tags":
+		// the models served by the runner are always loaded
+		ex.kind = adapterModels
+		req.Header.SetMethod(fasthttp.MethodGet)
+		req.SetBody(nil)
+
+		if a.typ == models.RunnerTypeTGI {
+			return ex, "/info", nil
+		}
+
+		return ex, "/v1/models", nil
+	default:
+		return nil, "", &protocolError{fasthttp.StatusNotImplemented, fmt.Sprintf("%s is not supported by %s runners", pth, a.typ)}
+	}
+
+	if !req.Header.IsPost() {
+		return nil, "", &protocolError{fasthttp.StatusMethodNotAllowed, "method not allowed: " + string(req.Header.Method())}
+	}
+
+	var (
+		body map[string]any
+		err  error
+		rpth string
+	)
+	switch ex.kind {
+	case adapterChat:
+		body, err = ex.chatRequest(req.Body())
+		rpth = "/v1/chat/completions"
+	case adapterEmbed, adapterEmbeddings:
+		if a.typ == models.RunnerTypeTGI {
+			return nil, "", &protocolError{fasthttp.StatusNotImplemented, fmt.Sprintf("%s is not supported by %s runners", pth, a.typ)}
+		}
+
+		body, err = ex.embedRequest(req.Body())
+		rpth = "/v1/embeddings"
+	case adapterGenerate:
+		body, rpth, err = ex.generateRequest(req.Body())
+	}
+
+	if err != nil {
+		return nil, "", &protocolError{fasthttp.StatusBadRequest, err.Error()}
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.SetContentType("application/json")
+	req.SetBody(b)
+
+	return ex, rpth, nil
+}
+
+func (ex *openAIAdapterExchange) body(code int, b []byte) (int, []byte) {
+	if code >= fasthttp.StatusBadRequest {
+		return code, ex.line(map[string]any{"error": openAIErrorMessage(b)})
+	}
+
+	var (
+		out any
+		err error
+	)
+	switch ex.kind {
+	case adapterChat, adapterGenerate:
+		var res openAICompletionResponse
+		if err = json.Unmarshal(b, &res); err == nil {
+			out = ex.response(res)
+		}
+	case adapterEmbed, adapterEmbeddings:
+		var res openAIEmbeddingResponse
+		if err = json.Unmarshal(b, &res); err == nil {
+			out = ex.embeddings(res)
+		}
+	case adapterModels:
+		out, err = ex.models(b)
+	}
+
+	if err != nil {
+		return fasthttp.StatusBadGateway, ex.line(map[string]any{"error": "unable to read runner response: " + err.Error()})
+	}
+
+	tb, err := json.Marshal(out)
+	if err != nil {
+		return fasthttp.StatusBadGateway, ex.line(map[string]any{"error": err.Error()})
+	}
+
+	return code, tb
+}
+
+// chunk translates a single server-sent event line of a streamed runner
+// response into Ollama NDJSON chunks... tool calls and usage are reported in
+// the final chunk, once the runner has sent them in full
+func (ex *openAIAdapterExchange) chunk(ln []byte) []byte {
+	data, ok := bytes.CutPrefix(bytes.TrimSpace(ln), []byte("data:"))
+	if !ok {
+		// blank lines, comments and event types carry no data
+		return nil
+	}
+
+	data = bytes.TrimSpace(data)
+	if string(data) == "[DONE]" {
+		return ex.final()
+	}
+
+	var res openAICompletionResponse
+	if err := json.Unmarshal(data, &res); err != nil {
+		return ex.line(map[string]any{"error": "unable to read runner response: " + err.Error()})
+	}
+
+	if res.Error != nil {
+		return ex.line(map[string]any{"error": openAIErrorMessage(data)})
+	}
+
+	if res.Model != "" {
+		ex.model = res.Model
+	}
+
+	if res.Usage != nil {
+		ex.usage = *res.Usage
+	}
+
+	var out []byte
+	for _, ch := range res.Choices {
+		if ch.FinishReason != "" {
+			ex.rsn = ch.FinishReason
+		}
+
+		for _, tc := range ch.Delta.ToolCalls {
+			ex.toolCall(tc)
+		}
+
+		txt := ch.Delta.Content
+		if ex.text {
+			txt = ch.Text
+		}
+
+		if txt == "" && ch.Delta.ReasoningContent == "" {
+			continue
+		}
+
+		out = append(out, ex.line(ex.result(txt, ch.Delta.ReasoningContent, nil, false))...)
+	}
+
+	return out
+}
+
+func (ex *openAIAdapterExchange) contentType() string {
+	return ndjsonContentType
+}
+
+// end reports an error when the stream ended prematurely, or sends the final
+// chunk when the runner did not terminate the stream with [DONE]
+func (ex *openAIAdapterExchange) end(err error) []byte {
+	if err != nil {
+		return ex.line(map[string]any{"error": err.Error()})
+	}
+
+	return ex.final()
+}
+
+// chatRequest translates an Ollama chat request to a chat completions request
+func (ex *openAIAdapterExchange) chatRequest(b []byte) (map[string]any, error) {
+	var oreq ollamaChatRequest
+	if err := json.Unmarshal(b, &oreq); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	msgs, err := ex.messages(oreq.Messages)
+	if err != nil {
+		return nil, err
+	}
+
+	body := ex.request(oreq.Model, oreq.Options, oreq.Format, b)
+	body["messages"] = msgs
+
+	if len(oreq.Tools) > 0 {
+		body["tools"] = oreq.Tools
+	}
+
+	return body, nil
+}
+
+// embedRequest translates an Ollama embed (or legacy embeddings) request to an
+// embeddings request
+func (ex *openAIAdapterExchange) embedRequest(b []byte) (map[string]any, error) {
+	var oreq struct {
+		ollamaEmbedRequest
+		Prompt string `json:"prompt"`
+	}
+	if err := json.Unmarshal(b, &oreq); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	ex.model = oreq.Model
+
+	body := map[string]any{
+		"input": []string(oreq.Input),
+		"model": oreq.Model,
+	}
+
+	if ex.kind == adapterEmbeddings {
+		body["input"] = []string{oreq.Prompt}
+	}
+
+	if oreq.Dimensions != nil {
+		body["dimensions"] = *oreq.Dimensions
+	}
+
+	return body, nil
+}
+
+// embeddings translates an embeddings response
+func (ex *openAIAdapterExchange) embeddings(res openAIEmbeddingResponse) map[string]any {
+	sort.SliceStable(res.Data, func(i, j int) bool {
+		return res.Data[i].Index < res.Data[j].Index
+	})
+
+	if ex.kind == adapterEmbeddings {
+		emb := []float64{}
+		if len(res.Data) > 0 {
+			emb = res.Data[0].Embedding
+		}
+
+		return map[string]any{"embedding": emb}
+	}
+
+	embs := make([][]float64, 0, len(res.Data))
+	for _, d := range res.Data {
+		embs = append(embs, d.Embedding)
+	}
+
+	mdl := res.Model
+	if mdl == "" {
+		mdl = ex.model
+	}
+
+	return map[string]any{
+		"embeddings":        embs,
+		"model":             mdl,
+		"prompt_eval_count": res.Usage.PromptTokens,
+	}
+}
+
+// final returns the last chunk of a streamed response, once
+func (ex *openAIAdapterExchange) final() []byte {
+	if ex.done {
+		return nil
+	}
+	ex.done = true
+
+	var calls []openAIToolCall
+	idxs := make([]int, 0, len(ex.calls))
+	for idx := range ex.calls {
+		idxs = append(idxs, idx)
+	}
+	sort.Ints(idxs)
+
+	for _, idx := range idxs {
+		calls = append(calls, *ex.calls[idx])
+	}
+
+	res := ex.result("", "", calls, true)
+	res["done_reason"] = ex.doneReason(ex.rsn)
+	res["eval_count"] = ex.usage.CompletionTokens
+	res["prompt_eval_count"] = ex.usage.PromptTokens
+
+	return ex.line(res)
+}
+
+// generateRequest translates an Ollama generate request... prompts are sent
+// as chat messages so the runner applies the model template, unless the
+// request is raw (or fills in a suffix), which is sent as a completion
+func (ex *openAIAdapterExchange) generateRequest(b []byte) (map[string]any, string, error) {
+	var oreq struct {
+		ollamaGenerateRequest
+		Images []string `json:"images"`
+	}
+	if err := json.Unmarshal(b, &oreq); err != nil {
+		return nil, "", fmt.Errorf("invalid request body: %w", err)
+	}
+
+	body := ex.request(oreq.Model, oreq.Options, oreq.Format, b)
+
+	if oreq.Raw || oreq.Suffix != "" {
+		ex.text = true
+		body["prompt"] = oreq.Prompt
+		if oreq.Suffix != "" {
+			body["suffix"] = oreq.Suffix
+		}
+
+		return body, "/v1/completions", nil
+	}
+
+	msgs := []ollamaMessage{}
+	if oreq.System != "" {
+		msgs = append(msgs, ollamaMessage{Content: oreq.System, Role: "system"})
+	}
+	msgs = append(msgs, ollamaMessage{Content: oreq.Prompt, Images: oreq.Images, Role: "user"})
+
+	oms, err := ex.messages(msgs)
+	if err != nil {
+		return nil, "", err
+	}
+	body["messages"] = oms
+
+	return body, "/v1/chat/completions", nil
+}
+
+// line formats the value as a single NDJSON line
+func (ex *openAIAdapterExchange) line(v any) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil
+	}
+
+	return append(b, '\n')
+}
+
+// messages translates Ollama chat messages... tool results are matched to
+// the earliest unanswered tool call of the same name
+func (ex *openAIAdapterExchange) messages(msgs []ollamaMessage) ([]any, error) {
+	var (
+		n    int
+		out  = make([]any, 0, len(msgs))
+		pend = map[string][]string{}
+	)
+	for _, msg := range msgs {
+		om := map[string]any{
+			"content": msg.Content,
+			"role":    msg.Role,
+		}
+
+		if len(msg.Images) > 0 {
+			parts := []any{}
+			if msg.Content != "" {
+				parts = append(parts, map[string]any{"text": msg.Content, "type": "text"})
+			}
+
+			for _, img := range msg.Images {
+				parts = append(parts, map[string]any{
+					"image_url": map[string]any{"url": imageURL(img)},
+					"type":      "image_url",
+				})
+			}
+
+			om["content"] = parts
+		}
+
+		if len(msg.ToolCalls) > 0 {
+			calls := make([]any, 0, len(msg.ToolCalls))
+			for _, tc := range msg.ToolCalls {
+				args, err := json.Marshal(tc.Function.Arguments)
+				if err != nil {
+					return nil, fmt.Errorf("invalid arguments for tool call %s: %w", tc.Function.Name, err)
+				}
+
+				n++
+				id := fmt.Sprintf("call_%d", n)
+				pend[tc.Function.Name] = append(pend[tc.Function.Name], id)
+
+				calls = append(calls, map[string]any{
+					"function": map[string]any{
+						"arguments": string(args),
+						"name":      tc.Function.Name,
+					},
+					"id":   id,
+					"type": "function",
+				})
+			}
+
+			om["tool_calls"] = calls
+		}
+
+		if msg.Role == "tool" {
+			if ids := pend[msg.ToolName]; len(ids) > 0 {
+				om["tool_call_id"] = ids[0]
+				pend[msg.ToolName] = ids[1:]
+			} else if n > 0 {
+				om["tool_call_id"] = fmt.Sprintf("call_%d", n)
+			}
+		}
+
+		out = append(out, om)
+	}
+
+	return out, nil
+}
+
+// models translates the models listed by the runner
+func (ex *openAIAdapterExchange) models(b []byte) (map[string]any, error) {
+	type model struct {
+		created int64
+		name    string
+	}
+
+	var mdls []model
+	if ex.typ == models.RunnerTypeTGI {
+		var res tgiInfoResponse
+		if err := json.Unmarshal(b, &res); err != nil {
+			return nil, err
+		}
+		mdls = append(mdls, model{name: res.ModelID})
+	} else {
+		var res openAIModelsResponse
+		if err := json.Unmarshal(b, &res); err != nil {
+			return nil, err
+		}
+
+		for _, m := range res.Data {
+			mdls = append(mdls, model{created: m.Created, name: m.ID})
+		}
+	}
+
+	out := make([]any, 0, len(mdls))
+	for _, m := range mdls {
+		out = append(out, map[string]any{
+			"details":     map[string]any{},
+			"digest":      "",
+			"model":       m.name,
+			"modified_at": time.Unix(m.created, 0).UTC(),
+			"name":        m.name,
+			"size":        0,
+		})
+	}
+
+	return map[string]any{"models": out}, nil
+}
+
+// request returns the body common to chat completions and completions
+// requests, where the model options are translated to sampling parameters...
+// Ollama streams responses unless told otherwise
+func (ex *openAIAdapterExchange) request(mdl string, opts map[string]any, frmt json.RawMessage, b []byte) map[string]any {
+	ex.model = mdl
+
+	var strm struct {
+		Stream *bool `json:"stream"`
+	}
+	json.Unmarshal(b, &strm)
+
+	body := map[string]any{
+		"model":  mdl,
+		"stream": strm.Stream == nil || *strm.Stream,
+	}
+
+	if body["stream"] == true {
+		body["stream_options"] = map[string]any{"include_usage": true}
+	}
+
+	for _, opt := range []string{"frequency_penalty", "presence_penalty", "seed", "stop", "temperature", "top_k", "top_p"} {
+		// TGI does not accept top_k in the OpenAI API
+		if opt == "top_k" && ex.typ == models.RunnerTypeTGI {
+			continue
+		}
+
+		if val, ok := opts[opt]; ok {
+			body[opt] = val
+		}
+	}
+
+	if val, ok := opts["num_predict"].(float64); ok && val > 0 {
+		body["max_tokens"] = int(val)
+	}
+
+	switch {
+	case len(frmt) == 0 || string(frmt) == "null":
+	case string(frmt) == `"json"`:
+		body["response_format"] = map[string]any{"type": "json_object"}
+	default:
+		body["response_format"] = map[string]any{
+			"json_schema": map[string]any{"name": "response", "schema": frmt},
+			"type":        "json_schema",
+		}
+	}
+
+	return body
+}
+
+// response translates a complete chat completions or completions response
+func (ex *openAIAdapterExchange) response(res openAICompletionResponse) map[string]any {
+	if res.Model != "" {
+		ex.model = res.Model
+	}
+
+	var ch openAIChoice
+	if len(res.Choices) > 0 {
+		ch = res.Choices[0]
+	}
+
+	txt := ch.Message.Content
+	if ex.text {
+		txt = ch.Text
+	}
+
+	out := ex.result(txt, ch.Message.ReasoningContent, ch.Message.ToolCalls, true)
+	out["done_reason"] = ex.doneReason(ch.FinishReason)
+
+	if res.Usage != nil {
+		out["eval_count"] = res.Usage.CompletionTokens
+		out["prompt_eval_count"] = res.Usage.PromptTokens
+	}
+
+	return out
+}
+
+// result returns an Ollama chat or generate response (or chunk of one)
+func (ex *openAIAdapterExchange) result(txt string, thk string, calls []openAIToolCall, done bool) map[string]any {
+	out := map[string]any{
+		"created_at": time.Now().UTC(),
+		"done":       done,
+		"model":      ex.model,
+	}
+
+	if ex.kind == adapterGenerate {
+		out["response"] = txt
+		if thk != "" {
+			out["thinking"] = thk
+		}
+
+		return out
+	}
+
+	msg := map[string]any{
+		"content": txt,
+		"role":    "assistant",
+	}
+
+	if thk != "" {
+		msg["thinking"] = thk
+	}
+
+	if len(calls) > 0 {
+		tcs := make([]any, 0, len(calls))
+		for _, tc := range calls {
+			args := map[string]any{}
+			if tc.Function.Arguments != "" {
+				json.Unmarshal([]byte(tc.Function.Arguments), &args)
+			}
+
+			tcs = append(tcs, map[string]any{
+				"function": map[string]any{
+					"arguments": args,
+					"name":      tc.Function.Name,
+				},
+			})
+		}
+
+		msg["tool_calls"] = tcs
+	}
+
+	out["message"] = msg
+
+	return out
+}
+
+func (ex *openAIAdapterExchange) doneReason(rsn string) string {
+	if rsn == "length" {
+		return "length"
+	}
+
+	return "stop"
+}
+
+// toolCall gathers a streamed tool call, whose name and arguments may be
+// split across several chunks
+func (ex *openAIAdapterExchange) toolCall(tc openAIToolCall) {
+	idx := len(ex.calls)
+	if tc.Index != nil {
+		idx = *tc.Index
+	}
+
+	if ex.calls == nil {
+		ex.calls = map[int]*openAIToolCall{}
+	}
+
+	call, ok := ex.calls[idx]
+	if !ok {
+		call = &openAIToolCall{}
+		ex.calls[idx] = call
+	}
+
+	call.Function.Arguments += tc.Function.Arguments
+	call.Function.Name += tc.Function.Name
+}
+
+// imageURL returns a data URL for a base64 encoded image, detecting the media
+// type from the image data
+func imageURL(img string) string {
+	typ := "image/png"
+	if b, err := base64.StdEncoding.DecodeString(img[:min(len(img), 64)/4*4]); err == nil {
+		if ct := http.DetectContentType(b); strings.HasPrefix(ct, "image/") {
+			typ = ct
+		}
+	}
+
+	return "data:" + typ + ";base64," + img
+}
+
+// openAIErrorMessage returns the error message of a runner error response,
+// which is reported in any of the forms used by OpenAI compatible runners
+// (i.e. {"error": {"message": "..."}}, {"error": "..."} or {"message": "..."})
+func openAIErrorMessage(b []byte) string {
+	var e struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+	if err := json.Unmarshal(b, &e); err != nil {
+		return string(b)
+	}
+
+	var obj struct {
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(e.Error, &obj); err == nil && obj.Message != "" {
+		return obj.Message
+	}
+
+	var msg string
+	if err := json.Unmarshal(e.Error, &msg); err == nil && msg != "" {
+		return msg
+	}
+
+	if e.Message != "" {
+		return e.Message
+	}
+
+	return string(b)
+}
@@ -0,0 +1,579 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// ndjsonLines splits an NDJSON stream into its lines
+func ndjsonLines(b []byte) []string {
+	lns := []string{}
+	for ln := range strings.SplitSeq(strings.TrimSpace(string(b)), "\n") {
+		if ln != "" {
+			lns = append(lns, ln)
+		}
+	}
+
+	return lns
+}
+
+func TestAdapterTranslate(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      string
+		mthd     string
+		pth      string
+		body     string
+		wantPath string
+		wantMthd string
+		wantBody string
+		wantCode int
+	}{
+		{
+			name:     "chat",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/chat",
+			body:     `{"model":"llama3.2","messages":[{"role":"user","content":"hi"}],"options":{"num_predict":5,"seed":1,"temperature":0.5,"top_k":40},"format":"json","tools":[{"type":"function","function":{"name":"get_weather"}}]}`,
+			wantPath: "/v1/chat/completions",
+			wantBody: `{"max_tokens":5,"messages":[{"content":"hi","role":"user"}],"model":"llama3.2","response_format":{"type":"json_object"},"seed":1,"stream":true,"stream_options":{"include_usage":true},"temperature":0.5,"tools":[{"function":{"name":"get_weather"},"type":"function"}],"top_k":40}`,
+		},
+		{
+			name:     "chat with a schema",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/chat",
+			body:     `{"model":"llama3.2","messages":[],"format":{"type":"object"},"stream":false}`,
+			wantPath: "/v1/chat/completions",
+			wantBody: `{"messages":[],"model":"llama3.2","response_format":{"json_schema":{"name":"response","schema":{"type":"object"}},"type":"json_schema"},"stream":false}`,
+		},
+		{
+			name:     "chat without top_k on TGI",
+			typ:      models.RunnerTypeTGI,
+			pth:      "/api/chat",
+			body:     `{"model":"llama3.2","messages":[],"options":{"top_k":40,"top_p":0.9},"stream":false}`,
+			wantPath: "/v1/chat/completions",
+			wantBody: `{"messages":[],"model":"llama3.2","stream":false,"top_p":0.9}`,
+		},
+		{
+			name:     "chat with an invalid body",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/chat",
+			body:     `{"model":`,
+			wantCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "chat with GET",
+			typ:      models.RunnerTypeLlamaCpp,
+			mthd:     fasthttp.MethodGet,
+			pth:      "/api/chat",
+			wantCode: fasthttp.StatusMethodNotAllowed,
+		},
+		{
+			name:     "generate",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/generate",
+			body:     `{"model":"llama3.2","system":"be brief","prompt":"hi","images":["/9j/4AAQ"],"stream":false}`,
+			wantPath: "/v1/chat/completions",
+			wantBody: `{"messages":[{"content":"be brief","role":"system"},{"content":[{"text":"hi","type":"text"},{"image_url":{"url":"data:image/jpeg;base64,/9j/4AAQ"},"type":"image_url"}],"role":"user"}],"model":"llama3.2","stream":false}`,
+		},
+		{
+			name:     "raw generate",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/generate",
+			body:     `{"model":"llama3.2","prompt":"once","raw":true,"stream":false}`,
+			wantPath: "/v1/completions",
+			wantBody: `{"model":"llama3.2","prompt":"once","stream":false}`,
+		},
+		{
+			name:     "generate with a suffix",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/generate",
+			body:     `{"model":"llama3.2","prompt":"func main() {","suffix":"}","stream":false}`,
+			wantPath: "/v1/completions",
+			wantBody: `{"model":"llama3.2","prompt":"func main() {","stream":false,"suffix":"}"}`,
+		},
+		{
+			name:     "embed",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/embed",
+			body:     `{"model":"nomic-embed-text","input":["hello","world"],"dimensions":2}`,
+			wantPath: "/v1/embeddings",
+			wantBody: `{"dimensions":2,"input":["hello","world"],"model":"nomic-embed-text"}`,
+		},
+		{
+			name:     "embeddings",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/embeddings",
+			body:     `{"model":"nomic-embed-text","prompt":"hello"}`,
+			wantPath: "/v1/embeddings",
+			wantBody: `{"input":["hello"],"model":"nomic-embed-text"}`,
+		},
+		{
+			name:     "embed on TGI",
+			typ:      models.RunnerTypeTGI,
+			pth:      "/api/embed",
+			body:     `{"model":"nomic-embed-text","input":"hello"}`,
+			wantCode: fasthttp.StatusNotImplemented,
+		},
+		{
+			name:     "embeddings on TGI",
+			typ:      models.RunnerTypeTGI,
+			pth:      "/api/embeddings",
+			body:     `{"model":"nomic-embed-text","prompt":"hello"}`,
+			wantCode: fasthttp.StatusNotImplemented,
+		},
+		{
+			name:     "tags",
+			typ:      models.RunnerTypeVLLM,
+			mthd:     fasthttp.MethodGet,
+			pth:      "/api/tags",
+			wantPath: "/v1/models",
+			wantMthd: fasthttp.MethodGet,
+		},
+		{
+			name:     "running models",
+			typ:      models.RunnerTypeLlamaCpp,
+			mthd:     fasthttp.MethodGet,
+			pth:      "/api/ps",
+			wantPath: "/v1/models",
+			wantMthd: fasthttp.MethodGet,
+		},
+		{
+			name:     "tags on TGI",
+			typ:      models.RunnerTypeTGI,
+			pth:      "/api/tags",
+			body:     `{}`,
+			wantPath: "/info",
+			wantMthd: fasthttp.MethodGet,
+		},
+		{
+			name:     "unsupported endpoint",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/pull",
+			body:     `{"model":"llama3.2"}`,
+			wantCode: fasthttp.StatusNotImplemented,
+		},
+		{
+			name: "OpenAI API is not translated",
+			typ:  models.RunnerTypeLlamaCpp,
+			pth:  "/v1/chat/completions",
+			body: `{"model":"llama3.2"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mthd := tt.mthd
+			if mthd == "" {
+				mthd = fasthttp.MethodPost
+			}
+
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+
+			req.Header.SetMethod(mthd)
+			req.SetRequestURI(tt.pth)
+			req.SetBodyString(tt.body)
+
+			ex, rpth, err := newAdapter(models.Runner{Type: tt.typ}).translate(tt.pth, req)
+			if tt.wantCode != 0 {
+				var perr *protocolError
+				if !errors.As(err, &perr) || perr.code != tt.wantCode {
+					t.Fatalf("error = %v, want status %d", err, tt.wantCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if rpth != tt.wantPath {
+				t.Errorf("path = %q, want %q", rpth, tt.wantPath)
+			}
+
+			if (ex == nil) != (tt.wantPath == "") {
+				t.Errorf("exchange = %v, want one only for translated endpoints", ex)
+			}
+
+			if tt.wantMthd != "" {
+				if m := string(req.Header.Method()); m != tt.wantMthd {
+					t.Errorf("method = %s, want %s", m, tt.wantMthd)
+				}
+
+				if len(req.Body()) != 0 {
+					t.Errorf("body = %q, want none", req.Body())
+				}
+			}
+
+			if tt.wantBody == "" {
+				return
+			}
+
+			assertJSON(t, req.Body(), tt.wantBody)
+		})
+	}
+}
+
+func TestAdapterExchangeBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		typ      string
+		pth      string
+		req      string
+		code     int
+		resp     string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "chat with tool calls",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/chat",
+			req:      `{"model":"llama3.2","messages":[],"stream":false}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"llama3.2-q4","choices":[{"finish_reason":"tool_calls","message":{"content":"","reasoning_content":"hmm","tool_calls":[{"id":"c1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]}}],"usage":{"prompt_tokens":3,"completion_tokens":2}}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"done":true,"done_reason":"stop","eval_count":2,"message":{"content":"","role":"assistant","thinking":"hmm","tool_calls":[{"function":{"arguments":{"city":"Paris"},"name":"get_weather"}}]},"model":"llama3.2-q4","prompt_eval_count":3}`,
+		},
+		{
+			name:     "generate cut short",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/generate",
+			req:      `{"model":"llama3.2","prompt":"hi","stream":false}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"choices":[{"finish_reason":"length","message":{"content":"hello"}}]}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"done":true,"done_reason":"length","model":"llama3.2","response":"hello"}`,
+		},
+		{
+			name:     "raw generate",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/generate",
+			req:      `{"model":"llama3.2","prompt":"once","raw":true,"stream":false}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"llama3.2","choices":[{"finish_reason":"stop","text":" upon"}],"usage":{"prompt_tokens":1,"completion_tokens":2}}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"done":true,"done_reason":"stop","eval_count":2,"model":"llama3.2","prompt_eval_count":1,"response":" upon"}`,
+		},
+		{
+			name:     "embed",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/embed",
+			req:      `{"model":"nomic-embed-text","input":["hello","world"]}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"data":[{"embedding":[0.3,0.4],"index":1},{"embedding":[0.1,0.2],"index":0}],"usage":{"prompt_tokens":2}}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"embeddings":[[0.1,0.2],[0.3,0.4]],"model":"nomic-embed-text","prompt_eval_count":2}`,
+		},
+		{
+			name:     "embeddings",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/embeddings",
+			req:      `{"model":"nomic-embed-text","prompt":"hello"}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"nomic-embed-text","data":[{"embedding":[0.1,0.2],"index":0}]}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"embedding":[0.1,0.2]}`,
+		},
+		{
+			name:     "embeddings without data",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/embeddings",
+			req:      `{"model":"nomic-embed-text","prompt":"hello"}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"data":[]}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"embedding":[]}`,
+		},
+		{
+			name:     "tags",
+			typ:      models.RunnerTypeVLLM,
+			pth:      "/api/tags",
+			code:     fasthttp.StatusOK,
+			resp:     `{"object":"list","data":[{"id":"llama3.2","created":1704067200}]}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"models":[{"details":{},"digest":"","model":"llama3.2","modified_at":"2024-01-01T00:00:00Z","name":"llama3.2","size":0}]}`,
+		},
+		{
+			name:     "tags on TGI",
+			typ:      models.RunnerTypeTGI,
+			pth:      "/api/tags",
+			code:     fasthttp.StatusOK,
+			resp:     `{"model_id":"mistralai/Mistral-7B-Instruct-v0.3","max_input_tokens":4096}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"models":[{"details":{},"digest":"","model":"mistralai/Mistral-7B-Instruct-v0.3","modified_at":"1970-01-01T00:00:00Z","name":"mistralai/Mistral-7B-Instruct-v0.3","size":0}]}`,
+		},
+		{
+			name:     "runner error",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/chat",
+			req:      `{"model":"llama3.2","messages":[]}`,
+			code:     fasthttp.StatusBadRequest,
+			resp:     `{"error":{"code":400,"message":"context length exceeded","type":"invalid_request_error"}}`,
+			wantCode: fasthttp.StatusBadRequest,
+			want:     `{"error":"context length exceeded"}`,
+		},
+		{
+			name:     "unreadable runner response",
+			typ:      models.RunnerTypeLlamaCpp,
+			pth:      "/api/chat",
+			req:      `{"model":"llama3.2","messages":[]}`,
+			code:     fasthttp.StatusOK,
+			resp:     `not json`,
+			wantCode: fasthttp.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mthd := fasthttp.MethodPost
+			if tt.req == "" {
+				mthd = fasthttp.MethodGet
+			}
+
+			ex, _, _, err := translateRequest(t, newAdapter(models.Runner{Type: tt.typ}), mthd, tt.pth, tt.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			code, b := ex.body(tt.code, []byte(tt.resp))
+			if code != tt.wantCode {
+				t.Errorf("status = %d, want %d", code, tt.wantCode)
+			}
+
+			if tt.want == "" {
+				return
+			}
+
+			assertJSON(t, b, tt.want, "created_at")
+		})
+	}
+}
+
+func TestAdapterExchangeStream(t *testing.T) {
+	tests := []struct {
+		name  string
+		pth   string
+		req   string
+		lns   []string
+		err   error
+		after []string
+		want  []string
+	}{
+		{
+			name: "chat with tool calls split across chunks",
+			pth:  "/api/chat",
+			req:  `{"model":"llama3.2","messages":[]}`,
+			lns: []string{
+				`data: {"model":"llama3.2","choices":[{"delta":{"role":"assistant","content":"Let me check"}}]}`,
+				``,
+				`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"id":"c1","type":"function","function":{"name":"get_","arguments":""}}]}}]}`,
+				`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"name":"weather","arguments":"{\"city\":"}}]}}]}`,
+				`data: {"choices":[{"delta":{"tool_calls":[{"index":1,"id":"c2","type":"function","function":{"name":"get_time","arguments":"{}"}}]}}]}`,
+				`data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"Paris\"}"}}]}}]}`,
+				`data: {"choices":[{"delta":{},"finish_reason":"tool_calls"}]}`,
+				`data: {"choices":[],"usage":{"prompt_tokens":3,"completion_tokens":2,"total_tokens":5}}`,
+				`data: [DONE]`,
+			},
+			want: []string{
+				`{"done":false,"message":{"content":"Let me check","role":"assistant"},"model":"llama3.2"}`,
+				`{"done":true,"done_reason":"stop","eval_count":2,"message":{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":{"city":"Paris"},"name":"get_weather"}},{"function":{"arguments":{},"name":"get_time"}}]},"model":"llama3.2","prompt_eval_count":3}`,
+			},
+		},
+		{
+			name: "generate cut short",
+			pth:  "/api/generate",
+			req:  `{"model":"llama3.2","prompt":"hi"}`,
+			lns: []string{
+				`: keep-alive`,
+				`data: {"model":"llama3.2","choices":[{"delta":{"reasoning_content":"hmm"}}]}`,
+				`data: {"model":"llama3.2","choices":[{"delta":{"content":"hel"}}]}`,
+				`data: {"model":"llama3.2","choices":[{"delta":{"content":"lo"},"finish_reason":"length"}]}`,
+				`data: [DONE]`,
+			},
+			want: []string{
+				`{"done":false,"model":"llama3.2","response":"","thinking":"hmm"}`,
+				`{"done":false,"model":"llama3.2","response":"hel"}`,
+				`{"done":false,"model":"llama3.2","response":"lo"}`,
+				`{"done":true,"done_reason":"length","eval_count":0,"model":"llama3.2","prompt_eval_count":0,"response":""}`,
+			},
+		},
+		{
+			name: "raw generate",
+			pth:  "/api/generate",
+			req:  `{"model":"llama3.2","prompt":"once","raw":true}`,
+			lns: []string{
+				`data: {"model":"llama3.2","choices":[{"text":" upon"}]}`,
+				`data: {"model":"llama3.2","choices":[{"text":" a time","finish_reason":"stop"}],"usage":{"prompt_tokens":1,"completion_tokens":3}}`,
+				`data: [DONE]`,
+			},
+			want: []string{
+				`{"done":false,"model":"llama3.2","response":" upon"}`,
+				`{"done":false,"model":"llama3.2","response":" a time"}`,
+				`{"done":true,"done_reason":"stop","eval_count":3,"model":"llama3.2","prompt_eval_count":1,"response":""}`,
+			},
+		},
+		{
+			name: "stream ended without [DONE]",
+			pth:  "/api/chat",
+			req:  `{"model":"llama3.2","messages":[]}`,
+			lns: []string{
+				`data: {"model":"llama3.2","choices":[{"delta":{"content":"hello"},"finish_reason":"stop"}]}`,
+			},
+			want: []string{
+				`{"done":false,"message":{"content":"hello","role":"assistant"},"model":"llama3.2"}`,
+				`{"done":true,"done_reason":"stop","eval_count":0,"message":{"content":"","role":"assistant"},"model":"llama3.2","prompt_eval_count":0}`,
+			},
+		},
+		{
+			name: "[DONE] after the stream ended",
+			pth:  "/api/chat",
+			req:  `{"model":"llama3.2","messages":[]}`,
+			lns: []string{
+				`data: {"model":"llama3.2","choices":[{"delta":{"content":"hello"},"finish_reason":"stop"}]}`,
+			},
+			after: []string{`data: [DONE]`},
+			want: []string{
+				`{"done":false,"message":{"content":"hello","role":"assistant"},"model":"llama3.2"}`,
+				`{"done":true,"done_reason":"stop","eval_count":0,"message":{"content":"","role":"assistant"},"model":"llama3.2","prompt_eval_count":0}`,
+			},
+		},
+		{
+			name: "stream ended prematurely",
+			pth:  "/api/chat",
+			req:  `{"model":"llama3.2","messages":[]}`,
+			lns: []string{
+				`data: {"model":"llama3.2","choices":[{"delta":{"content":"hel"}}]}`,
+			},
+			err: errors.New("unexpected EOF"),
+			want: []string{
+				`{"done":false,"message":{"content":"hel","role":"assistant"},"model":"llama3.2"}`,
+				`{"error":"unexpected EOF"}`,
+			},
+		},
+		{
+			name: "runner error",
+			pth:  "/api/chat",
+			req:  `{"model":"llama3.2","messages":[]}`,
+			lns: []string{
+				`data: {"error":{"message":"out of memory"}}`,
+			},
+			err: errors.New("stream closed"),
+			want: []string{
+				`{"error":"out of memory"}`,
+				`{"error":"stream closed"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ex, _, _, err := translateRequest(t, newAdapter(models.Runner{Type: models.RunnerTypeLlamaCpp}), fasthttp.MethodPost, tt.pth, tt.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if ct := ex.contentType(); ct != ndjsonContentType {
+				t.Errorf("content type = %q, want %q", ct, ndjsonContentType)
+			}
+
+			var out []byte
+			for _, ln := range tt.lns {
+				out = append(out, ex.chunk([]byte(ln+"\n"))...)
+			}
+
+			out = append(out, ex.end(tt.err)...)
+			for _, ln := range tt.after {
+				out = append(out, ex.chunk([]byte(ln+"\n"))...)
+			}
+
+			got := ndjsonLines(out)
+			if len(got) != len(tt.want) {
+				t.Fatalf("lines = %q, want %d lines", got, len(tt.want))
+			}
+
+			for i, ln := range got {
+				assertJSON(t, []byte(ln), tt.want[i], "created_at")
+			}
+		})
+	}
+}
+
+func TestAdapterMessages(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs string
+		want string
+	}{
+		{
+			name: "results of the same tool in order",
+			msgs: `[{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}},{"function":{"name":"get_weather","arguments":{"city":"Rome"}}}]},{"role":"tool","tool_name":"get_weather","content":"20C"},{"role":"tool","tool_name":"get_weather","content":"25C"}]`,
+			want: `[{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":"{\"city\":\"Paris\"}","name":"get_weather"},"id":"call_1","type":"function"},{"function":{"arguments":"{\"city\":\"Rome\"}","name":"get_weather"},"id":"call_2","type":"function"}]},{"content":"20C","role":"tool","tool_call_id":"call_1"},{"content":"25C","role":"tool","tool_call_id":"call_2"}]`,
+		},
+		{
+			name: "results of different tools out of order",
+			msgs: `[{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{}}},{"function":{"name":"get_time","arguments":{}}}]},{"role":"tool","tool_name":"get_time","content":"noon"},{"role":"tool","tool_name":"get_weather","content":"20C"}]`,
+			want: `[{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":"{}","name":"get_weather"},"id":"call_1","type":"function"},{"function":{"arguments":"{}","name":"get_time"},"id":"call_2","type":"function"}]},{"content":"noon","role":"tool","tool_call_id":"call_2"},{"content":"20C","role":"tool","tool_call_id":"call_1"}]`,
+		},
+		{
+			name: "calls in later turns",
+			msgs: `[{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{}}}]},{"role":"tool","tool_name":"get_weather","content":"20C"},{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{}}}]},{"role":"tool","tool_name":"get_weather","content":"25C"}]`,
+			want: `[{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":"{}","name":"get_weather"},"id":"call_1","type":"function"}]},{"content":"20C","role":"tool","tool_call_id":"call_1"},{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":"{}","name":"get_weather"},"id":"call_2","type":"function"}]},{"content":"25C","role":"tool","tool_call_id":"call_2"}]`,
+		},
+		{
+			name: "result without a tool name",
+			msgs: `[{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{}}},{"function":{"name":"get_time","arguments":{}}}]},{"role":"tool","content":"20C"}]`,
+			want: `[{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":"{}","name":"get_weather"},"id":"call_1","type":"function"},{"function":{"arguments":"{}","name":"get_time"},"id":"call_2","type":"function"}]},{"content":"20C","role":"tool","tool_call_id":"call_2"}]`,
+		},
+		{
+			name: "result without a call",
+			msgs: `[{"role":"tool","tool_name":"get_weather","content":"20C"}]`,
+			want: `[{"content":"20C","role":"tool"}]`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var msgs []ollamaMessage
+			if err := json.Unmarshal([]byte(tt.msgs), &msgs); err != nil {
+				t.Fatal(err)
+			}
+
+			ex := &openAIAdapterExchange{kind: adapterChat}
+			out, err := ex.messages(msgs)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			b, _ := json.Marshal(out)
+			assertJSON(t, b, tt.want)
+		})
+	}
+}
+
+func TestOpenAIErrorMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+	}{
+		{name: "error object", body: `{"error":{"message":"model not found","type":"invalid_request_error"}}`, want: "model not found"},
+		{name: "error string", body: `{"error":"model not found"}`, want: "model not found"},
+		{name: "message", body: `{"message":"model not found","object":"error"}`, want: "model not found"},
+		{name: "error object without a message", body: `{"error":{"code":500}}`, want: `{"error":{"code":500}}`},
+		{name: "not JSON", body: `Internal Server Error`, want: "Internal Server Error"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := openAIErrorMessage([]byte(tt.body)); got != tt.want {
+				t.Errorf("openAIErrorMessage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,592 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const (
+	anthropicMessages = "messages"
+	anthropicModels   = "models"
+)
+
+// anthropicProtocol translates the Anthropic Messages and models endpoints to
+// the Ollama API
+type anthropicProtocol struct{}
+
+// anthropicExchange translates the Ollama response to a single Anthropic
+// request, tracking the content block being streamed
+type anthropicExchange struct {
+	blk     string
+	id      string
+	idx     int
+	kind    string
+	model   string
+	started bool
+	tools   bool
+}
+
+type anthropicBlock struct {
+	Content   json.RawMessage  `json:"content"`
+	ID        string           `json:"id"`
+	Input     map[string]any   `json:"input"`
+	IsError   bool             `json:"is_error"`
+	Name      string           `json:"name"`
+	Source    *anthropicSource `json:"source"`
+	Text      string           `json:"text"`
+	Thinking  string           `json:"thinking"`
+	ToolUseID string           `json:"tool_use_id"`
+	Type      string           `json:"type"`
+}
+
+type anthropicMessage struct {
+	Content json.RawMessage `json:"content"`
+	Role    string          `json:"role"`
+}
+
+type anthropicMessagesRequest struct {
+	MaxTokens     *int               `json:"max_tokens"`
+	Messages      []anthropicMessage `json:"messages"`
+	Model         string             `json:"model"`
+	StopSequences []string           `json:"stop_sequences"`
+	Stream        bool               `json:"stream"`
+	System        json.RawMessage    `json:"system"`
+	Temperature   *float64           `json:"temperature"`
+	Thinking      *struct {
+		Type string `json:"type"`
+	} `json:"thinking"`
+	Tools []anthropicTool `json:"tools"`
+	TopK  *int            `json:"top_k"`
+	TopP  *float64        `json:"top_p"`
+}
+
+type anthropicSource struct {
+	Data      string `json:"data"`
+	MediaType string `json:"media_type"`
+	Type      string `json:"type"`
+}
+
+type anthropicTool struct {
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"input_schema"`
+	Name        string          `json:"name"`
+}
+
+func (p *anthropicProtocol) failure(code int, msg string) []byte {
+	return anthropicFailure(code, msg)
+}
+
+func (p *anthropicProtocol) translate(pth string, req *fasthttp.Request) (exchange, string, error) {
+	ex := &anthropicExchange{}
+
+	switch pth {
+	case "/v1/messages":
+		ex.kind = anthropicMessages
+		ex.id = "msg_" + rand.Text()
+	case "/v1/models":
+		if !req.Header.IsGet() {
+			return nil, "", &protocolError{fasthttp.StatusMethodNotAllowed, "method not allowed: " + string(req.Header.Method())}
+		}
+
+		ex.kind = anthropicModels
+		req.SetBody(nil)
+
+		rpth, _ := models.TranslatedPath(models.ProtocolAnthropic, pth)
+		return ex, rpth, nil
+	default:
+		// other endpoints (i.e. the Ollama API itself) are not translated
+		return nil, "", nil
+	}
+
+	if !req.Header.IsPost() {
+		return nil, "", &protocolError{fasthttp.StatusMethodNotAllowed, "method not allowed: " + string(req.Header.Method())}
+	}
+
+	creq, err := ex.messagesRequest(req.Body())
+	if err != nil {
+		return nil, "", &protocolError{fasthttp.StatusBadRequest, err.Error()}
+	}
+
+	b, err := json.Marshal(creq)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.SetContentType("application/json")
+	req.SetBody(b)
+
+	rpth, _ := models.TranslatedPath(models.ProtocolAnthropic, pth)
+	return ex, rpth, nil
+}
+
+func (ex *anthropicExchange) body(code int, b []byte) (int, []byte) {
+	if code >= fasthttp.StatusBadRequest {
+		return code, anthropicFailure(code, ollamaError(b))
+	}
+
+	var (
+		out any
+		err error
+	)
+	switch ex.kind {
+	case anthropicMessages:
+		var res ollamaResponse
+		if err = json.Unmarshal(b, &res); err == nil {
+			out = ex.message(res)
+		}
+	case anthropicModels:
+		var res ollamaTagsResponse
+		if err = json.Unmarshal(b, &res); err == nil {
+			out = ex.models(res)
+		}
+	}
+
+	if err != nil {
+		return fasthttp.StatusBadGateway, anthropicFailure(fasthttp.StatusBadGateway, "unable to read runner response: "+err.Error())
+	}
+
+	tb, err := json.Marshal(out)
+	if err != nil {
+		return fasthttp.StatusBadGateway, anthropicFailure(fasthttp.StatusBadGateway, err.Error())
+	}
+
+	return code, tb
+}
+
+// chunk translates a single chunk of a streamed Ollama chat response into
+// the message, content block and delta events of the Messages API
+func (ex *anthropicExchange) chunk(ln []byte) []byte {
+	ln = bytes.TrimSpace(ln)
+	if len(ln) == 0 {
+		return nil
+	}
+
+	var res ollamaResponse
+	if err := json.Unmarshal(ln, &res); err != nil {
+		return ex.event("error", anthropicFailure(fasthttp.StatusBadGateway, "unable to read runner response: "+err.Error()))
+	}
+
+	if res.Error != "" {
+		return ex.event("error", anthropicFailure(fasthttp.StatusInternalServerError, res.Error))
+	}
+
+	if ex.model == "" {
+		ex.model = res.Model
+	}
+
+	var out []byte
+	if !ex.started {
+		ex.started = true
+		out = ex.send(out, "message_start", map[string]any{
+			"message": map[string]any{
+				"content":       []any{},
+				"id":            ex.id,
+				"model":         ex.model,
+				"role":          "assistant",
+				"stop_reason":   nil,
+				"stop_sequence": nil,
+				"type":          "message",
+				"usage": map[string]int{
+					"input_tokens":  res.PromptEvalCount,
+					"output_tokens": 0,
+				},
+			},
+		})
+	}
+
+	if res.Message.Thinking != "" {
+		out = ex.open(out, "thinking", map[string]any{"signature": "", "thinking": "", "type": "thinking"})
+		out = ex.send(out, "content_block_delta", map[string]any{
+			"delta": map[string]any{"thinking": res.Message.Thinking, "type": "thinking_delta"},
+			"index": ex.idx,
+		})
+	}
+
+	if res.Message.Content != "" {
+		out = ex.open(out, "text", map[string]any{"text": "", "type": "text"})
+		out = ex.send(out, "content_block_delta", map[string]any{
+			"delta": map[string]any{"text": res.Message.Content, "type": "text_delta"},
+			"index": ex.idx,
+		})
+	}
+
+	// tool calls arrive whole, so each is sent as a block of its own
+	for _, tc := range res.Message.ToolCalls {
+		ex.tools = true
+
+		args, _ := json.Marshal(tc.Function.Arguments)
+		out = ex.open(out, "tool_use", map[string]any{
+			"id":    "toolu_" + rand.Text(),
+			"input": map[string]any{},
+			"name":  tc.Function.Name,
+			"type":  "tool_use",
+		})
+		out = ex.send(out, "content_block_delta", map[string]any{
+			"delta": map[string]any{"partial_json": string(args), "type": "input_json_delta"},
+			"index": ex.idx,
+		})
+		out = ex.close(out)
+	}
+
+	if res.Done {
+		out = ex.close(out)
+		out = ex.send(out, "message_delta", map[string]any{
+			"delta": map[string]any{
+				"stop_reason":   ex.stopReason(res.DoneReason, ex.tools),
+				"stop_sequence": nil,
+			},
+			"usage": map[string]int{
+				"input_tokens":  res.PromptEvalCount,
+				"output_tokens": res.EvalCount,
+			},
+		})
+		out = ex.send(out, "message_stop", map[string]any{})
+	}
+
+	return out
+}
+
+func (ex *anthropicExchange) contentType() string {
+	return sseContentType
+}
+
+// end reports an error when the stream ended prematurely... the Messages API
+// has no terminating event other than message_stop
+func (ex *anthropicExchange) end(err error) []byte {
+	if err == nil {
+		return nil
+	}
+
+	return ex.event("error", anthropicFailure(fasthttp.StatusBadGateway, err.Error()))
+}
+
+// close ends the content block being streamed, if any
+func (ex *anthropicExchange) close(out []byte) []byte {
+	if ex.blk == "" {
+		return out
+	}
+
+	out = ex.send(out, "content_block_stop", map[string]any{"index": ex.idx})
+	ex.blk = ""
+	ex.idx++
+
+	return out
+}
+
+// event formats the data as a server-sent event of the type
+func (ex *anthropicExchange) event(typ string, b []byte) []byte {
+	out := append([]byte("event: "+typ+"\ndata: "), b...)
+	return append(out, '\n', '\n')
+}
+
+// message translates a complete Ollama chat response
+func (ex *anthropicExchange) message(res ollamaResponse) map[string]any {
+	if res.Model != "" {
+		ex.model = res.Model
+	}
+
+	cnt := []any{}
+	if res.Message.Thinking != "" {
+		cnt = append(cnt, map[string]any{
+			"signature": "",
+			"thinking":  res.Message.Thinking,
+			"type":      "thinking",
+		})
+	}
+
+	if res.Message.Content != "" || len(res.Message.ToolCalls) == 0 {
+		cnt = append(cnt, map[string]any{
+			"text": res.Message.Content,
+			"type": "text",
+		})
+	}
+
+	for _, tc := range res.Message.ToolCalls {
+		input := tc.Function.Arguments
+		if input == nil {
+			input = map[string]any{}
+		}
+
+		cnt = append(cnt, map[string]any{
+			"id":    "toolu_" + rand.Text(),
+			"input": input,
+			"name":  tc.Function.Name,
+			"type":  "tool_use",
+		})
+	}
+
+	return map[string]any{
+		"content":       cnt,
+		"id":            ex.id,
+		"model":         ex.model,
+		"role":          "assistant",
+		"stop_reason":   ex.stopReason(res.DoneReason, len(res.Message.ToolCalls) > 0),
+		"stop_sequence": nil,
+		"type":          "message",
+		"usage": map[string]int{
+			"input_tokens":  res.PromptEvalCount,
+			"output_tokens": res.EvalCount,
+		},
+	}
+}
+
+// messagesRequest translates a Messages API request to an Ollama chat request
+func (ex *anthropicExchange) messagesRequest(b []byte) (*ollamaChatRequest, error) {
+	var areq anthropicMessagesRequest
+	if err := json.Unmarshal(b, &areq); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	ex.model = areq.Model
+
+	creq := &ollamaChatRequest{
+		Messages: []ollamaMessage{},
+		Model:    areq.Model,
+		Options:  anthropicOptions(areq),
+		Stream:   areq.Stream,
+	}
+
+	if areq.Thinking != nil {
+		think := areq.Thinking.Type == "enabled"
+		creq.Think = &think
+	}
+
+	for _, tl := range areq.Tools {
+		prms := tl.InputSchema
+		if len(prms) == 0 {
+			prms = json.RawMessage(`{"type":"object"}`)
+		}
+
+		b, err := json.Marshal(map[string]any{
+			"function": map[string]any{
+				"description": tl.Description,
+				"name":        tl.Name,
+				"parameters":  prms,
+			},
+			"type": "function",
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid tool %s: %w", tl.Name, err)
+		}
+		creq.Tools = append(creq.Tools, b)
+	}
+
+	// the system prompt is either a string or an array of text blocks
+	if len(areq.System) > 0 && string(areq.System) != "null" {
+		blks, err := anthropicBlocks(areq.System)
+		if err != nil {
+			return nil, fmt.Errorf("invalid system prompt: %w", err)
+		}
+
+		var sb strings.Builder
+		for _, blk := range blks {
+			sb.WriteString(blk.Text)
+		}
+		creq.Messages = append(creq.Messages, ollamaMessage{Content: sb.String(), Role: "system"})
+	}
+
+	// tool results are named for the tool use block they answer
+	names := map[string]string{}
+	for _, msg := range areq.Messages {
+		blks, err := anthropicBlocks(msg.Content)
+		if err != nil {
+			return nil, err
+		}
+
+		cm := ollamaMessage{Role: msg.Role}
+		rslts := false
+		for _, blk := range blks {
+			switch blk.Type {
+			case "text":
+				cm.Content += blk.Text
+			case "image":
+				if blk.Source == nil || blk.Source.Type != "base64" {
+					return nil, fmt.Errorf("only base64 image sources are supported")
+				}
+				cm.Images = append(cm.Images, blk.Source.Data)
+			case "thinking":
+				cm.Thinking += blk.Thinking
+			case "redacted_thinking":
+			case "tool_use":
+				call := ollamaToolCall{}
+				call.Function.Arguments = blk.Input
+				call.Function.Name = blk.Name
+
+				names[blk.ID] = blk.Name
+				cm.ToolCalls = append(cm.ToolCalls, call)
+			case "tool_result":
+				// results are sent to Ollama as tool messages
+				res, err := anthropicBlocks(blk.Content)
+				if err != nil {
+					return nil, fmt.Errorf("invalid tool result %s: %w", blk.ToolUseID, err)
+				}
+
+				var sb strings.Builder
+				for _, r := range res {
+					sb.WriteString(r.Text)
+				}
+
+				txt := sb.String()
+				if blk.IsError {
+					txt = "Error: " + txt
+				}
+
+				rslts = true
+				creq.Messages = append(creq.Messages, ollamaMessage{
+					Content:  txt,
+					Role:     "tool",
+					ToolName: names[blk.ToolUseID],
+				})
+			default:
+				return nil, fmt.Errorf("unsupported content block type %q", blk.Type)
+			}
+		}
+
+		// a user message holding only tool results has nothing left to send
+		if rslts && cm.Content == "" && len(cm.Images) == 0 {
+			continue
+		}
+
+		creq.Messages = append(creq.Messages, cm)
+	}
+
+	return creq, nil
+}
+
+// models translates an Ollama tags response to a models list
+func (ex *anthropicExchange) models(res ollamaTagsResponse) map[string]any {
+	data := make([]any, 0, len(res.Models))
+	for _, mdl := range res.Models {
+		data = append(data, map[string]any{
+			"created_at":   mdl.ModifiedAt.UTC().Format(time.RFC3339),
+			"display_name": mdl.Name,
+			"id":           mdl.Name,
+			"type":         "model",
+		})
+	}
+
+	out := map[string]any{
+		"data":     data,
+		"first_id": nil,
+		"has_more": false,
+		"last_id":  nil,
+	}
+
+	if len(res.Models) > 0 {
+		out["first_id"] = res.Models[0].Name
+		out["last_id"] = res.Models[len(res.Models)-1].Name
+	}
+
+	return out
+}
+
+// open starts a content block of the type, ending the current block when it
+// is of another type
+func (ex *anthropicExchange) open(out []byte, typ string, blk map[string]any) []byte {
+	if ex.blk == typ && typ != "tool_use" {
+		return out
+	}
+
+	out = ex.close(out)
+	ex.blk = typ
+
+	return ex.send(out, "content_block_start", map[string]any{
+		"content_block": blk,
+		"index":         ex.idx,
+	})
+}
+
+// send appends an event of the type to out
+func (ex *anthropicExchange) send(out []byte, typ string, data map[string]any) []byte {
+	data["type"] = typ
+
+	b, err := json.Marshal(data)
+	if err != nil {
+		return out
+	}
+
+	return append(out, ex.event(typ, b)...)
+}
+
+func (ex *anthropicExchange) stopReason(rsn string, tools bool) string {
+	switch {
+	case tools:
+		return "tool_use"
+	case rsn == "length":
+		return "max_tokens"
+	default:
+		return "end_turn"
+	}
+}
+
+// anthropicBlocks reads message content, which is either a string or an array
+// of content blocks
+func anthropicBlocks(raw json.RawMessage) ([]anthropicBlock, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var txt string
+	if err := json.Unmarshal(raw, &txt); err == nil {
+		return []anthropicBlock{{Text: txt, Type: "text"}}, nil
+	}
+
+	var blks []anthropicBlock
+	if err := json.Unmarshal(raw, &blks); err != nil {
+		return nil, fmt.Errorf("invalid message content: %w", err)
+	}
+
+	return blks, nil
+}
+
+// anthropicOptions translates sampling parameters to Ollama model options
+func anthropicOptions(areq anthropicMessagesRequest) map[string]any {
+	opts := openAIOptions(areq.Temperature, areq.TopP, nil, areq.StopSequences, nil, nil, areq.MaxTokens)
+	if areq.TopK != nil {
+		if opts == nil {
+			opts = map[string]any{}
+		}
+		opts["top_k"] = *areq.TopK
+	}
+
+	return opts
+}
+
+// anthropicFailure returns an error response body in the form the Anthropic
+// API uses, with the error type corresponding to the status code
+func anthropicFailure(code int, msg string) []byte {
+	typ := "invalid_request_error"
+	switch {
+	case code == fasthttp.StatusUnauthorized:
+		typ = "authentication_error"
+	case code == fasthttp.StatusForbidden:
+		typ = "permission_error"
+	case code == fasthttp.StatusNotFound:
+		typ = "not_found_error"
+	case code == fasthttp.StatusRequestEntityTooLarge:
+		typ = "request_too_large"
+	case code == fasthttp.StatusTooManyRequests:
+		typ = "rate_limit_error"
+	case code == fasthttp.StatusServiceUnavailable:
+		typ = "overloaded_error"
+	case code >= fasthttp.StatusInternalServerError:
+		typ = "api_error"
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": msg,
+			"type":    typ,
+		},
+		"type": "error",
+	})
+
+	return b
+}
@@ -0,0 +1,368 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestAnthropicTranslate(t *testing.T) {
+	tests := []struct {
+		name     string
+		mthd     string
+		pth      string
+		body     string
+		wantPath string
+		wantBody string
+		wantCode int
+	}{
+		{
+			name:     "messages",
+			pth:      "/v1/messages",
+			body:     `{"model":"llama3.2","max_tokens":64,"system":[{"type":"text","text":"be "},{"type":"text","text":"brief"}],"messages":[{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image","source":{"type":"base64","media_type":"image/png","data":"AAAA"}}]}],"stop_sequences":["END"],"top_k":40,"stream":true,"thinking":{"type":"enabled"}}`,
+			wantPath: "/api/chat",
+			wantBody: `{"messages":[{"content":"be brief","role":"system"},{"content":"hi","images":["AAAA"],"role":"user"}],"model":"llama3.2","options":{"num_predict":64,"stop":["END"],"top_k":40},"stream":true,"think":true}`,
+		},
+		{
+			name:     "messages with tool use",
+			pth:      "/v1/messages",
+			body:     `{"model":"llama3.2","max_tokens":64,"tools":[{"name":"get_weather","description":"weather for a city","input_schema":{"type":"object"}}],"messages":[{"role":"user","content":"weather in Paris?"},{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}}]},{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":"20C"}]}]}`,
+			wantPath: "/api/chat",
+			wantBody: `{"messages":[{"content":"weather in Paris?","role":"user"},{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":{"city":"Paris"},"name":"get_weather"}}]},{"content":"20C","role":"tool","tool_name":"get_weather"}],"model":"llama3.2","options":{"num_predict":64},"stream":false,"tools":[{"function":{"description":"weather for a city","name":"get_weather","parameters":{"type":"object"}},"type":"function"}]}`,
+		},
+		{
+			name:     "messages with a failed tool result",
+			pth:      "/v1/messages",
+			body:     `{"model":"llama3.2","max_tokens":64,"messages":[{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","is_error":true,"content":[{"type":"text","text":"timed out"}]},{"type":"text","text":"try again"}]}]}`,
+			wantPath: "/api/chat",
+			wantBody: `{"messages":[{"content":"Error: timed out","role":"tool"},{"content":"try again","role":"user"}],"model":"llama3.2","options":{"num_predict":64},"stream":false}`,
+		},
+		{
+			name:     "messages with an image URL",
+			pth:      "/v1/messages",
+			body:     `{"model":"llama3.2","max_tokens":64,"messages":[{"role":"user","content":[{"type":"image","source":{"type":"url","url":"https://example.com/cat.png"}}]}]}`,
+			wantCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "messages with an unsupported block",
+			pth:      "/v1/messages",
+			body:     `{"model":"llama3.2","max_tokens":64,"messages":[{"role":"user","content":[{"type":"document"}]}]}`,
+			wantCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "messages with GET",
+			mthd:     fasthttp.MethodGet,
+			pth:      "/v1/messages",
+			wantCode: fasthttp.StatusMethodNotAllowed,
+		},
+		{
+			name:     "models",
+			mthd:     fasthttp.MethodGet,
+			pth:      "/v1/models",
+			wantPath: "/api/tags",
+		},
+		{
+			name:     "models with POST",
+			pth:      "/v1/models",
+			wantCode: fasthttp.StatusMethodNotAllowed,
+		},
+		{
+			name: "OpenAI API is not translated",
+			pth:  "/v1/chat/completions",
+			body: `{"model":"llama3.2"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mthd := tt.mthd
+			if mthd == "" {
+				mthd = fasthttp.MethodPost
+			}
+
+			ex, rpth, body, err := translateRequest(t, &anthropicProtocol{}, mthd, tt.pth, tt.body)
+			if tt.wantCode != 0 {
+				var perr *protocolError
+				if !errors.As(err, &perr) || perr.code != tt.wantCode {
+					t.Fatalf("error = %v, want status %d", err, tt.wantCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if rpth != tt.wantPath {
+				t.Errorf("path = %q, want %q", rpth, tt.wantPath)
+			}
+
+			if (ex == nil) != (tt.wantPath == "") {
+				t.Errorf("exchange = %v, want one only for translated endpoints", ex)
+			}
+
+			if tt.wantBody == "" {
+				if tt.wantPath != "" && body != "" {
+					t.Errorf("body = %q, want none", body)
+				}
+				return
+			}
+
+			assertJSON(t, []byte(body), tt.wantBody)
+		})
+	}
+}
+
+func TestAnthropicExchangeBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		pth      string
+		req      string
+		code     int
+		resp     string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "message",
+			pth:      "/v1/messages",
+			req:      `{"model":"llama3.2","max_tokens":64,"messages":[]}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"llama3.2","message":{"role":"assistant","content":"hello","thinking":"greet them"},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":2}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"content":[{"signature":"","thinking":"greet them","type":"thinking"},{"text":"hello","type":"text"}],"model":"llama3.2","role":"assistant","stop_reason":"end_turn","stop_sequence":null,"type":"message","usage":{"input_tokens":3,"output_tokens":2}}`,
+		},
+		{
+			name:     "message cut short",
+			pth:      "/v1/messages",
+			req:      `{"model":"llama3.2","max_tokens":2,"messages":[]}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"llama3.2","message":{"role":"assistant","content":"hel"},"done":true,"done_reason":"length","prompt_eval_count":3,"eval_count":2}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"content":[{"text":"hel","type":"text"}],"model":"llama3.2","role":"assistant","stop_reason":"max_tokens","stop_sequence":null,"type":"message","usage":{"input_tokens":3,"output_tokens":2}}`,
+		},
+		{
+			name:     "models",
+			pth:      "/v1/models",
+			code:     fasthttp.StatusOK,
+			resp:     `{"models":[{"name":"llama3.2:latest","modified_at":"2024-01-01T00:00:00Z"},{"name":"qwen3:8b","modified_at":"2024-02-01T00:00:00Z"}]}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"data":[{"created_at":"2024-01-01T00:00:00Z","display_name":"llama3.2:latest","id":"llama3.2:latest","type":"model"},{"created_at":"2024-02-01T00:00:00Z","display_name":"qwen3:8b","id":"qwen3:8b","type":"model"}],"first_id":"llama3.2:latest","has_more":false,"last_id":"qwen3:8b"}`,
+		},
+		{
+			name:     "runner error",
+			pth:      "/v1/messages",
+			req:      `{"model":"llama3.2","max_tokens":64,"messages":[]}`,
+			code:     fasthttp.StatusNotFound,
+			resp:     `{"error":"model \"llama3.2\" not found"}`,
+			wantCode: fasthttp.StatusNotFound,
+			want:     `{"error":{"message":"model \"llama3.2\" not found","type":"not_found_error"},"type":"error"}`,
+		},
+		{
+			name:     "unreadable runner response",
+			pth:      "/v1/messages",
+			req:      `{"model":"llama3.2","max_tokens":64,"messages":[]}`,
+			code:     fasthttp.StatusOK,
+			resp:     `not json`,
+			wantCode: fasthttp.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mthd := fasthttp.MethodPost
+			if tt.req == "" {
+				mthd = fasthttp.MethodGet
+			}
+
+			ex, _, _, err := translateRequest(t, &anthropicProtocol{}, mthd, tt.pth, tt.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			code, b := ex.body(tt.code, []byte(tt.resp))
+			if code != tt.wantCode {
+				t.Errorf("status = %d, want %d", code, tt.wantCode)
+			}
+
+			if tt.want == "" {
+				return
+			}
+
+			assertJSON(t, b, tt.want, "id")
+		})
+	}
+}
+
+func TestAnthropicExchangeBodyToolUse(t *testing.T) {
+	ex, _, _, err := translateRequest(t, &anthropicProtocol{}, fasthttp.MethodPost, "/v1/messages", `{"model":"llama3.2","max_tokens":64,"messages":[]}`)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, b := ex.body(fasthttp.StatusOK, []byte(`{"model":"llama3.2","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Paris"}}}]},"done":true,"done_reason":"stop"}`))
+
+	var msg struct {
+		Content    []anthropicBlock `json:"content"`
+		ID         string           `json:"id"`
+		StopReason string           `json:"stop_reason"`
+	}
+	if err := json.Unmarshal(b, &msg); err != nil {
+		t.Fatalf("invalid message %s: %v", b, err)
+	}
+
+	if msg.StopReason != "tool_use" {
+		t.Errorf("stop reason = %q, want tool_use", msg.StopReason)
+	}
+
+	if !strings.HasPrefix(msg.ID, "msg_") {
+		t.Errorf("id = %q, want a msg_ prefix", msg.ID)
+	}
+
+	// the tool use block stands alone, without an empty text block
+	if len(msg.Content) != 1 {
+		t.Fatalf("content = %+v, want a single tool use block", msg.Content)
+	}
+
+	blk := msg.Content[0]
+	if blk.Type != "tool_use" || blk.Name != "get_weather" || blk.Input["city"] != "Paris" || !strings.HasPrefix(blk.ID, "toolu_") {
+		t.Errorf("block = %+v, want the get_weather tool use", blk)
+	}
+}
+
+func TestAnthropicExchangeStream(t *testing.T) {
+	const start = `message_start: {"message":{"content":[],"model":"llama3.2","role":"assistant","stop_reason":null,"stop_sequence":null,"type":"message","usage":{"input_tokens":0,"output_tokens":0}},"type":"message_start"}`
+
+	tests := []struct {
+		name string
+		lns  []string
+		err  error
+		want []string
+	}{
+		{
+			name: "text",
+			lns: []string{
+				`{"model":"llama3.2","message":{"role":"assistant","content":"Hel"},"done":false}`,
+				`{"model":"llama3.2","message":{"role":"assistant","content":"lo"},"done":false}`,
+				`{"model":"llama3.2","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":2}`,
+			},
+			want: []string{
+				start,
+				`content_block_start: {"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`,
+				`content_block_delta: {"delta":{"text":"Hel","type":"text_delta"},"index":0,"type":"content_block_delta"}`,
+				`content_block_delta: {"delta":{"text":"lo","type":"text_delta"},"index":0,"type":"content_block_delta"}`,
+				`content_block_stop: {"index":0,"type":"content_block_stop"}`,
+				`message_delta: {"delta":{"stop_reason":"end_turn","stop_sequence":null},"type":"message_delta","usage":{"input_tokens":3,"output_tokens":2}}`,
+				`message_stop: {"type":"message_stop"}`,
+			},
+		},
+		{
+			name: "thinking then text",
+			lns: []string{
+				`{"model":"llama3.2","message":{"role":"assistant","thinking":"hmm"},"done":false}`,
+				`{"model":"llama3.2","message":{"role":"assistant","content":"Hi"},"done":false}`,
+				`{"model":"llama3.2","message":{"role":"assistant","content":""},"done":true,"done_reason":"length","eval_count":2}`,
+			},
+			want: []string{
+				start,
+				`content_block_start: {"content_block":{"signature":"","thinking":"","type":"thinking"},"index":0,"type":"content_block_start"}`,
+				`content_block_delta: {"delta":{"thinking":"hmm","type":"thinking_delta"},"index":0,"type":"content_block_delta"}`,
+				`content_block_stop: {"index":0,"type":"content_block_stop"}`,
+				`content_block_start: {"content_block":{"text":"","type":"text"},"index":1,"type":"content_block_start"}`,
+				`content_block_delta: {"delta":{"text":"Hi","type":"text_delta"},"index":1,"type":"content_block_delta"}`,
+				`content_block_stop: {"index":1,"type":"content_block_stop"}`,
+				`message_delta: {"delta":{"stop_reason":"max_tokens","stop_sequence":null},"type":"message_delta","usage":{"input_tokens":0,"output_tokens":2}}`,
+				`message_stop: {"type":"message_stop"}`,
+			},
+		},
+		{
+			name: "runner error mid-stream",
+			lns: []string{
+				`{"model":"llama3.2","message":{"role":"assistant","content":"Hel"},"done":false}`,
+				`{"error":"out of memory"}`,
+			},
+			want: []string{
+				start,
+				`content_block_start: {"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`,
+				`content_block_delta: {"delta":{"text":"Hel","type":"text_delta"},"index":0,"type":"content_block_delta"}`,
+				`error: {"error":{"message":"out of memory","type":"api_error"},"type":"error"}`,
+			},
+		},
+		{
+			name: "stream ended prematurely",
+			lns: []string{
+				`{"model":"llama3.2","message":{"role":"assistant","content":"Hel"},"done":false}`,
+			},
+			err: errors.New("unexpected EOF"),
+			want: []string{
+				start,
+				`content_block_start: {"content_block":{"text":"","type":"text"},"index":0,"type":"content_block_start"}`,
+				`content_block_delta: {"delta":{"text":"Hel","type":"text_delta"},"index":0,"type":"content_block_delta"}`,
+				`error: {"error":{"message":"unexpected EOF","type":"api_error"},"type":"error"}`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ex, _, _, err := translateRequest(t, &anthropicProtocol{}, fasthttp.MethodPost, "/v1/messages", `{"model":"llama3.2","max_tokens":64,"messages":[],"stream":true}`)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			got := streamEvents(ex, tt.lns, tt.err)
+			if len(got) != len(tt.want) {
+				t.Fatalf("events = %q, want %d events", got, len(tt.want))
+			}
+
+			for i, evt := range got {
+				typ, data, _ := strings.Cut(evt, ": ")
+				wtyp, wdata, _ := strings.Cut(tt.want[i], ": ")
+				if typ != wtyp {
+					t.Errorf("event %d type = %q, want %q", i, typ, wtyp)
+					continue
+				}
+
+				// the message identifier is generated, so it is checked apart
+				if typ == "message_start" {
+					var ms struct {
+						Message map[string]any `json:"message"`
+					}
+					json.Unmarshal([]byte(data), &ms)
+					if id, _ := ms.Message["id"].(string); !strings.HasPrefix(id, "msg_") {
+						t.Errorf("message id = %q, want a msg_ prefix", id)
+					}
+
+					delete(ms.Message, "id")
+					b, _ := json.Marshal(map[string]any{"message": ms.Message, "type": typ})
+					data = string(b)
+				}
+
+				assertJSON(t, []byte(data), wdata)
+			}
+		})
+	}
+}
+
+func TestAnthropicFailure(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{code: fasthttp.StatusBadRequest, want: "invalid_request_error"},
+		{code: fasthttp.StatusUnauthorized, want: "authentication_error"},
+		{code: fasthttp.StatusForbidden, want: "permission_error"},
+		{code: fasthttp.StatusNotFound, want: "not_found_error"},
+		{code: fasthttp.StatusRequestEntityTooLarge, want: "request_too_large"},
+		{code: fasthttp.StatusTooManyRequests, want: "rate_limit_error"},
+		{code: fasthttp.StatusServiceUnavailable, want: "overloaded_error"},
+		{code: fasthttp.StatusBadGateway, want: "api_error"},
+	}
+
+	for _, tt := range tests {
+		assertJSON(t, anthropicFailure(tt.code, "failed"), `{"error":{"message":"failed","type":"`+tt.want+`"},"type":"error"}`)
+	}
+}
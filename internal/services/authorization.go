@@ -1,8 +1,11 @@
 package services
 
 import (
+	"errors"
+	"fmt"
 	"strings"
 
+	"aidanwoods.dev/go-paseto"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
@@ -10,6 +13,24 @@ import (
 	"go.jtlabs.io/runner-gateway/internal/models"
 )
 
+// auth failure reasons, recorded in the gateway metrics
+const (
+	authBadSignature    = "bad_signature"
+	authExpired         = "expired"
+	authInvalid         = "invalid"
+	authInvalidClaims   = "invalid_claims"
+	authMalformed       = "malformed"
+	authMissingClaim    = "missing_claim"
+	authMissingHeader   = "missing_header"
+	authUnsupportedType = "unsupported_token_type"
+)
+
+// headerAPIKey holds the token for clients that do not send an Authorization
+// header (i.e. Anthropic SDK clients)
+const headerAPIKey = "X-Api-Key"
+
+var errMissingAuthorization = errors.New("missing authorization header")
+
 type authorizationService struct {
 	pp  interfaces.PASETOProvider
 	log zerolog.Logger
@@ -26,15 +47,34 @@ func NewAuthorizationService(pp interfaces.PASETOProvider, s *models.Settings) *
 	return svc
 }
 
-func (svc *authorizationService) AuthorizeRequest(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+// AuthorizeRequest validates the token provided in the Authorization header
+// or, when it is not sent, the x-api-key header (401 when missing or invalid)
+// and ensures it holds the claims required (403 when it does not) before
+// calling next
+func (svc *authorizationService) AuthorizeRequest(req models.ClaimRequirements, next fasthttp.RequestHandler) fasthttp.RequestHandler {
 	return func(ctx *fasthttp.RequestCtx) {
-		svc.log.Trace().
+		lg := models.RequestLogger(ctx, svc.log)
+		lg.Trace().
 			Str("uri", string(ctx.RequestURI())).
 			Msg("Authorizing request")
 
-		// validate Authorization
+		// the span ends once the request is authorized, before next is called
+		_, span := tracer.Start(models.ContextTrace(ctx), "authorize")
+		fail := func(rsn string, err error) {
+			authFailures.WithLabelValues(rsn).Inc()
+			span.SetAttributes(attrAuthFailure.String(rsn))
+			endSpan(span, 0, err)
+			span.End()
+		}
+
+		// validate Authorization (or the API key sent in its place)
 		hdr := ctx.Request.Header.Peek("Authorization")
 		if hdr == nil {
+			hdr = ctx.Request.Header.Peek(headerAPIKey)
+		}
+
+		if hdr == nil {
+			fail(authMissingHeader, errMissingAuthorization)
 			ctx.Error("Missing authorization error", fasthttp.StatusUnauthorized)
 			return
 		}
@@ -43,11 +83,30 @@ func (svc *authorizationService) AuthorizeRequest(next fasthttp.RequestHandler)
 		tkn := strings.TrimPrefix(string(hdr), "Bearer ")
 
 		// validate token
-		if err := svc.ValidateToken(tkn); err != nil {
+		parsed, err := svc.validateToken(lg, tkn)
+		if err != nil {
+			fail(authFailureReason(err), err)
 			ctx.Error(err.Error(), fasthttp.StatusUnauthorized)
 			return
 		}
 
+		// ensure the token holds the claims required
+		clms := models.NewClaims(parsed)
+		if name, ok := clms.Satisfies(req); !ok {
+			fail(authMissingClaim, fmt.Errorf("token is missing required claim: %s", name))
+			lg.Warn().
+				Str("claim", name).
+				Str("subject", clms.Subject()).
+				Str("uri", string(ctx.RequestURI())).
+				Msg("Token is missing a required claim")
+			ctx.Error("Token is missing required claim: "+name, fasthttp.StatusForbidden)
+			return
+		}
+
+		// make the claims available to subsequent handlers
+		models.SetContextClaims(ctx, clms)
+		span.End()
+
 		next(ctx)
 	}
 }
@@ -110,16 +169,58 @@ func (svc *authorizationService) GenerateSymmetricKey() string {
 	return sym
 }
 
-func (svc *authorizationService) ValidateToken(tkn string) error {
-	svc.log.Trace().Str("token", tkn).Msg("Validating token")
+func (svc *authorizationService) ValidateToken(tkn string) (*paseto.Token, error) {
+	return svc.validateToken(&svc.log, tkn)
+}
+
+// VerifyKeys ensures the keys needed to validate tokens were read
+func (svc *authorizationService) VerifyKeys() error {
+	return svc.pp.VerifyKeys()
+}
 
-	if err := svc.pp.ValidateToken(tkn); err != nil {
-		svc.log.Warn().
+// validateToken validates the token, logging any failure with the logger
+// given (i.e. that of the request being authorized)
+func (svc *authorizationService) validateToken(lg *zerolog.Logger, tkn string) (*paseto.Token, error) {
+	lg.Trace().Str("token", tkn).Msg("Validating token")
+
+	parsed, err := svc.pp.ValidateToken(tkn)
+	if err != nil {
+		lg.Warn().
 			Err(err).
 			Str("token", tkn).
 			Msg("Failed to parse token")
-		return err
+		return nil, err
 	}
 
-	return nil
+	return parsed, nil
+}
+
+// authFailureReason returns the reason a token failed validation... tokens
+// failing a rule (i.e. expiry) were otherwise valid, while token errors are
+// either a signature (or MAC) that did not verify or a malformed token
+func authFailureReason(err error) string {
+	var (
+		re paseto.RuleError
+		te paseto.TokenError
+	)
+
+	switch {
+	case errors.Is(err, errUnsupportedToken):
+		return authUnsupportedType
+	case errors.As(err, &re):
+		if strings.Contains(re.Error(), "expired") {
+			return authExpired
+		}
+
+		return authInvalidClaims
+	case errors.As(err, &te):
+		msg := te.Error()
+		if strings.Contains(msg, "bad signature") || strings.Contains(msg, "bad message authentication code") || strings.Contains(msg, "could not be decrypted") {
+			return authBadSignature
+		}
+
+		return authMalformed
+	default:
+		return authInvalid
+	}
 }
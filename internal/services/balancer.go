@@ -0,0 +1,171 @@
+package services
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// runnerPool balances requests for a runner across its healthy upstream hosts
+type runnerPool struct {
+	btch     []*lease
+	mu       sync.Mutex
+	q        priorityQueue
+	qmu      sync.Mutex
+	qs       queueStats
+	rnr      models.Runner
+	strategy string
+	ups      []*upstream
+}
+
+// upstream is a single runner host with a pooled client
+type upstream struct {
+	clnt   *fasthttp.HostClient
+	cur    int
+	hlth   hostHealth
+	host   string
+	inflt  atomic.Int64
+	weight int
+}
+
+func newRunnerPool(rnr models.Runner, tr fasthttp.RoundTripper) *runnerPool {
+	pl := &runnerPool{
+		q:        newPriorityQueue(),
+		rnr:      rnr,
+		strategy: rnr.Balancer,
+	}
+
+	isTLS := rnr.Scheme == "https"
+	for _, u := range rnr.Upstreams() {
+		pl.ups = append(pl.ups, &upstream{
+			clnt: &fasthttp.HostClient{
+				Addr:      fasthttp.AddMissingPort(u.Host, isTLS),
+				IsTLS:     isTLS,
+				Transport: tr,
+			},
+			hlth:   hostHealth{healthy: true},
+			host:   u.Host,
+			weight: u.Share(),
+		})
+	}
+
+	return pl
+}
+
+// begin marks the start of a request to the upstream
+func (u *upstream) begin() {
+	u.inflt.Add(1)
+}
+
+// end marks the completion of a request to the upstream (including reading
+// the entire response body)
+func (u *upstream) end() {
+	u.inflt.Add(-1)
+}
+
+// load is the number of outstanding requests (including the one being
+// placed) relative to the upstream weight
+func (u *upstream) load() float64 {
+	return float64(u.inflt.Load()+1) / float64(u.weight)
+}
+
+// pick selects a healthy upstream according to the pool strategy, and returns
+// nil when none of the upstreams are healthy (or each is drained or at the
+// runner limit of requests in flight)
+func (pl *runnerPool) pick() *upstream {
+	lim := int64(pl.rnr.Concurrency.MaxInFlight)
+	ups := make([]*upstream, 0, len(pl.ups))
+	for _, u := range pl.ups {
+		if u.weight > 0 && u.hlth.isHealthy() && (lim <= 0 || u.inflt.Load() < lim) {
+			ups = append(ups, u)
+		}
+	}
+
+	switch {
+	case len(ups) == 0:
+		return nil
+	case len(ups) == 1:
+		return ups[0]
+	}
+
+	switch pl.strategy {
+	case models.LeastOutstanding:
+		return leastOutstanding(ups)
+	case models.RandomTwoChoices:
+		return randomTwoChoices(ups)
+	default:
+		return pl.roundRobin(ups)
+	}
+}
+
+func leastOutstanding(ups []*upstream) *upstream {
+	var sel *upstream
+	for _, u := range ups {
+		if sel == nil || u.load() < sel.load() {
+			sel = u
+		}
+	}
+
+	return sel
+}
+
+// randomTwoChoices selects two upstreams at random (in proportion to their
+// weight) and returns the one with the fewest outstanding requests
+func randomTwoChoices(ups []*upstream) *upstream {
+	a := weightedRandom(ups, nil)
+	b := weightedRandom(ups, a)
+
+	if b.load() < a.load() {
+		return b
+	}
+
+	return a
+}
+
+// roundRobin uses smooth weighted round-robin selection, so that upstreams
+// are selected in proportion to their weight without bursts
+func (pl *runnerPool) roundRobin(ups []*upstream) *upstream {
+	pl.mu.Lock()
+	defer pl.mu.Unlock()
+
+	var (
+		sel *upstream
+		tot int
+	)
+	for _, u := range ups {
+		u.cur += u.weight
+		tot += u.weight
+		if sel == nil || u.cur > sel.cur {
+			sel = u
+		}
+	}
+	sel.cur -= tot
+
+	return sel
+}
+
+func weightedRandom(ups []*upstream, excl *upstream) *upstream {
+	tot := 0
+	for _, u := range ups {
+		if u != excl {
+			tot += u.weight
+		}
+	}
+
+	n := rand.IntN(tot)
+	for _, u := range ups {
+		if u == excl {
+			continue
+		}
+
+		if n < u.weight {
+			return u
+		}
+		n -= u.weight
+	}
+
+	return ups[0]
+}
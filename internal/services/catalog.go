@@ -0,0 +1,265 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const defaultRefreshInterval = 30 * time.Second
+
+// catalogService keeps track of the models available on each runner (keyed by
+// runner hostnames and path) by periodically polling the runner /api/tags
+// endpoint
+type catalogService struct {
+	clnt *fasthttp.Client
+	log  zerolog.Logger
+	mdls map[string][]string
+	mu   sync.RWMutex
+	s    *models.Settings
+}
+
+// listResponse is the response of the runner /api/tags and /api/ps endpoints
+type listResponse struct {
+	Models []map[string]any `json:"models"`
+}
+
+func NewCatalogService(s *models.Settings) *catalogService {
+	return &catalogService{
+		clnt: &fasthttp.Client{
+			ReadTimeout:  5 * time.Second,
+			WriteTimeout: 5 * time.Second,
+		},
+		log:  log.With().Str("service", "catalog").Logger(),
+		mdls: map[string][]string{},
+		s:    s,
+	}
+}
+
+// Collect fetches the models listed by a runner endpoint (i.e. /api/tags or
+// /api/ps) from each of the runners concurrently
+func (svc *catalogService) Collect(pth string, rnrs ...models.Runner) []models.RunnerModels {
+	rslts := make([]models.RunnerModels, len(rnrs))
+
+	var wg sync.WaitGroup
+	for i, rnr := range rnrs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			mdls, err := svc.list(rnr, pth)
+			if err != nil {
+				svc.log.Warn().
+					Err(err).
+					Str("path", pth).
+					Str("runner", rnr.Name).
+					Msg("Failed to collect models from runner")
+			}
+
+			rslts[i] = models.RunnerModels{Err: err, Models: mdls, Runner: rnr}
+		}()
+	}
+	wg.Wait()
+
+	return rslts
+}
+
+// Models returns the models available across the provided runners
+func (svc *catalogService) Models(rnrs ...models.Runner) []string {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	seen := map[string]bool{}
+	for _, rnr := range rnrs {
+		for _, mdl := range svc.mdls[rnr.Key()] {
+			seen[mdl] = true
+		}
+	}
+
+	mdls := make([]string, 0, len(seen))
+	for mdl := range seen {
+		mdls = append(mdls, mdl)
+	}
+	sort.Strings(mdls)
+
+	return mdls
+}
+
+// Refresh polls each runner for the models it has available
+func (svc *catalogService) Refresh() {
+	for _, rnr := range svc.s.Runners {
+		mdls, err := svc.fetch(rnr)
+		if err != nil {
+			// keep the last known models for the runner
+			svc.log.Warn().
+				Err(err).
+				Str("runner", rnr.Name).
+				Msg("Failed to refresh models for runner")
+			continue
+		}
+
+		svc.log.Debug().
+			Str("runner", rnr.Name).
+			Strs("models", mdls).
+			Msg("Refreshed models for runner")
+
+		svc.mu.Lock()
+		svc.mdls[rnr.Key()] = mdls
+		svc.mu.Unlock()
+	}
+}
+
+// Runners returns the runners that have the model available, in the order the
+// runners are configured
+func (svc *catalogService) Runners(mdl string) []models.Runner {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	rnrs := []models.Runner{}
+	for _, rnr := range svc.s.Runners {
+		for _, avl := range svc.mdls[rnr.Key()] {
+			if sameModel(avl, mdl) {
+				rnrs = append(rnrs, rnr)
+				break
+			}
+		}
+	}
+
+	return rnrs
+}
+
+// Start refreshes the catalog and continues to do so on the configured
+// interval in the background
+func (svc *catalogService) Start() {
+	intvl := svc.s.ModelRouting.RefreshInterval
+	if intvl <= 0 {
+		intvl = defaultRefreshInterval
+	}
+
+	svc.Refresh()
+
+	go func() {
+		for range time.Tick(intvl) {
+			svc.Refresh()
+		}
+	}()
+}
+
+func (svc *catalogService) fetch(rnr models.Runner) ([]string, error) {
+	tags, err := svc.list(rnr, "/api/tags")
+	if err != nil {
+		return nil, err
+	}
+
+	mdls := make([]string, 0, len(tags))
+	for _, mdl := range tags {
+		if nm := models.ModelName(mdl); nm != "" {
+			mdls = append(mdls, nm)
+		}
+	}
+
+	return mdls, nil
+}
+
+// list fetches the models listed by a runner endpoint... the models running
+// (/api/ps) differ from host to host and are gathered from each host of the
+// runner, while other listings are taken from the first host that responds
+func (svc *catalogService) list(rnr models.Runner, pth string) ([]map[string]any, error) {
+	var (
+		adpt = newAdapter(rnr)
+		err  error
+		mdls []map[string]any
+		ok   bool
+	)
+	for _, u := range rnr.Upstreams() {
+		lst, lErr := svc.listHost(rnr.Scheme, u.Host, pth, adpt)
+		if lErr != nil {
+			err = lErr
+			continue
+		}
+
+		if pth != "/api/ps" {
+			return lst, nil
+		}
+
+		for _, mdl := range lst {
+			mdl["host"] = u.Host
+		}
+
+		mdls = append(mdls, lst...)
+		ok = true
+	}
+
+	if !ok {
+		return nil, err
+	}
+
+	return mdls, nil
+}
+
+// listHost fetches the models listed by a runner host, using the adapter for
+// the runner type (when the runner does not serve the Ollama API)
+func (svc *catalogService) listHost(schm string, hst string, pth string, adpt protocol) ([]map[string]any, error) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.Header.SetMethod(fasthttp.MethodGet)
+
+	var ex exchange
+	if adpt != nil {
+		tx, tpth, err := adpt.translate(pth, req)
+		if err != nil {
+			return nil, err
+		}
+
+		if tx != nil {
+			ex = tx
+			pth = tpth
+		}
+	}
+
+	req.SetRequestURI(fmt.Sprintf("%s://%s%s", schm, hst, pth))
+
+	if err := svc.clnt.Do(req, resp); err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode() != fasthttp.StatusOK {
+		return nil, fmt.Errorf("unexpected status code %d from %s", resp.StatusCode(), hst)
+	}
+
+	body := resp.Body()
+	if ex != nil {
+		_, body = ex.body(resp.StatusCode(), body)
+	}
+
+	var lst listResponse
+	if err := json.Unmarshal(body, &lst); err != nil {
+		return nil, err
+	}
+
+	return lst.Models, nil
+}
+
+// sameModel compares model names, treating names without a tag as "latest"
+func sameModel(a string, b string) bool {
+	if !strings.Contains(a, ":") {
+		a += ":latest"
+	}
+
+	if !strings.Contains(b, ":") {
+		b += ":latest"
+	}
+
+	return a == b
+}
@@ -1,19 +1,38 @@
 package services
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"runtime/debug"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/interfaces"
 	"go.jtlabs.io/runner-gateway/internal/models"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const ndjsonContentType = "application/x-ndjson"
+
 type gatewayService struct {
-	log zerolog.Logger
-	s   *models.Settings
+	hc    *fasthttp.Client
+	log   zerolog.Logger
+	mu    sync.Mutex
+	pools map[string]*runnerPool
+	s     *models.Settings
+	tr    *upstreamTransport
+	us    interfaces.UsageService
 }
 
 type proxyRequest struct {
@@ -21,19 +40,65 @@ type proxyRequest struct {
 	req  *fasthttp.Request
 }
 
-func NewGatewayService(s *models.Settings) *gatewayService {
+func NewGatewayService(s *models.Settings, us interfaces.UsageService) *gatewayService {
+	tmt := s.HealthCheck.Timeout
+	if tmt <= 0 {
+		tmt = defaultHealthCheckTimeout
+	}
+
 	return &gatewayService{
-		log: log.With().Str("service", "gateway").Logger(),
-		s:   s,
+		hc: &fasthttp.Client{
+			ReadTimeout:  tmt,
+			WriteTimeout: tmt,
+		},
+		log:   log.With().Str("service", "gateway").Logger(),
+		pools: map[string]*runnerPool{},
+		s:     s,
+		tr:    newUpstreamTransport(s.Server.StreamIdleTimeout),
+		us:    us,
+	}
+}
+
+// cancelOnDisconnect watches the client connection and cancels the upstream
+// call if the client goes away... the returned func stops watching and
+// reports whether the call was canceled (because the client went away)
+func (svc *gatewayService) cancelOnDisconnect(conn net.Conn, call *upstreamCall) func() bool {
+	cc, ok := watchConn(conn)
+	if !ok {
+		return call.isDisconnected
+	}
+
+	gone, stop := cc.watch()
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-gone:
+			call.cancel()
+		case <-done:
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		stop()
+		return call.isDisconnected()
 	}
 }
 
-func (svc *gatewayService) ForwardRequest(hst string, pthPfx string, schm string) func(*fasthttp.RequestCtx) {
+// ForwardRequest returns a handler that proxies requests to one of the runner
+// hosts, removing the path prefix from the request path
+func (svc *gatewayService) ForwardRequest(rnr models.Runner, pthPfx string) fasthttp.RequestHandler {
+	pl := svc.pool(rnr)
+	pr := newProtocol(rnr)
+	schm := rnr.Scheme
+
 	return func(ctx *fasthttp.RequestCtx) {
+		lg := models.RequestLogger(ctx, svc.log)
 		pxyReq := &proxyRequest{
 			rcvd: time.Now(),
 			req:  fasthttp.AcquireRequest(),
 		}
+		defer fasthttp.ReleaseRequest(pxyReq.req)
 
 		// recovery for unhandled exceptions
 		defer func() {
@@ -47,7 +112,7 @@ func (svc *gatewayService) ForwardRequest(hst string, pthPfx string, schm string
 					ctx.SetBodyString("Internal server error")
 				}
 
-				svc.log.Error().
+				lg.Error().
 					Str("duration", time.Since(pxyReq.rcvd).String()).
 					Interface("panic", rec).
 					Str("stacktrace", string(debug.Stack())).
@@ -61,19 +126,141 @@ func (svc *gatewayService) ForwardRequest(hst string, pthPfx string, schm string
 		// evaluate inbound path and determine if adjustments are needed
 		dwnUri := pxyReq.req.URI()
 		pth := string(dwnUri.Path())
-		if len(pthPfx) > 1 {
-			svc.log.Trace().
+		if pfx := strings.TrimSuffix(pthPfx, "/"); pfx != "" {
+			lg.Trace().
 				Str("prefix", pthPfx).
 				Str("path", pth).
 				Msg("Trimming prefix from path")
-			pth = strings.TrimPrefix(pth, pthPfx)
+			if pth = strings.TrimPrefix(pth, pfx); pth == "" {
+				pth = "/"
+			}
 		}
 
-		// 
-		svc.log.Debug().
-			Str("originalHost", string(dwnUri.Host())).
-			Str("originalPath", string(dwnUri.Path())).
-			Str("originalScheme", string(dwnUri.Scheme())).
+		// requests are measured until the response has been relayed (streamed
+		// responses are measured once the stream ends)
+		rel := pth
+		mdl, _ := models.RequestModel(ctx, rel)
+		requestsInFlight.WithLabelValues(rnr.Name).Inc()
+		measure := func(code int) {
+			requestsInFlight.WithLabelValues(rnr.Name).Dec()
+			observeRequest(rnr, rel, code, mdl, time.Since(pxyReq.rcvd).Seconds())
+		}
+
+		strm := false
+		defer func() {
+			if !strm {
+				measure(ctx.Response.StatusCode())
+			}
+		}()
+
+		// the runner and model are recorded on the span of the request
+		tc := models.ContextTrace(ctx)
+		attrs := []attribute.KeyValue{attrRunner.String(rnr.Name)}
+		if mdl != "" {
+			attrs = append(attrs, semconv.GenAIRequestModel(mdl))
+		}
+		trace.SpanFromContext(tc).SetAttributes(attrs...)
+
+		// translate requests made with the runner front-end protocol
+		var ex exchange
+		if pr != nil {
+			tx, tpth, err := pr.translate(pth, pxyReq.req)
+			if err != nil {
+				code := fasthttp.StatusInternalServerError
+				if pe, ok := err.(*protocolError); ok {
+					code = pe.code
+				}
+
+				lg.Warn().
+					Err(err).
+					Str("path", pth).
+					Str("protocol", rnr.Protocol).
+					Str("runner", rnr.Name).
+					Msg("Failed to translate request")
+
+				ctx.SetStatusCode(code)
+				ctx.SetContentType("application/json")
+				ctx.SetBody(pr.failure(code, err.Error()))
+				relayed(ctx)
+				return
+			}
+
+			if tx != nil {
+				lg.Trace().
+					Str("path", pth).
+					Str("protocol", rnr.Protocol).
+					Str("targetPath", tpth).
+					Msg("Translated request")
+
+				// the runner response must be readable to be translated
+				pxyReq.req.Header.Del(fasthttp.HeaderAcceptEncoding)
+				ex = tx
+				pth = tpth
+			}
+		}
+
+		// select the runner host to send the request to, waiting in the
+		// runner queue (by priority class) when each of its hosts is busy
+		prty, rank := svc.priority(ctx)
+		if hdr := svc.s.Priority.Header; hdr != "" {
+			pxyReq.req.Header.Del(hdr)
+		}
+
+		_, rspan := tracer.Start(tc, "route", trace.WithAttributes(attrRunner.String(rnr.Name), attrPriority.String(prty)))
+		ls, wait, err := pl.acquire(models.ContextClaims(ctx).Subject(), rank, ctx.Conn())
+		rspan.SetAttributes(attrQueueWait.Int64(wait.Milliseconds()))
+		if err != nil {
+			endSpan(rspan, 0, err)
+			rspan.End()
+
+			evt := lg.Warn().
+				Err(err).
+				Str("path", string(dwnUri.Path())).
+				Str("priority", prty).
+				Str("queueWait", wait.String()).
+				Str("runner", rnr.Name)
+
+			switch err {
+			case errClientGone:
+				evt.Msg("Client disconnected while waiting for runner host")
+				return
+			case errNoHosts:
+				evt.Msg("No healthy hosts available for runner")
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBodyString("No healthy hosts available for runner")
+			default:
+				evt.Msg("No runner host available for request")
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBodyString("No runner host available: " + err.Error())
+			}
+			return
+		}
+		up := ls.up
+		hst := up.host
+		rspan.SetAttributes(semconv.ServerAddress(hst))
+		rspan.End()
+
+		if wait > 0 {
+			lg.Debug().
+				Str("priority", prty).
+				Str("queueWait", wait.String()).
+				Str("runner", rnr.Name).
+				Str("targetHost", hst).
+				Msg("Admitted request from runner queue")
+		}
+
+		// usage is read from the runner response and linked to the subject
+		mtr := newUsageMeter(rnr, hst, rel, models.ContextAccount(ctx), mdl, models.ContextRequestID(ctx), models.ContextClaims(ctx).Subject())
+
+		// capture the original request details for logging
+		orgHst := string(dwnUri.Host())
+		orgPth := string(dwnUri.Path())
+		orgSchm := string(dwnUri.Scheme())
+
+		lg.Debug().
+			Str("originalHost", orgHst).
+			Str("originalPath", orgPth).
+			Str("originalScheme", orgSchm).
 			Str("targetHost", hst).
 			Str("targetPath", pth).
 			Str("targetScheme", schm).
@@ -83,26 +270,359 @@ func (svc *gatewayService) ForwardRequest(hst string, pthPfx string, schm string
 		dwnUri.SetPath(pth)
 		dwnUri.SetScheme(schm)
 
+		// track the upstream call so it can be canceled if the client goes away
+		call := svc.tr.track(pxyReq.req)
+		defer svc.tr.untrack(pxyReq.req)
+		stop := svc.cancelOnDisconnect(ctx.Conn(), call)
+		pl.track(ls, call)
+
+		// the host request count is held until the response has been relayed
+		done := func() bool {
+			pl.release(ls)
+			return stop()
+		}
+
+		// the runner continues the trace from the span of the upstream call,
+		// which ends once the response has been relayed
+		utc, uspan := tracer.Start(tc, "upstream", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(append(attrs,
+			semconv.HTTPRequestMethodKey.String(string(pxyReq.req.Header.Method())),
+			semconv.ServerAddress(hst),
+			semconv.URLPath(pth),
+		)...))
+		injectTrace(utc, pxyReq.req)
+		ae := contextAccess(ctx)
+		var sent time.Time
+		end := func(code int, err error) {
+			ae.upstream(rnr.Name, hst, time.Since(sent))
+			if u, ok := mtr.usage(); ok {
+				uspan.SetAttributes(
+					semconv.GenAIUsageInputTokens(u.PromptTokens),
+					semconv.GenAIUsageOutputTokens(u.CompletionTokens),
+				)
+			}
+
+			endSpan(uspan, code, err)
+			uspan.End()
+		}
+
 		// reverse proxy the request, log any errors and respond accordingly
-		if err := fasthttp.Do(pxyReq.req, &ctx.Response); err != nil {
-			svc.log.Error().
+		resp := fasthttp.AcquireResponse()
+		sent = time.Now()
+		if err := up.clnt.Do(pxyReq.req, resp); err != nil {
+			fasthttp.ReleaseResponse(resp)
+			end(0, err)
+			if done() {
+				lg.Warn().
+					Str("duration", time.Since(pxyReq.rcvd).String()).
+					Str("uri", dwnUri.String()).
+					Int("bytes", 0).
+					Msg("Client disconnected, canceled upstream request")
+				return
+			}
+
+			if errors.Is(err, errPreempted) {
+				lg.Warn().
+					Str("priority", prty).
+					Str("uri", dwnUri.String()).
+					Msg("Request preempted by higher priority requests")
+				ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+				ctx.SetBodyString(err.Error())
+				return
+			}
+
+			lg.Error().
 				Err(err).
 				Str("uri", dwnUri.String()).
 				Msg("Failed to proxy request")
+			svc.observe(pl, up, err, false)
 
 			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
 			ctx.SetBodyString(err.Error())
 			return
 		}
 
-		svc.log.Info().
-			Str("duration", time.Since(pxyReq.rcvd).String()).
-			Str("originalHost", string(dwnUri.Host())).
-			Str("originalPath", string(dwnUri.Path())).
-			Str("originalScheme", string(dwnUri.Scheme())).
-			Str("targetHost", hst).
-			Str("targetPath", pth).
-			Str("targetScheme", schm).
+		upstreamTTFB.WithLabelValues(rnr.Name, hst).Observe(time.Since(sent).Seconds())
+
+		// runner errors count toward ejecting the host from rotation
+		if code := resp.StatusCode(); code >= fasthttp.StatusInternalServerError {
+			svc.observe(pl, up, fmt.Errorf("unexpected status code %d", code), false)
+		} else {
+			svc.observe(pl, up, nil, false)
+		}
+
+		// copy the status and headers received from the runner
+		resp.Header.CopyTo(&ctx.Response.Header)
+		if ex != nil {
+			ctx.Response.Header.SetContentType("application/json")
+		}
+
+		evt := func(lvl zerolog.Level) *zerolog.Event {
+			return lg.WithLevel(lvl).
+				Str("duration", time.Since(pxyReq.rcvd).String()).
+				Str("originalHost", orgHst).
+				Str("originalPath", orgPth).
+				Str("originalScheme", orgSchm).
+				Str("priority", prty).
+				Str("queueWait", wait.String()).
+				Str("targetHost", hst).
+				Str("targetPath", pth).
+				Str("targetScheme", schm)
+		}
+
+		// responses without a known length (i.e. chunked NDJSON from a
+		// streaming generate or chat call) are relayed as they arrive
+		if resp.Header.ContentLength() < 0 && resp.BodyStream() != nil {
+			if ex != nil {
+				ctx.Response.Header.SetContentType(ex.contentType())
+				ctx.Response.Header.Set(fasthttp.HeaderCacheControl, "no-cache")
+			}
+
+			strm = true
+			code := ctx.Response.StatusCode()
+			var (
+				n     int
+				upErr error
+			)
+			sw := svc.streamResponse(ctx.Conn(), resp, ex, mtr, func() bool {
+				dsc := done()
+				measure(code)
+				return dsc
+			}, evt, func(byts int, err error) {
+				n = byts
+				if upErr = err; err != nil {
+					svc.observe(pl, up, err, false)
+				}
+			})
+
+			relayed(ctx)
+
+			// the server span ends (and the access log record is written) once
+			// the stream has ended
+			ss := contextSpan(ctx)
+			ss.hold()
+			ae.hold()
+			ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+				sw(w)
+				end(code, upErr)
+				ss.release()
+				ae.streamed(n)
+			})
+			return
+		}
+
+		// responses with a known length are relayed in full
+		err = resp.BodyWriteTo(ctx)
+		fasthttp.ReleaseResponse(resp)
+		code := ctx.Response.StatusCode()
+		if done() {
+			end(code, call.err())
+			evt(zerolog.WarnLevel).
+				Int("bytes", len(ctx.Response.Body())).
+				Msg("Client disconnected, canceled upstream request")
+			return
+		}
+
+		if err != nil {
+			end(code, err)
+			evt(zerolog.ErrorLevel).
+				Err(err).
+				Msg("Failed to read response from runner")
+			svc.observe(pl, up, err, false)
+
+			ctx.ResetBody()
+			ctx.SetStatusCode(fasthttp.StatusBadGateway)
+			ctx.SetBodyString(err.Error())
+			return
+		}
+
+		if code < fasthttp.StatusBadRequest {
+			mtr.observe(ctx.Response.Body())
+			svc.record(mtr)
+		}
+		end(code, nil)
+		relayed(ctx)
+
+		// translate the runner response for the front-end protocol
+		if ex != nil {
+			code, b := ex.body(ctx.Response.StatusCode(), ctx.Response.Body())
+			ctx.SetStatusCode(code)
+			ctx.SetBody(b)
+		}
+
+		evt(zerolog.InfoLevel).
+			Int("bytes", len(ctx.Response.Body())).
+			Msg("Successfully proxied request")
+	}
+}
+
+// streamResponse returns a stream writer that relays the runner response to
+// the client line by line, flushing after each NDJSON chunk... each line is
+// translated by the exchange, when the request was translated, and fin is
+// called with the bytes relayed (and any error reading from the runner) once
+// the stream ends
+func (svc *gatewayService) streamResponse(conn net.Conn, resp *fasthttp.Response, ex exchange, mtr *usageMeter, done func() bool, evt func(zerolog.Level) *zerolog.Event, fin func(int, error)) fasthttp.StreamWriter {
+	ndjson := bytes.HasPrefix(resp.Header.ContentType(), []byte(ndjsonContentType))
+	idle := svc.s.Server.StreamIdleTimeout
+
+	return func(w *bufio.Writer) {
+		// the server write timeout applies to the entire response, so it is
+		// replaced with a per-chunk deadline for the duration of the stream
+		if idle > 0 {
+			defer conn.SetWriteDeadline(time.Time{})
+		}
+
+		var (
+			n     int
+			pend  []byte
+			upErr error
+			wErr  error
+		)
+		rdr := bufio.NewReader(resp.BodyStream())
+		for {
+			ln, rErr := rdr.ReadSlice('\n')
+			mtr.write(ln)
+
+			// translated lines are held until the line is complete
+			if ex != nil && len(ln) > 0 {
+				pend = append(pend, ln...)
+				if errors.Is(rErr, bufio.ErrBufferFull) {
+					continue
+				}
+
+				ln = ex.chunk(pend)
+				pend = pend[:0]
+			}
+
+			if len(ln) > 0 {
+				if idle > 0 {
+					conn.SetWriteDeadline(time.Now().Add(idle))
+				}
+
+				if _, wErr = w.Write(ln); wErr != nil {
+					break
+				}
+
+				// hold partial lines until the remainder arrives
+				if !errors.Is(rErr, bufio.ErrBufferFull) {
+					if wErr = w.Flush(); wErr != nil {
+						break
+					}
+				}
+
+				n += len(ln)
+			}
+
+			if rErr == nil || errors.Is(rErr, bufio.ErrBufferFull) {
+				continue
+			}
+
+			if !errors.Is(rErr, io.EOF) {
+				upErr = rErr
+			}
+
+			break
+		}
+
+		// releasing the response closes the runner connection if the body
+		// was not read in full (i.e. the client went away mid-stream)
+		fasthttp.ReleaseResponse(resp)
+
+		mtr.flush()
+		svc.record(mtr)
+
+		if done() || wErr != nil {
+			evt(zerolog.WarnLevel).
+				Int("bytes", n).
+				Msg("Client disconnected, canceled upstream request")
+			fin(n, nil)
+			return
+		}
+
+		// terminate the translated stream (i.e. with an OpenAI [DONE] event)
+		if ex != nil {
+			b := ex.end(upErr)
+			w.Write(b)
+			w.Flush()
+			n += len(b)
+		}
+
+		if upErr != nil {
+			// let NDJSON clients know the stream ended prematurely, in the
+			// same form Ollama uses to report errors mid-stream
+			if ndjson && ex == nil {
+				b, _ := json.Marshal(map[string]string{"error": upErr.Error()})
+				w.Write(append(b, '\n'))
+				w.Flush()
+				n += len(b) + 1
+			}
+
+			evt(zerolog.ErrorLevel).
+				Err(upErr).
+				Int("bytes", n).
+				Msg("Failed to stream response from runner")
+			fin(n, upErr)
+			return
+		}
+
+		evt(zerolog.InfoLevel).
+			Int("bytes", n).
 			Msg("Successfully proxied request")
+		fin(n, nil)
+	}
+}
+
+// pool returns the pool of hosts for the runner... pools are shared by every
+// handler forwarding to the runner (i.e. direct and model routing)
+func (svc *gatewayService) pool(rnr models.Runner) *runnerPool {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	if pl, ok := svc.pools[rnr.Key()]; ok {
+		return pl
 	}
+
+	pl := newRunnerPool(rnr, svc.tr)
+	svc.pools[rnr.Key()] = pl
+
+	return pl
+}
+
+// record stores the usage read from a runner response, when reported
+func (svc *gatewayService) record(mtr *usageMeter) {
+	if svc.us == nil {
+		return
+	}
+
+	if u, ok := mtr.usage(); ok {
+		svc.us.Record(u)
+	}
+}
+
+// priority returns the priority class of the request (and its rank), taken
+// from the priority header when set... the priority claim (when configured
+// and held by the token) holds the highest class the token may use (and its
+// class otherwise), and no token may use a class above the default class
+// without it, so that interactive requests cannot be sent to preempt others
+func (svc *gatewayService) priority(ctx *fasthttp.RequestCtx) (string, int) {
+	prty := models.PriorityDefault
+	if clm := svc.s.Priority.Claim; clm != "" {
+		if vals := models.ContextClaims(ctx).Values(clm); len(vals) > 0 {
+			if _, ok := models.PriorityRank(vals[0]); ok {
+				prty = vals[0]
+			}
+		}
+	}
+
+	lim, _ := models.PriorityRank(prty)
+
+	if hdr := svc.s.Priority.Header; hdr != "" {
+		val := string(ctx.Request.Header.Peek(hdr))
+		if rank, ok := models.PriorityRank(val); ok && rank >= lim {
+			prty = val
+		}
+	}
+
+	rank, _ := models.PriorityRank(prty)
+
+	return prty, rank
 }
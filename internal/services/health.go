@@ -0,0 +1,282 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const (
+	defaultEjection            = 30 * time.Second
+	defaultHealthCheckInterval = 10 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+	defaultHealthyThreshold    = 2
+	defaultUnhealthyThreshold  = 3
+)
+
+// hostHealth tracks consecutive failures (from health checks and proxied
+// requests) and successful health checks for an upstream host
+type hostHealth struct {
+	fails   int
+	healthy bool
+	lastChk time.Time
+	lastErr string
+	mu      sync.Mutex
+	succs   int
+}
+
+// failure records a failed health check or proxied request and reports
+// whether the host was ejected as a result
+func (h *hostHealth) failure(err error, thrsh int, probe bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fails++
+	h.succs = 0
+	h.lastErr = err.Error()
+	if probe {
+		h.lastChk = time.Now()
+	}
+
+	if h.healthy && h.fails >= thrsh {
+		h.healthy = false
+		return true
+	}
+
+	return false
+}
+
+// restore returns an ejected host to rotation once its ejection has passed
+// (when health checks are not configured to return it), reporting whether it
+// was ejected
+func (h *hostHealth) restore() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.healthy {
+		return false
+	}
+
+	h.fails = 0
+	h.healthy = true
+	h.lastErr = ""
+
+	return true
+}
+
+func (h *hostHealth) isHealthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.healthy
+}
+
+func (h *hostHealth) snapshot(hst string) models.HostHealth {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return models.HostHealth{
+		Failures:  h.fails,
+		Healthy:   h.healthy,
+		Host:      hst,
+		LastCheck: h.lastChk,
+		LastError: h.lastErr,
+		Successes: h.succs,
+	}
+}
+
+// success records a successful health check or proxied request and reports
+// whether the host was returned to rotation as a result... only health checks
+// return an ejected host to rotation, as it receives no requests
+func (h *hostHealth) success(thrsh int, probe bool) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.fails = 0
+	if !probe {
+		return false
+	}
+
+	h.lastChk = time.Now()
+	h.succs++
+
+	if !h.healthy && h.succs >= thrsh {
+		h.healthy = true
+		h.lastErr = ""
+		return true
+	}
+
+	return false
+}
+
+// Health returns the health of each of the runner hosts
+func (svc *gatewayService) Health() []models.RunnerHealth {
+	svc.mu.Lock()
+	defer svc.mu.Unlock()
+
+	hlth := []models.RunnerHealth{}
+	for _, rnr := range svc.s.Runners {
+		pl, ok := svc.pools[rnr.Key()]
+		if !ok {
+			continue
+		}
+
+		rh := models.RunnerHealth{Name: rnr.Name, Path: rnr.Path}
+		for _, u := range pl.ups {
+			hh := u.hlth.snapshot(u.host)
+			hh.Drained = u.weight == 0
+			hh.InFlight = u.inflt.Load()
+			rh.Healthy = rh.Healthy || (hh.Healthy && !hh.Drained)
+			rh.Hosts = append(rh.Hosts, hh)
+		}
+
+		if rnr.Concurrency.MaxInFlight > 0 {
+			rh.Queue = pl.queue()
+		}
+
+		hlth = append(hlth, rh)
+	}
+
+	return hlth
+}
+
+// StartHealthChecks probes each of the runner hosts and continues to do so on
+// the configured interval in the background
+func (svc *gatewayService) StartHealthChecks() {
+	intvl := svc.s.HealthCheck.Interval
+	if intvl <= 0 {
+		intvl = defaultHealthCheckInterval
+	}
+
+	svc.checkHealth()
+
+	go func() {
+		for range time.Tick(intvl) {
+			svc.checkHealth()
+		}
+	}()
+}
+
+// checkHealth probes each of the runner hosts concurrently
+func (svc *gatewayService) checkHealth() {
+	svc.mu.Lock()
+	pls := make([]*runnerPool, 0, len(svc.pools))
+	for _, pl := range svc.pools {
+		pls = append(pls, pl)
+	}
+	svc.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, pl := range pls {
+		for _, up := range pl.ups {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				svc.observe(pl, up, svc.probe(pl.rnr.Scheme, up.host), true)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// observe records the outcome of a health check or proxied request and logs
+// any change in the host health... proxied requests eject failing hosts
+// whether or not health checks are configured, and ejected hosts are returned
+// to rotation by health checks when configured (or after the ejection period
+// otherwise)
+func (svc *gatewayService) observe(pl *runnerPool, up *upstream, err error, probe bool) {
+	// preempted requests say nothing of the host health
+	if errors.Is(err, errPreempted) {
+		return
+	}
+
+	if err != nil {
+		thrsh := svc.s.HealthCheck.UnhealthyThreshold
+		if thrsh <= 0 {
+			thrsh = defaultUnhealthyThreshold
+		}
+
+		if up.hlth.failure(err, thrsh, probe) {
+			svc.log.Warn().
+				Err(err).
+				Int("failures", thrsh).
+				Str("host", up.host).
+				Str("runner", pl.rnr.Name).
+				Msg("Runner host is unhealthy, removed from rotation")
+
+			if svc.s.HealthCheck.Path == "" {
+				svc.restore(pl, up)
+			}
+			return
+		}
+
+		svc.log.Debug().
+			Err(err).
+			Str("host", up.host).
+			Bool("probe", probe).
+			Str("runner", pl.rnr.Name).
+			Msg("Runner host failure")
+		return
+	}
+
+	thrsh := svc.s.HealthCheck.HealthyThreshold
+	if thrsh <= 0 {
+		thrsh = defaultHealthyThreshold
+	}
+
+	if up.hlth.success(thrsh, probe) {
+		svc.log.Info().
+			Str("host", up.host).
+			Int("successes", thrsh).
+			Str("runner", pl.rnr.Name).
+			Msg("Runner host is healthy, returned to rotation")
+		pl.resume()
+	}
+}
+
+// restore returns the host to rotation once the ejection period has passed,
+// for when no health checks are configured to do so
+func (svc *gatewayService) restore(pl *runnerPool, up *upstream) {
+	ejct := svc.s.HealthCheck.Ejection
+	if ejct <= 0 {
+		ejct = defaultEjection
+	}
+
+	time.AfterFunc(ejct, func() {
+		if !up.hlth.restore() {
+			return
+		}
+
+		svc.log.Info().
+			Dur("ejection", ejct).
+			Str("host", up.host).
+			Str("runner", pl.rnr.Name).
+			Msg("Runner host ejection has passed, returned to rotation")
+		pl.resume()
+	})
+}
+
+// probe calls the health check path on the runner host
+func (svc *gatewayService) probe(schm string, hst string) error {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(fmt.Sprintf("%s://%s%s", schm, hst, svc.s.HealthCheck.Path))
+	req.Header.SetMethod(fasthttp.MethodGet)
+
+	if err := svc.hc.Do(req, resp); err != nil {
+		return err
+	}
+
+	if code := resp.StatusCode(); code < 200 || code > 299 {
+		return fmt.Errorf("unexpected status code %d", code)
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo is used as a read deadline to unblock a background read
+var aLongTimeAgo = time.Unix(1, 0)
+
+type clientListener struct {
+	net.Listener
+}
+
+// clientConn allows the gateway to watch for a client disconnecting while a
+// request is being forwarded. Between requests, the server is not reading
+// from the connection, so a background read is used to detect when the
+// client goes away; any data received in the meantime (i.e. a pipelined
+// request) is held and returned on the next Read.
+type clientConn struct {
+	net.Conn
+	cond   *sync.Cond
+	err    error
+	gone   chan struct{}
+	hasB   bool
+	inRead bool
+	mu     sync.Mutex
+	one    [1]byte
+}
+
+// tlsClientConn preserves the TLS connection state of the underlying
+// connection so that the server still recognizes it as TLS
+type tlsClientConn struct {
+	*clientConn
+	tc *tls.Conn
+}
+
+// NewClientListener wraps the provided listener so that the gateway can
+// detect client disconnects and cancel any in-flight upstream requests
+func NewClientListener(lstnr net.Listener) net.Listener {
+	return &clientListener{Listener: lstnr}
+}
+
+func (l *clientListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &clientConn{Conn: conn}
+	cc.cond = sync.NewCond(&cc.mu)
+
+	if tc, ok := conn.(*tls.Conn); ok {
+		return &tlsClientConn{clientConn: cc, tc: tc}, nil
+	}
+
+	return cc, nil
+}
+
+func (c *tlsClientConn) ConnectionState() tls.ConnectionState {
+	return c.tc.ConnectionState()
+}
+
+func (c *tlsClientConn) Handshake() error {
+	return c.tc.Handshake()
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for c.inRead {
+		c.cond.Wait()
+	}
+
+	if c.hasB && len(b) > 0 {
+		b[0] = c.one[0]
+		c.hasB = false
+		return 1, nil
+	}
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	c.mu.Unlock()
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+
+	return n, err
+}
+
+// watch starts a background read on the connection and returns a channel
+// that is closed if the client disconnects, along with a func to stop
+// watching (which must be called before the server reads from the
+// connection again)
+func (c *clientConn) watch() (<-chan struct{}, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	gone := make(chan struct{})
+	if c.err != nil || c.hasB {
+		// the client has already gone away, or has sent more data
+		if c.err != nil {
+			close(gone)
+		}
+
+		return gone, func() {}
+	}
+
+	c.gone = gone
+	c.inRead = true
+	go c.backgroundRead()
+
+	return gone, c.stop
+}
+
+func (c *clientConn) backgroundRead() {
+	n, err := c.Conn.Read(c.one[:])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if n == 1 {
+		c.hasB = true
+	}
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() && c.gone == nil {
+		// the read was aborted by stop... this is expected
+		err = nil
+	}
+
+	if err != nil {
+		c.err = err
+		if c.gone != nil {
+			close(c.gone)
+			c.gone = nil
+		}
+	}
+
+	c.inRead = false
+	c.cond.Broadcast()
+}
+
+func (c *clientConn) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.inRead {
+		return
+	}
+
+	c.gone = nil
+	c.Conn.SetReadDeadline(aLongTimeAgo)
+	for c.inRead {
+		c.cond.Wait()
+	}
+	c.Conn.SetReadDeadline(time.Time{})
+}
+
+// watchConn returns the watcher for the connection, if it was accepted by a
+// client listener
+func watchConn(conn net.Conn) (*clientConn, bool) {
+	switch cc := conn.(type) {
+	case *clientConn:
+		return cc, true
+	case *tlsClientConn:
+		return cc.clientConn, true
+	default:
+		return nil, false
+	}
+}
@@ -0,0 +1,137 @@
+package services
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptPair returns a connection accepted by a client listener and the
+// client end of it
+func acceptPair(t *testing.T) (*clientConn, net.Conn) {
+	t.Helper()
+
+	lstnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lstnr.Close() })
+
+	cl := NewClientListener(lstnr)
+	clnt, err := net.Dial("tcp", lstnr.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { clnt.Close() })
+
+	conn, err := cl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	cc, ok := watchConn(conn)
+	if !ok {
+		t.Fatal("accepted connection cannot be watched")
+	}
+
+	return cc, clnt
+}
+
+func isClosed(ch <-chan struct{}, wait time.Duration) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+	}
+
+	select {
+	case <-ch:
+		return true
+	case <-time.After(wait):
+		return false
+	}
+}
+
+func TestClientConnWatch(t *testing.T) {
+	tests := []struct {
+		name string
+		send string
+		hang bool
+		gone bool
+		want string
+	}{
+		{name: "client disconnects", hang: true, gone: true},
+		{name: "client sends a pipelined request", send: "GET / HTTP/1.1\r\n", want: "GET / HTTP/1.1\r\n"},
+		{name: "client stays connected", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, clnt := acceptPair(t)
+			gone, stop := cc.watch()
+
+			if tt.send != "" {
+				clnt.Write([]byte(tt.send))
+			}
+
+			if tt.hang {
+				clnt.Close()
+			}
+
+			if got := isClosed(gone, 200*time.Millisecond); got != tt.gone {
+				t.Fatalf("gone = %t, want %t", got, tt.gone)
+			}
+
+			stopped := make(chan struct{})
+			go func() {
+				stop()
+				close(stopped)
+			}()
+
+			if !isClosed(stopped, 5*time.Second) {
+				t.Fatal("stop did not end the background read")
+			}
+
+			if tt.gone {
+				if _, err := cc.Read(make([]byte, 1)); err == nil {
+					t.Error("read after disconnect did not fail")
+				}
+				return
+			}
+
+			// the server reads any data received while watching, followed by
+			// data sent after watching stopped
+			clnt.Write([]byte("next"))
+			want := tt.want + "next"
+			got := make([]byte, len(want))
+			cc.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(cc, got); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if string(got) != want {
+				t.Errorf("read %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestClientConnWatchAfterDisconnect(t *testing.T) {
+	cc, clnt := acceptPair(t)
+
+	gone, stop := cc.watch()
+	clnt.Close()
+	if !isClosed(gone, 5*time.Second) {
+		t.Fatal("disconnect not detected")
+	}
+	stop()
+
+	// watching again reports the client has gone right away
+	gone, stop = cc.watch()
+	defer stop()
+	if !isClosed(gone, 0) {
+		t.Error("disconnect not reported when watching again")
+	}
+}
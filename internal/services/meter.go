@@ -0,0 +1,119 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// maxMeterLine is the longest streamed line read for usage... longer lines
+// are content, rather than the final chunk of a response
+const maxMeterLine = 1 << 20
+
+// usageMeter reads the usage reported in a runner response, which is taken
+// from the metrics in the final chunk of an Ollama response (or the usage of
+// an OpenAI response, for runners that serve the OpenAI API)
+type usageMeter struct {
+	buf  []byte
+	ok   bool
+	skip bool
+	u    models.Usage
+}
+
+// usageMetrics are the fields of a runner response that report usage
+type usageMetrics struct {
+	Done            bool          `json:"done"`
+	EvalCount       int           `json:"eval_count"`
+	EvalDuration    time.Duration `json:"eval_duration"`
+	Model           string        `json:"model"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	TotalDuration   time.Duration `json:"total_duration"`
+	Usage           *openAIUsage  `json:"usage"`
+}
+
+func newUsageMeter(rnr models.Runner, hst string, pth string, acct string, mdl string, rid string, sbj string) *usageMeter {
+	return &usageMeter{
+		u: models.Usage{
+			Account:   acct,
+			Host:      hst,
+			Model:     mdl,
+			Path:      pth,
+			RequestID: rid,
+			Runner:    rnr.Name,
+			Subject:   sbj,
+		},
+	}
+}
+
+// flush reads any line held when the stream ended without a line break
+func (m *usageMeter) flush() {
+	if len(m.buf) > 0 && !m.skip {
+		m.observe(m.buf)
+	}
+
+	m.buf = m.buf[:0]
+	m.skip = false
+}
+
+// observe reads the usage from a response body or a single streamed line
+// (either an NDJSON chunk or a server-sent event)
+func (m *usageMeter) observe(b []byte) {
+	b = bytes.TrimSpace(b)
+	if d, ok := bytes.CutPrefix(b, []byte("data:")); ok {
+		b = bytes.TrimSpace(d)
+	}
+
+	// only the final chunk reports usage
+	if !bytes.Contains(b, []byte(`"prompt_eval_count"`)) && !bytes.Contains(b, []byte(`"prompt_tokens"`)) {
+		return
+	}
+
+	var mtr usageMetrics
+	if err := json.Unmarshal(b, &mtr); err != nil {
+		return
+	}
+
+	switch {
+	case mtr.Done || mtr.PromptEvalCount > 0 || mtr.EvalCount > 0:
+		m.u.CompletionTokens = mtr.EvalCount
+		m.u.EvalDuration = mtr.EvalDuration
+		m.u.PromptTokens = mtr.PromptEvalCount
+		m.u.TotalDuration = mtr.TotalDuration
+	case mtr.Usage != nil:
+		m.u.CompletionTokens = mtr.Usage.CompletionTokens
+		m.u.PromptTokens = mtr.Usage.PromptTokens
+	default:
+		return
+	}
+
+	if m.u.Model == "" {
+		m.u.Model = mtr.Model
+	}
+
+	m.ok = true
+}
+
+// usage returns the usage read from the response, if any was reported
+func (m *usageMeter) usage() (models.Usage, bool) {
+	m.u.Time = time.Now()
+	return m.u, m.ok
+}
+
+// write reads a streamed line, which may arrive in several parts when it is
+// longer than the stream buffer
+func (m *usageMeter) write(ln []byte) {
+	if !m.skip {
+		if len(m.buf)+len(ln) > maxMeterLine {
+			m.buf = m.buf[:0]
+			m.skip = true
+		} else {
+			m.buf = append(m.buf, ln...)
+		}
+	}
+
+	if bytes.HasSuffix(ln, []byte("\n")) {
+		m.flush()
+	}
+}
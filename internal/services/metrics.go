@@ -0,0 +1,208 @@
+package services
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const (
+	defaultMetricsPath = "/metrics"
+	metricsNamespace   = "runner_gateway"
+)
+
+// pathOther groups requests to runner paths other than known endpoints, so
+// that arbitrary paths do not each add a series
+const pathOther = "other"
+
+// metricPaths are the runner endpoints (and front-end protocol endpoints)
+// that requests are grouped by
+var metricPaths = map[string]bool{
+	"/api/chat":            true,
+	"/api/copy":            true,
+	"/api/create":          true,
+	"/api/delete":          true,
+	"/api/embed":           true,
+	"/api/embeddings":      true,
+	"/api/generate":        true,
+	"/api/ps":              true,
+	"/api/pull":            true,
+	"/api/push":            true,
+	"/api/show":            true,
+	"/api/tags":            true,
+	"/api/version":         true,
+	"/v1/chat/completions": true,
+	"/v1/completions":      true,
+	"/v1/embeddings":       true,
+	"/v1/messages":         true,
+	"/v1/models":           true,
+}
+
+// the request metrics are recorded as requests are served, and gathered by
+// each metrics service
+var (
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_failures_total",
+		Help:      "Requests rejected by authorization, by reason.",
+	}, []string{"reason"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "request_duration_seconds",
+		Help:      "Time taken to serve requests forwarded to runners (including streamed responses), by runner, path, status and model.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"runner", "path", "status", "model"})
+	requestsInFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_in_flight",
+		Help:      "Requests being forwarded to runners (including those waiting in a runner queue), by runner.",
+	}, []string{"runner"})
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "requests_total",
+		Help:      "Requests forwarded to runners, by runner, path, status and model.",
+	}, []string{"runner", "path", "status", "model"})
+	upstreamTTFB = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "upstream_ttfb_seconds",
+		Help:      "Time from sending a request to a runner host until its response headers arrive, by runner and host.",
+		Buckets:   []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"runner", "host"})
+)
+
+// the runner host, queue and connection metrics are read from the gateway
+// when gathered
+var (
+	connectionsDesc = prometheus.NewDesc(metricsNamespace+"_upstream_connections", "Connections to runner hosts, by host and state (active or idle).", []string{"host", "state"}, nil)
+	dialsDesc       = prometheus.NewDesc(metricsNamespace+"_upstream_dials_total", "Connections opened to runner hosts, by host.", []string{"host"}, nil)
+	healthyDesc     = prometheus.NewDesc(metricsNamespace+"_upstream_healthy", "Whether the runner host is in rotation (1) or not (0), by runner and host.", []string{"runner", "host"}, nil)
+	hostFlightDesc  = prometheus.NewDesc(metricsNamespace+"_upstream_in_flight", "Requests in flight to runner hosts, by runner and host.", []string{"runner", "host"}, nil)
+	preemptedDesc   = prometheus.NewDesc(metricsNamespace+"_queue_preempted_total", "Batch requests preempted by interactive requests, by runner.", []string{"runner"}, nil)
+	queueDepthDesc  = prometheus.NewDesc(metricsNamespace+"_queue_depth", "Requests waiting in the runner queue, by runner.", []string{"runner"}, nil)
+	rejectedDesc    = prometheus.NewDesc(metricsNamespace+"_queue_rejected_total", "Requests rejected as the runner queue was full, by runner.", []string{"runner"}, nil)
+	reusesDesc      = prometheus.NewDesc(metricsNamespace+"_upstream_connection_reuses_total", "Requests sent on a pooled connection to runner hosts, by host.", []string{"host"}, nil)
+	timedOutDesc    = prometheus.NewDesc(metricsNamespace+"_queue_timed_out_total", "Requests that timed out waiting in the runner queue, by runner.", []string{"runner"}, nil)
+	waitDesc        = prometheus.NewDesc(metricsNamespace+"_queue_wait_seconds_total", "Time spent by requests waiting in the runner queue, by runner.", []string{"runner"}, nil)
+	waitedDesc      = prometheus.NewDesc(metricsNamespace+"_queue_waited_total", "Requests admitted from the runner queue, by runner.", []string{"runner"}, nil)
+)
+
+// metricsService serves the gateway metrics in the Prometheus text format, on
+// a listener separate from the one serving runners
+type metricsService struct {
+	gs  *gatewayService
+	reg *prometheus.Registry
+	s   *models.Settings
+}
+
+// NewMetricsService registers the gateway metrics (along with Go runtime and
+// process metrics) with a registry of its own
+func NewMetricsService(s *models.Settings, gs *gatewayService) *metricsService {
+	svc := &metricsService{
+		gs:  gs,
+		reg: prometheus.NewRegistry(),
+		s:   s,
+	}
+
+	svc.reg.MustRegister(
+		authFailures,
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		requestDuration,
+		requestsInFlight,
+		requestsTotal,
+		svc,
+		upstreamTTFB,
+	)
+
+	return svc
+}
+
+// Collect reads the runner host, queue and connection metrics from the
+// gateway
+func (svc *metricsService) Collect(ch chan<- prometheus.Metric) {
+	for _, rh := range svc.gs.Health() {
+		for _, hh := range rh.Hosts {
+			hlthy := 0.0
+			if hh.Healthy {
+				hlthy = 1
+			}
+
+			ch <- prometheus.MustNewConstMetric(healthyDesc, prometheus.GaugeValue, hlthy, rh.Name, hh.Host)
+			ch <- prometheus.MustNewConstMetric(hostFlightDesc, prometheus.GaugeValue, float64(hh.InFlight), rh.Name, hh.Host)
+		}
+
+		if q := rh.Queue; q != nil {
+			ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(q.Depth), rh.Name)
+			ch <- prometheus.MustNewConstMetric(preemptedDesc, prometheus.CounterValue, float64(q.Preempted), rh.Name)
+			ch <- prometheus.MustNewConstMetric(rejectedDesc, prometheus.CounterValue, float64(q.Rejected), rh.Name)
+			ch <- prometheus.MustNewConstMetric(timedOutDesc, prometheus.CounterValue, float64(q.TimedOut), rh.Name)
+			ch <- prometheus.MustNewConstMetric(waitDesc, prometheus.CounterValue, q.WaitSeconds, rh.Name)
+			ch <- prometheus.MustNewConstMetric(waitedDesc, prometheus.CounterValue, float64(q.Waited), rh.Name)
+		}
+	}
+
+	for hst, cs := range svc.gs.tr.connections() {
+		ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(cs.open-cs.idle), hst, "active")
+		ch <- prometheus.MustNewConstMetric(connectionsDesc, prometheus.GaugeValue, float64(cs.idle), hst, "idle")
+		ch <- prometheus.MustNewConstMetric(dialsDesc, prometheus.CounterValue, float64(cs.dials), hst)
+		ch <- prometheus.MustNewConstMetric(reusesDesc, prometheus.CounterValue, float64(cs.reuses), hst)
+	}
+}
+
+func (svc *metricsService) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{connectionsDesc, dialsDesc, healthyDesc, hostFlightDesc, preemptedDesc, queueDepthDesc, rejectedDesc, reusesDesc, timedOutDesc, waitDesc, waitedDesc} {
+		ch <- d
+	}
+}
+
+// Handler serves the metrics at the metrics path (/metrics by default)
+func (svc *metricsService) Handler() fasthttp.RequestHandler {
+	pth := svc.s.Metrics.Path
+	if pth == "" {
+		pth = defaultMetricsPath
+	}
+
+	mtrcs := fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(svc.reg, promhttp.HandlerOpts{}))
+
+	return func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) != pth || !ctx.IsGet() {
+			ctx.SetStatusCode(fasthttp.StatusNotFound)
+			ctx.SetBodyString("Not Found")
+			return
+		}
+
+		mtrcs(ctx)
+	}
+}
+
+// observeRequest records a request forwarded to a runner... the model is only
+// recorded for requests the runner accepted, so that clients cannot add a
+// series for each model name they send
+func observeRequest(rnr models.Runner, pth string, code int, mdl string, dur float64) {
+	if code >= fasthttp.StatusBadRequest {
+		mdl = ""
+	}
+
+	lbls := []string{rnr.Name, pathGroup(pth), strconv.Itoa(code), mdl}
+	requestsTotal.WithLabelValues(lbls...).Inc()
+	requestDuration.WithLabelValues(lbls...).Observe(dur)
+}
+
+// pathGroup returns the endpoint a runner path is recorded as
+func pathGroup(pth string) string {
+	if metricPaths[pth] {
+		return pth
+	}
+
+	if strings.HasPrefix(pth, "/v1/models/") {
+		return "/v1/models/{model}"
+	}
+
+	return pathOther
+}
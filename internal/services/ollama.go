@@ -0,0 +1,97 @@
+package services
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Ollama API request and response bodies, used by the front-end protocols to
+// translate requests into the Ollama API (and responses from it)
+
+type ollamaChatRequest struct {
+	Format   json.RawMessage   `json:"format,omitempty"`
+	Messages []ollamaMessage   `json:"messages"`
+	Model    string            `json:"model"`
+	Options  map[string]any    `json:"options,omitempty"`
+	Stream   bool              `json:"stream"`
+	Think    *bool             `json:"think,omitempty"`
+	Tools    []json.RawMessage `json:"tools,omitempty"`
+}
+
+type ollamaEmbedRequest struct {
+	Dimensions *int       `json:"dimensions,omitempty"`
+	Input      stringList `json:"input"`
+	Model      string     `json:"model"`
+	Truncate   *bool      `json:"truncate,omitempty"`
+}
+
+type ollamaEmbedResponse struct {
+	Embeddings      [][]float64 `json:"embeddings"`
+	Model           string      `json:"model"`
+	PromptEvalCount int         `json:"prompt_eval_count"`
+}
+
+type ollamaGenerateRequest struct {
+	Format  json.RawMessage `json:"format,omitempty"`
+	Model   string          `json:"model"`
+	Options map[string]any  `json:"options,omitempty"`
+	Prompt  string          `json:"prompt"`
+	Raw     bool            `json:"raw,omitempty"`
+	Stream  bool            `json:"stream"`
+	Suffix  string          `json:"suffix,omitempty"`
+	System  string          `json:"system,omitempty"`
+}
+
+type ollamaMessage struct {
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	Role      string           `json:"role"`
+	Thinking  string           `json:"thinking,omitempty"`
+	ToolCalls []ollamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+// ollamaResponse is a chat or generate response (or a single chunk of one,
+// when streamed), including the final metrics reported when done
+type ollamaResponse struct {
+	CreatedAt       time.Time     `json:"created_at"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	Error           string        `json:"error"`
+	EvalCount       int           `json:"eval_count"`
+	EvalDuration    time.Duration `json:"eval_duration"`
+	Message         ollamaMessage `json:"message"`
+	Model           string        `json:"model"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	Response        string        `json:"response"`
+	TotalDuration   time.Duration `json:"total_duration"`
+}
+
+type ollamaTagsResponse struct {
+	Models []struct {
+		ModifiedAt time.Time `json:"modified_at"`
+		Name       string    `json:"name"`
+		Size       int64     `json:"size"`
+	} `json:"models"`
+}
+
+type ollamaToolCall struct {
+	Function struct {
+		Arguments map[string]any `json:"arguments"`
+		Name      string         `json:"name"`
+	} `json:"function"`
+}
+
+// ollamaError returns the error message of an Ollama error response body
+// (i.e. {"error": "model not found"}), or the body itself when it is not one
+func ollamaError(b []byte) string {
+	var e struct {
+		Error string `json:"error"`
+	}
+
+	if err := json.Unmarshal(b, &e); err == nil && e.Error != "" {
+		return e.Error
+	}
+
+	return string(b)
+}
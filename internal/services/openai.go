@@ -0,0 +1,725 @@
+package services
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const sseContentType = "text/event-stream"
+
+const (
+	openAIChat       = "chat"
+	openAICompletion = "completion"
+	openAIEmbedding  = "embedding"
+	openAIModels     = "models"
+)
+
+// openAIProtocol translates the OpenAI chat completions, completions,
+// embeddings and models endpoints to the Ollama API
+type openAIProtocol struct{}
+
+// openAIExchange translates the Ollama response to a single OpenAI request
+type openAIExchange struct {
+	b64     bool
+	calls   int
+	created int64
+	id      string
+	kind    string
+	model   string
+	role    bool
+	tools   bool
+	usage   bool
+}
+
+type openAIChatRequest struct {
+	FrequencyPenalty    *float64            `json:"frequency_penalty"`
+	MaxCompletionTokens *int                `json:"max_completion_tokens"`
+	MaxTokens           *int                `json:"max_tokens"`
+	Messages            []openAIMessage     `json:"messages"`
+	Model               string              `json:"model"`
+	PresencePenalty     *float64            `json:"presence_penalty"`
+	ResponseFormat      *openAIFormat       `json:"response_format"`
+	Seed                *int                `json:"seed"`
+	Stop                stringList          `json:"stop"`
+	Stream              bool                `json:"stream"`
+	StreamOptions       *openAIStreamOption `json:"stream_options"`
+	Temperature         *float64            `json:"temperature"`
+	Tools               []json.RawMessage   `json:"tools"`
+	TopP                *float64            `json:"top_p"`
+}
+
+type openAICompletionRequest struct {
+	FrequencyPenalty *float64            `json:"frequency_penalty"`
+	MaxTokens        *int                `json:"max_tokens"`
+	Model            string              `json:"model"`
+	PresencePenalty  *float64            `json:"presence_penalty"`
+	Prompt           stringList          `json:"prompt"`
+	Seed             *int                `json:"seed"`
+	Stop             stringList          `json:"stop"`
+	Stream           bool                `json:"stream"`
+	StreamOptions    *openAIStreamOption `json:"stream_options"`
+	Suffix           string              `json:"suffix"`
+	Temperature      *float64            `json:"temperature"`
+	TopP             *float64            `json:"top_p"`
+}
+
+type openAIEmbeddingRequest struct {
+	Dimensions     *int       `json:"dimensions"`
+	EncodingFormat string     `json:"encoding_format"`
+	Input          stringList `json:"input"`
+	Model          string     `json:"model"`
+}
+
+type openAIFormat struct {
+	JSONSchema *struct {
+		Schema json.RawMessage `json:"schema"`
+	} `json:"json_schema"`
+	Type string `json:"type"`
+}
+
+type openAIMessage struct {
+	Content    json.RawMessage  `json:"content"`
+	Role       string           `json:"role"`
+	ToolCallID string           `json:"tool_call_id"`
+	ToolCalls  []openAIToolCall `json:"tool_calls"`
+}
+
+type openAIStreamOption struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type openAIToolCall struct {
+	Function struct {
+		Arguments string `json:"arguments"`
+		Name      string `json:"name"`
+	} `json:"function"`
+	ID    string `json:"id"`
+	Index *int   `json:"index,omitempty"`
+	Type  string `json:"type"`
+}
+
+type openAIUsage struct {
+	CompletionTokens int `json:"completion_tokens"`
+	PromptTokens     int `json:"prompt_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+// stringList is a JSON value that may be either a string or an array of
+// strings (i.e. stop sequences or embedding input)
+type stringList []string
+
+func (l *stringList) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*l = stringList{s}
+		return nil
+	}
+
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return fmt.Errorf("expected a string or an array of strings")
+	}
+
+	*l = ss
+	return nil
+}
+
+func (p *openAIProtocol) failure(code int, msg string) []byte {
+	return openAIFailure(code, msg)
+}
+
+func (p *openAIProtocol) translate(pth string, req *fasthttp.Request) (exchange, string, error) {
+	ex := &openAIExchange{created: time.Now().Unix()}
+
+	switch pth {
+	case "/v1/chat/completions":
+		ex.kind = openAIChat
+		ex.id = "chatcmpl-" + rand.Text()
+	case "/v1/completions":
+		ex.kind = openAICompletion
+		ex.id = "cmpl-" + rand.Text()
+	case "/v1/embeddings":
+		ex.kind = openAIEmbedding
+	case "/v1/models":
+		if !req.Header.IsGet() {
+			return nil, "", &protocolError{fasthttp.StatusMethodNotAllowed, "method not allowed: " + string(req.Header.Method())}
+		}
+
+		ex.kind = openAIModels
+		req.SetBody(nil)
+
+		rpth, _ := models.TranslatedPath(models.ProtocolOpenAI, pth)
+		return ex, rpth, nil
+	default:
+		// other endpoints (i.e. the Ollama API itself) are not translated
+		return nil, "", nil
+	}
+
+	if !req.Header.IsPost() {
+		return nil, "", &protocolError{fasthttp.StatusMethodNotAllowed, "method not allowed: " + string(req.Header.Method())}
+	}
+
+	var (
+		body any
+		err  error
+	)
+	switch ex.kind {
+	case openAIChat:
+		body, err = ex.chatRequest(req.Body())
+	case openAICompletion:
+		body, err = ex.completionRequest(req.Body())
+	case openAIEmbedding:
+		body, err = ex.embeddingRequest(req.Body())
+	}
+
+	if err != nil {
+		return nil, "", &protocolError{fasthttp.StatusBadRequest, err.Error()}
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.SetContentType("application/json")
+	req.SetBody(b)
+
+	rpth, _ := models.TranslatedPath(models.ProtocolOpenAI, pth)
+	return ex, rpth, nil
+}
+
+func (ex *openAIExchange) body(code int, b []byte) (int, []byte) {
+	if code >= fasthttp.StatusBadRequest {
+		return code, openAIFailure(code, ollamaError(b))
+	}
+
+	var (
+		out any
+		err error
+	)
+	switch ex.kind {
+	case openAIChat, openAICompletion:
+		var res ollamaResponse
+		if err = json.Unmarshal(b, &res); err == nil {
+			out = ex.completion(res)
+		}
+	case openAIEmbedding:
+		var res ollamaEmbedResponse
+		if err = json.Unmarshal(b, &res); err == nil {
+			out = ex.embeddings(res)
+		}
+	case openAIModels:
+		var res ollamaTagsResponse
+		if err = json.Unmarshal(b, &res); err == nil {
+			out = ex.models(res)
+		}
+	}
+
+	if err != nil {
+		return fasthttp.StatusBadGateway, openAIFailure(fasthttp.StatusBadGateway, "unable to read runner response: "+err.Error())
+	}
+
+	tb, err := json.Marshal(out)
+	if err != nil {
+		return fasthttp.StatusBadGateway, openAIFailure(fasthttp.StatusBadGateway, err.Error())
+	}
+
+	return code, tb
+}
+
+func (ex *openAIExchange) chunk(ln []byte) []byte {
+	ln = bytes.TrimSpace(ln)
+	if len(ln) == 0 {
+		return nil
+	}
+
+	var res ollamaResponse
+	if err := json.Unmarshal(ln, &res); err != nil {
+		return ex.event(openAIFailure(fasthttp.StatusBadGateway, "unable to read runner response: "+err.Error()))
+	}
+
+	if res.Error != "" {
+		return ex.event(openAIFailure(fasthttp.StatusInternalServerError, res.Error))
+	}
+
+	if ex.model == "" {
+		ex.model = res.Model
+	}
+
+	var out []byte
+	if b, err := json.Marshal(ex.streamChunk(res)); err == nil {
+		out = ex.event(b)
+	}
+
+	// usage is reported in a final chunk of its own, when requested
+	if res.Done && ex.usage {
+		b, _ := json.Marshal(map[string]any{
+			"choices": []any{},
+			"created": ex.created,
+			"id":      ex.id,
+			"model":   ex.model,
+			"object":  ex.object(true),
+			"usage":   openAITokenUsage(res),
+		})
+		out = append(out, ex.event(b)...)
+	}
+
+	return out
+}
+
+func (ex *openAIExchange) contentType() string {
+	return sseContentType
+}
+
+func (ex *openAIExchange) end(err error) []byte {
+	var out []byte
+	if err != nil {
+		out = ex.event(openAIFailure(fasthttp.StatusBadGateway, err.Error()))
+	}
+
+	return append(out, ex.event([]byte("[DONE]"))...)
+}
+
+// chatRequest translates a chat completions request to an Ollama chat request
+func (ex *openAIExchange) chatRequest(b []byte) (*ollamaChatRequest, error) {
+	var oreq openAIChatRequest
+	if err := json.Unmarshal(b, &oreq); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	ex.model = oreq.Model
+	ex.usage = oreq.StreamOptions != nil && oreq.StreamOptions.IncludeUsage
+
+	creq := &ollamaChatRequest{
+		Messages: []ollamaMessage{},
+		Model:    oreq.Model,
+		Options:  openAIOptions(oreq.Temperature, oreq.TopP, oreq.Seed, oreq.Stop, oreq.FrequencyPenalty, oreq.PresencePenalty, oreq.MaxCompletionTokens, oreq.MaxTokens),
+		Stream:   oreq.Stream,
+		Tools:    oreq.Tools,
+	}
+
+	if f := oreq.ResponseFormat; f != nil {
+		switch {
+		case f.Type == "json_object":
+			creq.Format = json.RawMessage(`"json"`)
+		case f.Type == "json_schema" && f.JSONSchema != nil && len(f.JSONSchema.Schema) > 0:
+			creq.Format = f.JSONSchema.Schema
+		}
+	}
+
+	// tool results are named for the tool call they answer
+	names := map[string]string{}
+	for _, msg := range oreq.Messages {
+		cm := ollamaMessage{Role: msg.Role}
+		if cm.Role == "developer" {
+			cm.Role = "system"
+		}
+
+		txt, imgs, err := openAIContent(msg.Content)
+		if err != nil {
+			return nil, err
+		}
+		cm.Content = txt
+		cm.Images = imgs
+
+		for _, tc := range msg.ToolCalls {
+			call := ollamaToolCall{}
+			call.Function.Name = tc.Function.Name
+			if tc.Function.Arguments != "" {
+				if err := json.Unmarshal([]byte(tc.Function.Arguments), &call.Function.Arguments); err != nil {
+					return nil, fmt.Errorf("invalid arguments for tool call %s: %w", tc.ID, err)
+				}
+			}
+
+			names[tc.ID] = tc.Function.Name
+			cm.ToolCalls = append(cm.ToolCalls, call)
+		}
+
+		if msg.Role == "tool" {
+			cm.ToolName = names[msg.ToolCallID]
+		}
+
+		creq.Messages = append(creq.Messages, cm)
+	}
+
+	return creq, nil
+}
+
+// completion translates a complete Ollama chat or generate response
+func (ex *openAIExchange) completion(res ollamaResponse) map[string]any {
+	if res.Model != "" {
+		ex.model = res.Model
+	}
+
+	choice := map[string]any{
+		"finish_reason": ex.finishReason(res.DoneReason, len(res.Message.ToolCalls) > 0),
+		"index":         0,
+	}
+
+	if ex.kind == openAIChat {
+		msg := map[string]any{
+			"content": res.Message.Content,
+			"role":    "assistant",
+		}
+
+		if len(res.Message.ToolCalls) > 0 {
+			msg["tool_calls"] = ex.toolCalls(res.Message.ToolCalls, false)
+		}
+
+		choice["message"] = msg
+	} else {
+		choice["logprobs"] = nil
+		choice["text"] = res.Response
+	}
+
+	return map[string]any{
+		"choices": []any{choice},
+		"created": ex.created,
+		"id":      ex.id,
+		"model":   ex.model,
+		"object":  ex.object(false),
+		"usage":   openAITokenUsage(res),
+	}
+}
+
+// completionRequest translates a completions request to an Ollama generate
+// request
+func (ex *openAIExchange) completionRequest(b []byte) (*ollamaGenerateRequest, error) {
+	var oreq openAICompletionRequest
+	if err := json.Unmarshal(b, &oreq); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	if len(oreq.Prompt) > 1 {
+		return nil, fmt.Errorf("only a single prompt is supported")
+	}
+
+	ex.model = oreq.Model
+	ex.usage = oreq.StreamOptions != nil && oreq.StreamOptions.IncludeUsage
+
+	greq := &ollamaGenerateRequest{
+		Model:   oreq.Model,
+		Options: openAIOptions(oreq.Temperature, oreq.TopP, oreq.Seed, oreq.Stop, oreq.FrequencyPenalty, oreq.PresencePenalty, oreq.MaxTokens, nil),
+		Stream:  oreq.Stream,
+		Suffix:  oreq.Suffix,
+	}
+
+	if len(oreq.Prompt) == 1 {
+		greq.Prompt = oreq.Prompt[0]
+	}
+
+	return greq, nil
+}
+
+// embeddingRequest translates an embeddings request to an Ollama embed request
+func (ex *openAIExchange) embeddingRequest(b []byte) (*ollamaEmbedRequest, error) {
+	var oreq openAIEmbeddingRequest
+	if err := json.Unmarshal(b, &oreq); err != nil {
+		return nil, fmt.Errorf("invalid request body: %w", err)
+	}
+
+	switch oreq.EncodingFormat {
+	case "", "float":
+	case "base64":
+		ex.b64 = true
+	default:
+		return nil, fmt.Errorf("unsupported encoding format %q", oreq.EncodingFormat)
+	}
+
+	ex.model = oreq.Model
+
+	return &ollamaEmbedRequest{
+		Dimensions: oreq.Dimensions,
+		Input:      oreq.Input,
+		Model:      oreq.Model,
+	}, nil
+}
+
+// embeddings translates an Ollama embed response
+func (ex *openAIExchange) embeddings(res ollamaEmbedResponse) map[string]any {
+	data := make([]any, 0, len(res.Embeddings))
+	for i, emb := range res.Embeddings {
+		var val any = emb
+		if ex.b64 {
+			// base64 embeddings are little-endian float32 values
+			buf := make([]byte, 4*len(emb))
+			for j, f := range emb {
+				binary.LittleEndian.PutUint32(buf[4*j:], math.Float32bits(float32(f)))
+			}
+			val = base64.StdEncoding.EncodeToString(buf)
+		}
+
+		data = append(data, map[string]any{
+			"embedding": val,
+			"index":     i,
+			"object":    "embedding",
+		})
+	}
+
+	mdl := res.Model
+	if mdl == "" {
+		mdl = ex.model
+	}
+
+	return map[string]any{
+		"data":   data,
+		"model":  mdl,
+		"object": "list",
+		"usage": map[string]int{
+			"prompt_tokens": res.PromptEvalCount,
+			"total_tokens":  res.PromptEvalCount,
+		},
+	}
+}
+
+// event formats the data as a server-sent event
+func (ex *openAIExchange) event(b []byte) []byte {
+	return append(append([]byte("data: "), b...), '\n', '\n')
+}
+
+func (ex *openAIExchange) finishReason(rsn string, tools bool) string {
+	switch {
+	case tools:
+		return "tool_calls"
+	case rsn == "length":
+		return "length"
+	default:
+		return "stop"
+	}
+}
+
+// models translates an Ollama tags response to a models list
+func (ex *openAIExchange) models(res ollamaTagsResponse) map[string]any {
+	data := make([]any, 0, len(res.Models))
+	for _, mdl := range res.Models {
+		data = append(data, map[string]any{
+			"created":  mdl.ModifiedAt.Unix(),
+			"id":       mdl.Name,
+			"object":   "model",
+			"owned_by": "library",
+		})
+	}
+
+	return map[string]any{
+		"data":   data,
+		"object": "list",
+	}
+}
+
+func (ex *openAIExchange) object(chunk bool) string {
+	switch {
+	case ex.kind == openAICompletion:
+		return "text_completion"
+	case chunk:
+		return "chat.completion.chunk"
+	default:
+		return "chat.completion"
+	}
+}
+
+// streamChunk translates a single chunk of a streamed Ollama chat or generate
+// response
+func (ex *openAIExchange) streamChunk(res ollamaResponse) map[string]any {
+	ex.tools = ex.tools || len(res.Message.ToolCalls) > 0
+
+	choice := map[string]any{
+		"finish_reason": nil,
+		"index":         0,
+	}
+
+	if res.Done {
+		choice["finish_reason"] = ex.finishReason(res.DoneReason, ex.tools)
+	}
+
+	if ex.kind == openAIChat {
+		delta := map[string]any{}
+		if !ex.role {
+			delta["role"] = "assistant"
+			ex.role = true
+		}
+
+		if res.Message.Content != "" || !res.Done {
+			delta["content"] = res.Message.Content
+		}
+
+		if len(res.Message.ToolCalls) > 0 {
+			delta["tool_calls"] = ex.toolCalls(res.Message.ToolCalls, true)
+		}
+
+		choice["delta"] = delta
+	} else {
+		choice["logprobs"] = nil
+		choice["text"] = res.Response
+	}
+
+	return map[string]any{
+		"choices": []any{choice},
+		"created": ex.created,
+		"id":      ex.id,
+		"model":   ex.model,
+		"object":  ex.object(true),
+	}
+}
+
+// toolCalls translates Ollama tool calls, which are identified by their index
+// in the response when streamed
+func (ex *openAIExchange) toolCalls(calls []ollamaToolCall, stream bool) []any {
+	out := make([]any, 0, len(calls))
+	for _, tc := range calls {
+		args, _ := json.Marshal(tc.Function.Arguments)
+		call := map[string]any{
+			"function": map[string]any{
+				"arguments": string(args),
+				"name":      tc.Function.Name,
+			},
+			"id":   "call_" + strings.ToLower(rand.Text()),
+			"type": "function",
+		}
+
+		if stream {
+			call["index"] = ex.calls
+		}
+		ex.calls++
+
+		out = append(out, call)
+	}
+
+	return out
+}
+
+// openAIContent reads the text and images of a message, where the content is
+// either a string or an array of content parts... images must be provided as
+// base64 data URLs, as the runner cannot fetch them
+func openAIContent(raw json.RawMessage) (string, []string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+
+	var txt string
+	if err := json.Unmarshal(raw, &txt); err == nil {
+		return txt, nil, nil
+	}
+
+	var parts []struct {
+		ImageURL struct {
+			URL string `json:"url"`
+		} `json:"image_url"`
+		Text string `json:"text"`
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", nil, fmt.Errorf("invalid message content: %w", err)
+	}
+
+	var (
+		imgs []string
+		sb   strings.Builder
+	)
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			sb.WriteString(part.Text)
+		case "image_url":
+			_, data, ok := strings.Cut(part.ImageURL.URL, ";base64,")
+			if !ok || !strings.HasPrefix(part.ImageURL.URL, "data:") {
+				return "", nil, fmt.Errorf("only base64 data URLs are supported for images")
+			}
+			imgs = append(imgs, data)
+		default:
+			return "", nil, fmt.Errorf("unsupported content part type %q", part.Type)
+		}
+	}
+
+	return sb.String(), imgs, nil
+}
+
+// openAIOptions translates sampling parameters to Ollama model options... the first
+// token limit provided is used
+func openAIOptions(temp *float64, topP *float64, seed *int, stop []string, freq *float64, pres *float64, lmts ...*int) map[string]any {
+	opts := map[string]any{}
+	if temp != nil {
+		opts["temperature"] = *temp
+	}
+
+	if topP != nil {
+		opts["top_p"] = *topP
+	}
+
+	if seed != nil {
+		opts["seed"] = *seed
+	}
+
+	if len(stop) > 0 {
+		opts["stop"] = stop
+	}
+
+	if freq != nil {
+		opts["frequency_penalty"] = *freq
+	}
+
+	if pres != nil {
+		opts["presence_penalty"] = *pres
+	}
+
+	for _, lmt := range lmts {
+		if lmt != nil {
+			opts["num_predict"] = *lmt
+			break
+		}
+	}
+
+	if len(opts) == 0 {
+		return nil
+	}
+
+	return opts
+}
+
+func openAITokenUsage(res ollamaResponse) openAIUsage {
+	return openAIUsage{
+		CompletionTokens: res.EvalCount,
+		PromptTokens:     res.PromptEvalCount,
+		TotalTokens:      res.PromptEvalCount + res.EvalCount,
+	}
+}
+
+// openAIFailure returns an error response body in the form the OpenAI API
+// uses, with the error type corresponding to the status code
+func openAIFailure(code int, msg string) []byte {
+	typ := "invalid_request_error"
+	switch {
+	case code == fasthttp.StatusUnauthorized:
+		typ = "authentication_error"
+	case code == fasthttp.StatusForbidden:
+		typ = "permission_error"
+	case code == fasthttp.StatusTooManyRequests:
+		typ = "rate_limit_error"
+	case code >= fasthttp.StatusInternalServerError:
+		typ = "api_error"
+	}
+
+	b, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"code":    nil,
+			"message": msg,
+			"param":   nil,
+			"type":    typ,
+		},
+	})
+
+	return b
+}
@@ -0,0 +1,438 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+)
+
+// translateRequest translates a front-end API request, returning the
+// exchange, the runner path and the translated request body
+func translateRequest(t *testing.T, p protocol, mthd string, pth string, body string) (exchange, string, string, error) {
+	t.Helper()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+
+	req.Header.SetMethod(mthd)
+	req.SetRequestURI(pth)
+	req.SetBodyString(body)
+
+	ex, rpth, err := p.translate(pth, req)
+	return ex, rpth, string(req.Body()), err
+}
+
+// assertJSON compares JSON documents by value, ignoring the top level keys
+// listed in the document received (i.e. generated identifiers)
+func assertJSON(t *testing.T, got []byte, want string, ignore ...string) {
+	t.Helper()
+
+	var g, w any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON %q: %v", got, err)
+	}
+
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("invalid expected JSON %q: %v", want, err)
+	}
+
+	if m, ok := g.(map[string]any); ok {
+		for _, k := range ignore {
+			delete(m, k)
+		}
+	}
+
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("JSON = %s, want %s", got, want)
+	}
+}
+
+// sseEvents splits a server-sent event stream into the data of each event,
+// prefixed with the event type when there is one (i.e. "ping: {}")
+func sseEvents(b []byte) []string {
+	evts := []string{}
+	for evt := range strings.SplitSeq(strings.TrimSpace(string(b)), "\n\n") {
+		var typ, data string
+		for ln := range strings.SplitSeq(evt, "\n") {
+			if v, ok := strings.CutPrefix(ln, "event: "); ok {
+				typ = v + ": "
+			}
+
+			if v, ok := strings.CutPrefix(ln, "data: "); ok {
+				data = v
+			}
+		}
+
+		if evt != "" {
+			evts = append(evts, typ+data)
+		}
+	}
+
+	return evts
+}
+
+// streamEvents relays the runner NDJSON lines through the exchange, returning
+// the events of the translated stream
+func streamEvents(ex exchange, lns []string, err error) []string {
+	var out []byte
+	for _, ln := range lns {
+		out = append(out, ex.chunk([]byte(ln+"\n"))...)
+	}
+
+	return sseEvents(append(out, ex.end(err)...))
+}
+
+func TestOpenAITranslate(t *testing.T) {
+	tests := []struct {
+		name     string
+		mthd     string
+		pth      string
+		body     string
+		wantPath string
+		wantBody string
+		wantCode int
+	}{
+		{
+			name:     "chat completion",
+			pth:      "/v1/chat/completions",
+			body:     `{"model":"llama3.2","messages":[{"role":"developer","content":"be brief"},{"role":"user","content":[{"type":"text","text":"hi"},{"type":"image_url","image_url":{"url":"data:image/png;base64,AAAA"}}]}],"max_tokens":5,"temperature":0.5,"stream":true,"response_format":{"type":"json_object"}}`,
+			wantPath: "/api/chat",
+			wantBody: `{"format":"json","messages":[{"content":"be brief","role":"system"},{"content":"hi","images":["AAAA"],"role":"user"}],"model":"llama3.2","options":{"num_predict":5,"temperature":0.5},"stream":true}`,
+		},
+		{
+			name:     "chat completion with tool results",
+			pth:      "/v1/chat/completions",
+			body:     `{"model":"llama3.2","messages":[{"role":"assistant","content":null,"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]},{"role":"tool","tool_call_id":"call_1","content":"20C"}],"response_format":{"type":"json_schema","json_schema":{"schema":{"type":"object"}}}}`,
+			wantPath: "/api/chat",
+			wantBody: `{"format":{"type":"object"},"messages":[{"content":"","role":"assistant","tool_calls":[{"function":{"arguments":{"city":"Paris"},"name":"get_weather"}}]},{"content":"20C","role":"tool","tool_name":"get_weather"}],"model":"llama3.2","stream":false}`,
+		},
+		{
+			name:     "chat completion with a remote image",
+			pth:      "/v1/chat/completions",
+			body:     `{"model":"llama3.2","messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]}]}`,
+			wantCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "chat completion with an invalid body",
+			pth:      "/v1/chat/completions",
+			body:     `{"model":`,
+			wantCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "chat completion with GET",
+			mthd:     fasthttp.MethodGet,
+			pth:      "/v1/chat/completions",
+			wantCode: fasthttp.StatusMethodNotAllowed,
+		},
+		{
+			name:     "completion",
+			pth:      "/v1/completions",
+			body:     `{"model":"llama3.2","prompt":["once"],"stop":"\n","max_tokens":3,"suffix":"end"}`,
+			wantPath: "/api/generate",
+			wantBody: `{"model":"llama3.2","options":{"num_predict":3,"stop":["\n"]},"prompt":"once","stream":false,"suffix":"end"}`,
+		},
+		{
+			name:     "completion with several prompts",
+			pth:      "/v1/completions",
+			body:     `{"model":"llama3.2","prompt":["once","twice"]}`,
+			wantCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "embeddings",
+			pth:      "/v1/embeddings",
+			body:     `{"model":"nomic-embed-text","input":"hello","dimensions":2}`,
+			wantPath: "/api/embed",
+			wantBody: `{"dimensions":2,"input":["hello"],"model":"nomic-embed-text"}`,
+		},
+		{
+			name:     "embeddings with an unsupported encoding",
+			pth:      "/v1/embeddings",
+			body:     `{"model":"nomic-embed-text","input":"hello","encoding_format":"int8"}`,
+			wantCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "models",
+			mthd:     fasthttp.MethodGet,
+			pth:      "/v1/models",
+			wantPath: "/api/tags",
+		},
+		{
+			name:     "models with POST",
+			pth:      "/v1/models",
+			wantCode: fasthttp.StatusMethodNotAllowed,
+		},
+		{
+			name: "Ollama API is not translated",
+			pth:  "/api/chat",
+			body: `{"model":"llama3.2"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mthd := tt.mthd
+			if mthd == "" {
+				mthd = fasthttp.MethodPost
+			}
+
+			ex, rpth, body, err := translateRequest(t, &openAIProtocol{}, mthd, tt.pth, tt.body)
+			if tt.wantCode != 0 {
+				var perr *protocolError
+				if !errors.As(err, &perr) || perr.code != tt.wantCode {
+					t.Fatalf("error = %v, want status %d", err, tt.wantCode)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if rpth != tt.wantPath {
+				t.Errorf("path = %q, want %q", rpth, tt.wantPath)
+			}
+
+			if (ex == nil) != (tt.wantPath == "") {
+				t.Errorf("exchange = %v, want one only for translated endpoints", ex)
+			}
+
+			if tt.wantBody == "" {
+				if tt.wantPath != "" && body != "" {
+					t.Errorf("body = %q, want none", body)
+				}
+				return
+			}
+
+			assertJSON(t, []byte(body), tt.wantBody)
+		})
+	}
+}
+
+func TestOpenAIExchangeBody(t *testing.T) {
+	tests := []struct {
+		name     string
+		pth      string
+		req      string
+		code     int
+		resp     string
+		wantCode int
+		want     string
+	}{
+		{
+			name:     "chat completion",
+			pth:      "/v1/chat/completions",
+			req:      `{"model":"llama3.2","messages":[]}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"llama3.2","message":{"role":"assistant","content":"hello"},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":2}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"choices":[{"finish_reason":"stop","index":0,"message":{"content":"hello","role":"assistant"}}],"model":"llama3.2","object":"chat.completion","usage":{"completion_tokens":2,"prompt_tokens":3,"total_tokens":5}}`,
+		},
+		{
+			name:     "completion cut short",
+			pth:      "/v1/completions",
+			req:      `{"model":"llama3.2","prompt":"once"}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"llama3.2","response":" upon","done":true,"done_reason":"length","prompt_eval_count":1,"eval_count":2}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"choices":[{"finish_reason":"length","index":0,"logprobs":null,"text":" upon"}],"model":"llama3.2","object":"text_completion","usage":{"completion_tokens":2,"prompt_tokens":1,"total_tokens":3}}`,
+		},
+		{
+			name:     "embeddings in base64",
+			pth:      "/v1/embeddings",
+			req:      `{"model":"nomic-embed-text","input":"hello","encoding_format":"base64"}`,
+			code:     fasthttp.StatusOK,
+			resp:     `{"model":"nomic-embed-text","embeddings":[[1,0.5]],"prompt_eval_count":1}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"data":[{"embedding":"AACAPwAAAD8=","index":0,"object":"embedding"}],"model":"nomic-embed-text","object":"list","usage":{"prompt_tokens":1,"total_tokens":1}}`,
+		},
+		{
+			name:     "models",
+			pth:      "/v1/models",
+			code:     fasthttp.StatusOK,
+			resp:     `{"models":[{"name":"llama3.2:latest","modified_at":"2024-01-01T00:00:00Z","size":1}]}`,
+			wantCode: fasthttp.StatusOK,
+			want:     `{"data":[{"created":1704067200,"id":"llama3.2:latest","object":"model","owned_by":"library"}],"object":"list"}`,
+		},
+		{
+			name:     "runner error",
+			pth:      "/v1/chat/completions",
+			req:      `{"model":"llama3.2","messages":[]}`,
+			code:     fasthttp.StatusNotFound,
+			resp:     `{"error":"model \"llama3.2\" not found"}`,
+			wantCode: fasthttp.StatusNotFound,
+			want:     `{"error":{"code":null,"message":"model \"llama3.2\" not found","param":null,"type":"invalid_request_error"}}`,
+		},
+		{
+			name:     "unreadable runner response",
+			pth:      "/v1/chat/completions",
+			req:      `{"model":"llama3.2","messages":[]}`,
+			code:     fasthttp.StatusOK,
+			resp:     `not json`,
+			wantCode: fasthttp.StatusBadGateway,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mthd := fasthttp.MethodPost
+			if tt.req == "" {
+				mthd = fasthttp.MethodGet
+			}
+
+			ex, _, _, err := translateRequest(t, &openAIProtocol{}, mthd, tt.pth, tt.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			code, b := ex.body(tt.code, []byte(tt.resp))
+			if code != tt.wantCode {
+				t.Errorf("status = %d, want %d", code, tt.wantCode)
+			}
+
+			if tt.want == "" {
+				return
+			}
+
+			assertJSON(t, b, tt.want, "created", "id")
+		})
+	}
+}
+
+func TestOpenAIExchangeStream(t *testing.T) {
+	tests := []struct {
+		name string
+		pth  string
+		req  string
+		lns  []string
+		err  error
+		want []string
+	}{
+		{
+			name: "chat completion with usage",
+			pth:  "/v1/chat/completions",
+			req:  `{"model":"llama3.2","messages":[],"stream":true,"stream_options":{"include_usage":true}}`,
+			lns: []string{
+				`{"model":"llama3.2","message":{"role":"assistant","content":"Hel"},"done":false}`,
+				`{"model":"llama3.2","message":{"role":"assistant","content":"lo"},"done":false}`,
+				`{"model":"llama3.2","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":3,"eval_count":2}`,
+			},
+			want: []string{
+				`{"choices":[{"delta":{"content":"Hel","role":"assistant"},"finish_reason":null,"index":0}],"model":"llama3.2","object":"chat.completion.chunk"}`,
+				`{"choices":[{"delta":{"content":"lo"},"finish_reason":null,"index":0}],"model":"llama3.2","object":"chat.completion.chunk"}`,
+				`{"choices":[{"delta":{},"finish_reason":"stop","index":0}],"model":"llama3.2","object":"chat.completion.chunk"}`,
+				`{"choices":[],"model":"llama3.2","object":"chat.completion.chunk","usage":{"completion_tokens":2,"prompt_tokens":3,"total_tokens":5}}`,
+				`[DONE]`,
+			},
+		},
+		{
+			name: "completion",
+			pth:  "/v1/completions",
+			req:  `{"model":"llama3.2","prompt":"once","stream":true}`,
+			lns: []string{
+				`{"model":"llama3.2","response":" upon","done":false}`,
+				`{"model":"llama3.2","response":"","done":true,"done_reason":"length"}`,
+			},
+			want: []string{
+				`{"choices":[{"finish_reason":null,"index":0,"logprobs":null,"text":" upon"}],"model":"llama3.2","object":"text_completion"}`,
+				`{"choices":[{"finish_reason":"length","index":0,"logprobs":null,"text":""}],"model":"llama3.2","object":"text_completion"}`,
+				`[DONE]`,
+			},
+		},
+		{
+			name: "runner error mid-stream",
+			pth:  "/v1/chat/completions",
+			req:  `{"model":"llama3.2","messages":[],"stream":true}`,
+			lns: []string{
+				`{"model":"llama3.2","message":{"role":"assistant","content":"Hel"},"done":false}`,
+				`{"error":"out of memory"}`,
+			},
+			want: []string{
+				`{"choices":[{"delta":{"content":"Hel","role":"assistant"},"finish_reason":null,"index":0}],"model":"llama3.2","object":"chat.completion.chunk"}`,
+				`{"error":{"code":null,"message":"out of memory","param":null,"type":"api_error"}}`,
+				`[DONE]`,
+			},
+		},
+		{
+			name: "stream ended prematurely",
+			pth:  "/v1/chat/completions",
+			req:  `{"model":"llama3.2","messages":[],"stream":true}`,
+			lns: []string{
+				`{"model":"llama3.2","message":{"role":"assistant","content":"Hel"},"done":false}`,
+			},
+			err: errors.New("unexpected EOF"),
+			want: []string{
+				`{"choices":[{"delta":{"content":"Hel","role":"assistant"},"finish_reason":null,"index":0}],"model":"llama3.2","object":"chat.completion.chunk"}`,
+				`{"error":{"code":null,"message":"unexpected EOF","param":null,"type":"api_error"}}`,
+				`[DONE]`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ex, _, _, err := translateRequest(t, &openAIProtocol{}, fasthttp.MethodPost, tt.pth, tt.req)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if ct := ex.contentType(); ct != sseContentType {
+				t.Errorf("content type = %q, want %q", ct, sseContentType)
+			}
+
+			got := streamEvents(ex, tt.lns, tt.err)
+			if len(got) != len(tt.want) {
+				t.Fatalf("events = %q, want %d events", got, len(tt.want))
+			}
+
+			// each chunk of the stream has the identifier of the completion
+			var id any
+			for i, evt := range got {
+				if tt.want[i] == "[DONE]" {
+					if evt != "[DONE]" {
+						t.Errorf("event %d = %q, want [DONE]", i, evt)
+					}
+					continue
+				}
+
+				var chk map[string]any
+				json.Unmarshal([]byte(evt), &chk)
+				if cid, ok := chk["id"]; ok {
+					if id == nil {
+						id = cid
+					}
+
+					if cid != id {
+						t.Errorf("event %d id = %v, want %v", i, cid, id)
+					}
+				}
+
+				assertJSON(t, []byte(evt), tt.want[i], "created", "id")
+			}
+		})
+	}
+}
+
+func TestOpenAIFailure(t *testing.T) {
+	tests := []struct {
+		code int
+		want string
+	}{
+		{code: fasthttp.StatusBadRequest, want: "invalid_request_error"},
+		{code: fasthttp.StatusUnauthorized, want: "authentication_error"},
+		{code: fasthttp.StatusForbidden, want: "permission_error"},
+		{code: fasthttp.StatusTooManyRequests, want: "rate_limit_error"},
+		{code: fasthttp.StatusBadGateway, want: "api_error"},
+	}
+
+	for _, tt := range tests {
+		b := openAIFailure(tt.code, "failed")
+		if !bytes.Contains(b, []byte(`"type":"`+tt.want+`"`)) {
+			t.Errorf("%d: failure = %s, want type %s", tt.code, b, tt.want)
+		}
+	}
+}
@@ -21,6 +21,8 @@ const (
 	v4SymPrefix  = "v4.local."
 )
 
+var errUnsupportedToken = errors.New("unsupported token type")
+
 type v4Service struct {
 	pubKey *paseto.V4AsymmetricPublicKey
 	prvKey *paseto.V4AsymmetricSecretKey
@@ -69,8 +71,10 @@ func NewV4Service(s *models.Settings) (*v4Service, error) {
 		return nil, errors.New("unable to read either a public key or a symmetric key for signing and verification")
 	}
 
-	// assign symmetric key
-	svc.symKey = &sk
+	// assign symmetric key (when it could be read)
+	if err == nil {
+		svc.symKey = &sk
+	}
 
 	// attempt to read the private key based on configuration
 	b, err := readFile(s.PASETO.KeyPath)
@@ -152,28 +156,48 @@ func (svc *v4Service) SignToken(tkn paseto.Token) (string, error) {
 	return sgn, nil
 }
 
-func (svc *v4Service) ValidateToken(tkn string) error {
+func (svc *v4Service) ValidateToken(tkn string) (*paseto.Token, error) {
 	prsr := paseto.NewParser()
 
 	// check for asymmetric public token
 	if strings.HasPrefix(tkn, v4AsymPrefix) {
-		if _, err := prsr.ParseV4Public(*svc.pubKey, tkn, nil); err != nil {
-			return fmt.Errorf("failed to parse v4.public token: %w", err)
+		if svc.pubKey == nil {
+			return nil, errors.New("asymmetric public key is not set")
 		}
 
-		return nil
+		parsed, err := prsr.ParseV4Public(*svc.pubKey, tkn, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse v4.public token: %w", err)
+		}
+
+		return parsed, nil
 	}
 
 	// check for symmetric local token
 	if strings.HasPrefix(tkn, v4SymPrefix) {
-		if _, err := prsr.ParseV4Local(*svc.symKey, tkn, nil); err != nil {
-			return fmt.Errorf("failed to parse v4.local token: %w", err)
+		if svc.symKey == nil {
+			return nil, errors.New("symmetric key is not set")
 		}
 
-		return nil
+		parsed, err := prsr.ParseV4Local(*svc.symKey, tkn, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse v4.local token: %w", err)
+		}
+
+		return parsed, nil
+	}
+
+	return nil, errUnsupportedToken
+}
+
+// VerifyKeys ensures a public key or symmetric key was read, so that tokens
+// can be validated
+func (svc *v4Service) VerifyKeys() error {
+	if svc.pubKey == nil && svc.symKey == nil {
+		return errors.New("neither a public key nor a symmetric key is set")
 	}
 
-	return errors.New("unsupported token type")
+	return nil
 }
 
 type v2Service struct {
@@ -224,8 +248,10 @@ func NewV2Service(s *models.Settings) (*v2Service, error) {
 		return nil, errors.New("unable to read either a public key or a symmetric key for signing and verification")
 	}
 
-	// assign symmetric key
-	svc.symKey = &sk
+	// assign symmetric key (when it could be read)
+	if err == nil {
+		svc.symKey = &sk
+	}
 
 	// attempt to read the private key based on configuration
 	b, err := readFile(s.PASETO.KeyPath)
@@ -265,8 +291,8 @@ func NewV2Service(s *models.Settings) (*v2Service, error) {
 }
 
 func (svc *v2Service) EncryptToken(tkn paseto.Token) (string, error) {
-	if svc.prvKey == nil {
-		return "", fmt.Errorf("symmetric private key is not set")
+	if svc.symKey == nil {
+		return "", errors.New("symmetric key is not set")
 	}
 
 	return tkn.V2Encrypt(*svc.symKey), nil
@@ -307,26 +333,46 @@ func (svc *v2Service) SignToken(tkn paseto.Token) (string, error) {
 	return sgn, nil
 }
 
-func (svc *v2Service) ValidateToken(tkn string) error {
+func (svc *v2Service) ValidateToken(tkn string) (*paseto.Token, error) {
 	prsr := paseto.NewParser()
 
 	// check for asymmetric public token
 	if strings.HasPrefix(tkn, v2AsymPrefix) {
-		if _, err := prsr.ParseV2Public(*svc.pubKey, tkn); err != nil {
-			return fmt.Errorf("failed to parse v2.public token: %w", err)
+		if svc.pubKey == nil {
+			return nil, errors.New("asymmetric public key is not set")
 		}
 
-		return nil
+		parsed, err := prsr.ParseV2Public(*svc.pubKey, tkn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse v2.public token: %w", err)
+		}
+
+		return parsed, nil
 	}
 
 	// check for symmetric local token
 	if strings.HasPrefix(tkn, v2SymPrefix) {
-		if _, err := prsr.ParseV2Local(*svc.symKey, tkn); err != nil {
-			return fmt.Errorf("failed to parse v2.local token: %w", err)
+		if svc.symKey == nil {
+			return nil, errors.New("symmetric key is not set")
 		}
 
-		return nil
+		parsed, err := prsr.ParseV2Local(*svc.symKey, tkn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse v2.local token: %w", err)
+		}
+
+		return parsed, nil
+	}
+
+	return nil, errUnsupportedToken
+}
+
+// VerifyKeys ensures a public key or symmetric key was read, so that tokens
+// can be validated
+func (svc *v2Service) VerifyKeys() error {
+	if svc.pubKey == nil && svc.symKey == nil {
+		return errors.New("neither a public key nor a symmetric key is set")
 	}
 
-	return errors.New("unsupported token type")
+	return nil
 }
@@ -0,0 +1,191 @@
+package services
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// relayedKey marks a response relayed from the runner (or already reported in
+// the form of the front-end API), which is not translated again
+const relayedKey = "relayed"
+
+// protocol translates requests made with a front-end API (i.e. OpenAI) into
+// runner API requests, so that clients need not speak the runner API
+type protocol interface {
+	// failure returns a response body reporting an error in the form the
+	// front-end API uses
+	failure(code int, msg string) []byte
+
+	// translate rewrites the request for the runner and returns the runner
+	// path along with the exchange used to translate the response... a nil
+	// exchange means the endpoint is forwarded without translation
+	translate(pth string, req *fasthttp.Request) (exchange, string, error)
+}
+
+// exchange translates the runner response to a single translated request
+type exchange interface {
+	// body translates a runner response that was read in full
+	body(code int, b []byte) (int, []byte)
+
+	// chunk translates a single line of a streamed runner response
+	chunk(ln []byte) []byte
+
+	// contentType is the content type of a translated streamed response
+	contentType() string
+
+	// end returns the data that terminates a translated streamed response,
+	// reporting err when the stream ended prematurely
+	end(err error) []byte
+}
+
+// protocolError is a request that could not be translated, and is reported
+// to the client with the status code
+type protocolError struct {
+	code int
+	msg  string
+}
+
+func (e *protocolError) Error() string {
+	return e.msg
+}
+
+// chainProtocol translates front-end API requests into the Ollama API, and
+// then into the API of the runner type
+type chainProtocol struct {
+	adpt protocol
+	frnt protocol
+}
+
+// chainExchange translates the runner response into an Ollama response, and
+// then into a front-end API response
+type chainExchange struct {
+	adpt exchange
+	frnt exchange
+}
+
+// newProtocol returns the translator for the runner front-end protocol and
+// type, or nil when requests are forwarded as is
+func newProtocol(rnr models.Runner) protocol {
+	var frnt protocol
+	switch rnr.Protocol {
+	case models.ProtocolAnthropic:
+		frnt = &anthropicProtocol{}
+	case models.ProtocolOpenAI:
+		// runners serving the OpenAI API only need the Ollama API adapted
+		if rnr.Type != "" && rnr.Type != models.RunnerTypeOllama {
+			return newAdapter(rnr)
+		}
+
+		frnt = &openAIProtocol{}
+	}
+
+	adpt := newAdapter(rnr)
+	switch {
+	case adpt == nil:
+		return frnt
+	case frnt == nil:
+		return adpt
+	default:
+		return &chainProtocol{adpt: adpt, frnt: frnt}
+	}
+}
+
+// TranslateFailures reports the errors of the gateway itself (i.e. a missing
+// token or an exceeded rate limit) in the form of the runner front-end API,
+// for requests to the front-end endpoints... runner responses are translated
+// as they are relayed, so they are left as they are
+func (svc *gatewayService) TranslateFailures(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	var fail func(int, string) []byte
+	switch rnr.Protocol {
+	case models.ProtocolAnthropic:
+		fail = anthropicFailure
+	case models.ProtocolOpenAI:
+		fail = openAIFailure
+	default:
+		return next
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		next(ctx)
+
+		code := ctx.Response.StatusCode()
+		if code < fasthttp.StatusBadRequest || ctx.Response.IsBodyStream() || ctx.UserValue(relayedKey) != nil {
+			return
+		}
+
+		if _, ok := models.TranslatedPath(rnr.Protocol, rnr.RelativePath(string(ctx.URI().Path()))); !ok {
+			return
+		}
+
+		ctx.SetContentType("application/json")
+		ctx.SetBody(fail(code, strings.TrimSpace(ollamaError(ctx.Response.Body()))))
+	}
+}
+
+// relayed marks the response as relayed from the runner
+func relayed(ctx *fasthttp.RequestCtx) {
+	ctx.SetUserValue(relayedKey, true)
+}
+
+func (p *chainProtocol) failure(code int, msg string) []byte {
+	return p.frnt.failure(code, msg)
+}
+
+func (p *chainProtocol) translate(pth string, req *fasthttp.Request) (exchange, string, error) {
+	frnt, fpth, err := p.frnt.translate(pth, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if frnt != nil {
+		pth = fpth
+	}
+
+	adpt, apth, err := p.adpt.translate(pth, req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch {
+	case adpt == nil:
+		return frnt, pth, nil
+	case frnt == nil:
+		return adpt, apth, nil
+	default:
+		return &chainExchange{adpt: adpt, frnt: frnt}, apth, nil
+	}
+}
+
+func (ex *chainExchange) body(code int, b []byte) (int, []byte) {
+	return ex.frnt.body(ex.adpt.body(code, b))
+}
+
+func (ex *chainExchange) chunk(ln []byte) []byte {
+	return ex.relay(ex.adpt.chunk(ln))
+}
+
+func (ex *chainExchange) contentType() string {
+	return ex.frnt.contentType()
+}
+
+func (ex *chainExchange) end(err error) []byte {
+	// the error is reported once, by the front-end exchange
+	if err != nil {
+		return ex.frnt.end(err)
+	}
+
+	return append(ex.relay(ex.adpt.end(nil)), ex.frnt.end(nil)...)
+}
+
+// relay translates each of the Ollama NDJSON lines for the front-end
+func (ex *chainExchange) relay(b []byte) []byte {
+	var out []byte
+	for ln := range bytes.Lines(b) {
+		out = append(out, ex.frnt.chunk(ln)...)
+	}
+
+	return out
+}
@@ -0,0 +1,382 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const (
+	defaultMaxQueue     = 64
+	defaultQueueTimeout = 30 * time.Second
+)
+
+var (
+	errClientGone   = errors.New("client disconnected while queued")
+	errNoHosts      = errors.New("no healthy hosts available for runner")
+	errPreempted    = errors.New("request preempted by higher priority requests")
+	errQueueFull    = errors.New("runner queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a runner host")
+)
+
+// fairQueue holds the requests of a priority class waiting for a runner
+// host... requests are admitted round-robin across subjects (and in order for
+// each subject), so that one subject sending many requests cannot hold up the
+// others
+type fairQueue struct {
+	sbjs []string
+	wtrs map[string][]*waiter
+}
+
+// lease is a request holding one of the runner hosts... batch requests may be
+// preempted once their upstream call is underway
+type lease struct {
+	call      *upstreamCall
+	preempted bool
+	rank      int
+	up        *upstream
+}
+
+// priorityQueue holds the requests waiting for a runner host, admitting those
+// of higher priority classes first
+type priorityQueue struct {
+	clss []fairQueue
+	n    int
+}
+
+// queueStats counts the requests that have waited in (or were turned away
+// from) the queue of a runner
+type queueStats struct {
+	preempted atomic.Uint64
+	rejected  atomic.Uint64
+	timedOut  atomic.Uint64
+	wait      atomic.Int64
+	waited    atomic.Uint64
+}
+
+// waiter is a request waiting for a runner host, which is sent its lease once
+// it is admitted
+type waiter struct {
+	ls   chan *lease
+	rank int
+	sbj  string
+}
+
+func newPriorityQueue() priorityQueue {
+	q := priorityQueue{clss: make([]fairQueue, models.Priorities())}
+	for i := range q.clss {
+		q.clss[i].wtrs = map[string][]*waiter{}
+	}
+
+	return q
+}
+
+// acquire selects a runner host for the request and holds a request count on
+// it until released... when the runner limits requests in flight and each of
+// its healthy hosts is at the limit, the request waits in the queue until a
+// host is available, the queue timeout passes or the client goes away
+func (pl *runnerPool) acquire(sbj string, rank int, conn net.Conn) (*lease, time.Duration, error) {
+	cnc := pl.rnr.Concurrency
+	if cnc.MaxInFlight <= 0 {
+		up := pl.pick()
+		if up == nil {
+			return nil, 0, errNoHosts
+		}
+
+		up.begin()
+		return &lease{rank: rank, up: up}, 0, nil
+	}
+
+	pl.qmu.Lock()
+	if !pl.healthy() {
+		pl.qmu.Unlock()
+		return nil, 0, errNoHosts
+	}
+
+	// requests only bypass the queue when nothing is waiting
+	if pl.q.n == 0 {
+		if up := pl.pick(); up != nil {
+			ls := pl.hold(up, rank)
+			pl.qmu.Unlock()
+			return ls, 0, nil
+		}
+	}
+
+	if pl.q.n >= pl.queueLimit() {
+		pl.qmu.Unlock()
+		pl.qs.rejected.Add(1)
+		return nil, 0, errQueueFull
+	}
+
+	w := &waiter{ls: make(chan *lease, 1), rank: rank, sbj: sbj}
+	pl.q.push(w)
+	pl.qmu.Unlock()
+
+	var gone <-chan struct{}
+	if cc, ok := watchConn(conn); ok {
+		var stop func()
+		gone, stop = cc.watch()
+		defer stop()
+	}
+
+	tmt := cnc.QueueTimeout
+	if tmt <= 0 {
+		tmt = defaultQueueTimeout
+	}
+
+	tmr := time.NewTimer(tmt)
+	defer tmr.Stop()
+
+	// interactive requests waiting beyond the preempt threshold preempt a
+	// batch request, and continue to do so while they wait
+	var prmpt <-chan time.Time
+	if cnc.PreemptAfter > 0 && rank == 0 {
+		tckr := time.NewTicker(cnc.PreemptAfter)
+		defer tckr.Stop()
+		prmpt = tckr.C
+	}
+
+	start := time.Now()
+	var err error
+	for err == nil {
+		select {
+		case ls := <-w.ls:
+			return ls, pl.waited(start), nil
+		case <-prmpt:
+			pl.preempt()
+		case <-tmr.C:
+			err = errQueueTimeout
+		case <-gone:
+			err = errClientGone
+		}
+	}
+
+	pl.qmu.Lock()
+	rmvd := pl.q.remove(w)
+	pl.qmu.Unlock()
+
+	// the request was admitted as it timed out (or the client went away)
+	if !rmvd {
+		ls := <-w.ls
+		if err == errClientGone {
+			pl.release(ls)
+			return nil, pl.waited(start), err
+		}
+
+		return ls, pl.waited(start), nil
+	}
+
+	if err == errQueueTimeout {
+		pl.qs.timedOut.Add(1)
+	}
+
+	return nil, time.Since(start), err
+}
+
+// admit sends each waiting request a lease, for as long as a host is
+// available (which must be called holding the queue lock)... requests are
+// admitted as others are released and as hosts return to rotation
+func (pl *runnerPool) admit() {
+	for pl.q.n > 0 {
+		up := pl.pick()
+		if up == nil {
+			return
+		}
+
+		w := pl.q.pop()
+		w.ls <- pl.hold(up, w.rank)
+	}
+}
+
+// healthy reports whether any of the runner hosts (that are not drained) are
+// healthy
+func (pl *runnerPool) healthy() bool {
+	for _, u := range pl.ups {
+		if u.weight > 0 && u.hlth.isHealthy() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hold begins a request to the upstream, tracking batch requests so that they
+// may be preempted (which must be called holding the queue lock)
+func (pl *runnerPool) hold(up *upstream, rank int) *lease {
+	up.begin()
+
+	ls := &lease{rank: rank, up: up}
+	if rank == models.Priorities()-1 {
+		pl.btch = append(pl.btch, ls)
+	}
+
+	return ls
+}
+
+// preempt cancels the batch request admitted most recently (losing the least
+// work), once its upstream call is underway
+func (pl *runnerPool) preempt() {
+	pl.qmu.Lock()
+	defer pl.qmu.Unlock()
+
+	for i := len(pl.btch) - 1; i >= 0; i-- {
+		if ls := pl.btch[i]; ls.call != nil && !ls.preempted {
+			ls.preempted = true
+			ls.call.abort(errPreempted)
+			pl.qs.preempted.Add(1)
+			return
+		}
+	}
+}
+
+// queue returns the depth of the runner queue and the requests that have
+// waited in it
+func (pl *runnerPool) queue() *models.RunnerQueue {
+	pl.qmu.Lock()
+	dpth := pl.q.n
+	pl.qmu.Unlock()
+
+	return &models.RunnerQueue{
+		Depth:       dpth,
+		Limit:       pl.queueLimit(),
+		Preempted:   pl.qs.preempted.Load(),
+		Rejected:    pl.qs.rejected.Load(),
+		TimedOut:    pl.qs.timedOut.Load(),
+		Waited:      pl.qs.waited.Load(),
+		WaitSeconds: time.Duration(pl.qs.wait.Load()).Seconds(),
+	}
+}
+
+// queueLimit returns the most requests that may wait in the runner queue, so
+// that a runner limiting requests in flight queues requests without also
+// setting the queue limit
+func (pl *runnerPool) queueLimit() int {
+	if lim := pl.rnr.Concurrency.MaxQueue; lim > 0 {
+		return lim
+	}
+
+	return defaultMaxQueue
+}
+
+// release ends the request to the upstream, admitting the next request
+// waiting in the queue
+func (pl *runnerPool) release(ls *lease) {
+	if pl.rnr.Concurrency.MaxInFlight <= 0 {
+		ls.up.end()
+		return
+	}
+
+	pl.qmu.Lock()
+	defer pl.qmu.Unlock()
+
+	pl.btch = slices.DeleteFunc(pl.btch, func(b *lease) bool {
+		return b == ls
+	})
+	ls.up.end()
+	pl.admit()
+}
+
+// resume admits the requests waiting in the queue once a host returns to
+// rotation, rather than leaving them to wait for a request to be released
+func (pl *runnerPool) resume() {
+	if pl.rnr.Concurrency.MaxInFlight <= 0 {
+		return
+	}
+
+	pl.qmu.Lock()
+	defer pl.qmu.Unlock()
+
+	pl.admit()
+}
+
+// track links the upstream call to the lease, so that it can be preempted
+func (pl *runnerPool) track(ls *lease, call *upstreamCall) {
+	pl.qmu.Lock()
+	ls.call = call
+	pl.qmu.Unlock()
+}
+
+// waited counts a request admitted from the queue, returning its wait
+func (pl *runnerPool) waited(start time.Time) time.Duration {
+	wait := time.Since(start)
+	pl.qs.waited.Add(1)
+	pl.qs.wait.Add(int64(wait))
+
+	return wait
+}
+
+// pop removes the next request to admit, which is the first request of the
+// subject whose turn it is
+func (q *fairQueue) pop() *waiter {
+	sbj := q.sbjs[0]
+	q.sbjs = q.sbjs[1:]
+
+	w := q.wtrs[sbj][0]
+	if rest := q.wtrs[sbj][1:]; len(rest) > 0 {
+		q.wtrs[sbj] = rest
+		q.sbjs = append(q.sbjs, sbj)
+	} else {
+		delete(q.wtrs, sbj)
+	}
+
+	return w
+}
+
+// push adds a request to the end of the requests of its subject, where
+// subjects without requests waiting take the last turn
+func (q *fairQueue) push(w *waiter) {
+	if len(q.wtrs[w.sbj]) == 0 {
+		q.sbjs = append(q.sbjs, w.sbj)
+	}
+
+	q.wtrs[w.sbj] = append(q.wtrs[w.sbj], w)
+}
+
+// remove takes a request out of the queue, reporting whether it was waiting
+func (q *fairQueue) remove(w *waiter) bool {
+	i := slices.Index(q.wtrs[w.sbj], w)
+	if i < 0 {
+		return false
+	}
+
+	q.wtrs[w.sbj] = slices.Delete(q.wtrs[w.sbj], i, i+1)
+	if len(q.wtrs[w.sbj]) == 0 {
+		delete(q.wtrs, w.sbj)
+		q.sbjs = slices.DeleteFunc(q.sbjs, func(sbj string) bool {
+			return sbj == w.sbj
+		})
+	}
+
+	return true
+}
+
+// pop removes the next request to admit from the highest priority class with
+// requests waiting
+func (q *priorityQueue) pop() *waiter {
+	for i := range q.clss {
+		if len(q.clss[i].sbjs) > 0 {
+			q.n--
+			return q.clss[i].pop()
+		}
+	}
+
+	return nil
+}
+
+func (q *priorityQueue) push(w *waiter) {
+	q.clss[w.rank].push(w)
+	q.n++
+}
+
+func (q *priorityQueue) remove(w *waiter) bool {
+	if !q.clss[w.rank].remove(w) {
+		return false
+	}
+
+	q.n--
+	return true
+}
@@ -0,0 +1,445 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// newTestPool returns a pool for a runner served by the number of hosts
+// given, each limited as configured
+func newTestPool(hsts int, cnc models.Concurrency) *runnerPool {
+	rnr := models.Runner{Concurrency: cnc, Name: "test"}
+	for i := range hsts {
+		rnr.Hosts = append(rnr.Hosts, models.Upstream{Host: fmt.Sprintf("gpu-%d:11434", i)})
+	}
+
+	return newRunnerPool(rnr, nil)
+}
+
+// waiters parses a list of "subject/id" waiters (i.e. "a/1")
+func waiters(ids ...string) []*waiter {
+	wtrs := make([]*waiter, 0, len(ids))
+	for _, id := range ids {
+		sbj, _, _ := strings.Cut(id, "/")
+		wtrs = append(wtrs, &waiter{ls: make(chan *lease, 1), sbj: sbj})
+	}
+
+	return wtrs
+}
+
+// waitQueued waits until the pool has the number of requests queued
+func waitQueued(t *testing.T, pl *runnerPool, n int) {
+	t.Helper()
+
+	for range 500 {
+		pl.qmu.Lock()
+		dpth := pl.q.n
+		pl.qmu.Unlock()
+
+		if dpth == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("queue did not reach %d requests", n)
+}
+
+func TestFairQueuePop(t *testing.T) {
+	tests := []struct {
+		name string
+		push []string
+		want []string
+	}{
+		{
+			name: "single subject in order",
+			push: []string{"a/1", "a/2", "a/3"},
+			want: []string{"a/1", "a/2", "a/3"},
+		},
+		{
+			name: "subjects take turns",
+			push: []string{"a/1", "a/2", "a/3", "b/1", "c/1"},
+			want: []string{"a/1", "b/1", "c/1", "a/2", "a/3"},
+		},
+		{
+			name: "subjects interleaved",
+			push: []string{"a/1", "b/1", "a/2", "b/2"},
+			want: []string{"a/1", "b/1", "a/2", "b/2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := fairQueue{wtrs: map[string][]*waiter{}}
+			wtrs := waiters(tt.push...)
+			for _, w := range wtrs {
+				q.push(w)
+			}
+
+			got := []string{}
+			for len(q.sbjs) > 0 {
+				got = append(got, tt.push[slices.Index(wtrs, q.pop())])
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("popped %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFairQueueRemove(t *testing.T) {
+	q := fairQueue{wtrs: map[string][]*waiter{}}
+	wtrs := waiters("a/1", "b/1", "a/2")
+	for _, w := range wtrs {
+		q.push(w)
+	}
+
+	// the last request of a subject gives up its turn
+	if !q.remove(wtrs[1]) {
+		t.Fatal("waiting request not removed")
+	}
+
+	if q.remove(wtrs[1]) {
+		t.Error("request removed twice")
+	}
+
+	if got := q.pop(); got != wtrs[0] {
+		t.Errorf("first pop is not a/1")
+	}
+
+	if got := q.pop(); got != wtrs[2] {
+		t.Errorf("second pop is not a/2")
+	}
+
+	if len(q.sbjs) != 0 || len(q.wtrs) != 0 {
+		t.Errorf("queue not empty: %v", q.sbjs)
+	}
+}
+
+func TestPriorityQueuePop(t *testing.T) {
+	tests := []struct {
+		name  string
+		ranks []int
+		want  []int
+	}{
+		{name: "higher classes first", ranks: []int{2, 1, 0}, want: []int{2, 1, 0}},
+		{name: "in order within a class", ranks: []int{1, 1, 0}, want: []int{2, 0, 1}},
+		{name: "batch admitted last", ranks: []int{2, 0, 2, 1}, want: []int{1, 3, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newPriorityQueue()
+			wtrs := make([]*waiter, len(tt.ranks))
+			for i, rank := range tt.ranks {
+				wtrs[i] = &waiter{rank: rank, sbj: "a"}
+				q.push(wtrs[i])
+			}
+
+			got := []int{}
+			for q.n > 0 {
+				got = append(got, slices.Index(wtrs, q.pop()))
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("popped %v, want %v", got, tt.want)
+			}
+
+			if w := q.pop(); w != nil {
+				t.Error("pop of an empty queue returned a request")
+			}
+		})
+	}
+}
+
+func TestRunnerPoolAcquire(t *testing.T) {
+	tests := []struct {
+		name    string
+		cnc     models.Concurrency
+		hsts    int
+		held    int
+		wantErr error
+	}{
+		{name: "unlimited", hsts: 1, held: 5},
+		{name: "below the limit", cnc: models.Concurrency{MaxInFlight: 2}, hsts: 1, held: 1},
+		{name: "below the limit of each host", cnc: models.Concurrency{MaxInFlight: 1}, hsts: 2, held: 1},
+		{name: "queue timeout", cnc: models.Concurrency{MaxInFlight: 1, QueueTimeout: 20 * time.Millisecond}, hsts: 1, held: 1, wantErr: errQueueTimeout},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newTestPool(tt.hsts, tt.cnc)
+			for range tt.held {
+				if _, _, err := pl.acquire("a", 1, nil); err != nil {
+					t.Fatalf("unexpected error holding a host: %v", err)
+				}
+			}
+
+			ls, _, err := pl.acquire("b", 1, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("error = %v, want %v", err, tt.wantErr)
+			}
+
+			if err == nil && ls.up == nil {
+				t.Error("lease without a host")
+			}
+		})
+	}
+}
+
+func TestRunnerPoolAcquireQueueFull(t *testing.T) {
+	pl := newTestPool(1, models.Concurrency{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: time.Second})
+	ls, _, err := pl.acquire("a", 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		qls, _, err := pl.acquire("b", 1, nil)
+		if err == nil {
+			pl.release(qls)
+		}
+		errc <- err
+	}()
+	waitQueued(t, pl, 1)
+
+	if _, _, err := pl.acquire("c", 1, nil); !errors.Is(err, errQueueFull) {
+		t.Errorf("error = %v, want %v", err, errQueueFull)
+	}
+
+	if got := pl.queue().Rejected; got != 1 {
+		t.Errorf("rejected = %d, want 1", got)
+	}
+
+	pl.release(ls)
+	if err := <-errc; err != nil {
+		t.Errorf("queued request: unexpected error: %v", err)
+	}
+}
+
+func TestRunnerPoolAdmit(t *testing.T) {
+	tests := []struct {
+		name  string
+		queue []string
+		want  []string
+	}{
+		{
+			name:  "priority order",
+			queue: []string{"batch/a", "default/a", "interactive/a"},
+			want:  []string{"interactive/a", "default/a", "batch/a"},
+		},
+		{
+			name:  "round-robin across subjects",
+			queue: []string{"default/a", "default/a", "default/b"},
+			want:  []string{"default/a", "default/b", "default/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newTestPool(1, models.Concurrency{MaxInFlight: 1, QueueTimeout: 5 * time.Second})
+			ls, _, err := pl.acquire("holder", 1, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// requests are queued one at a time, so that their order is known
+			admitted := make(chan string, len(tt.queue))
+			leases := make(chan *lease, len(tt.queue))
+			for i, id := range tt.queue {
+				cls, sbj, _ := strings.Cut(id, "/")
+				rank, _ := models.PriorityRank(cls)
+				go func() {
+					qls, _, err := pl.acquire(sbj, rank, nil)
+					if err != nil {
+						t.Errorf("%s: unexpected error: %v", id, err)
+						return
+					}
+					admitted <- id
+					leases <- qls
+				}()
+				waitQueued(t, pl, i+1)
+			}
+
+			// releasing each lease admits the next request waiting
+			got := []string{}
+			pl.release(ls)
+			for range tt.queue {
+				got = append(got, <-admitted)
+				pl.release(<-leases)
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("admitted %v, want %v", got, tt.want)
+			}
+
+			if q := pl.queue(); q.Depth != 0 || q.Waited != uint64(len(tt.queue)) {
+				t.Errorf("queue = %+v, want empty with %d waited", q, len(tt.queue))
+			}
+		})
+	}
+}
+
+func TestRunnerPoolResume(t *testing.T) {
+	pl := newTestPool(1, models.Concurrency{MaxInFlight: 1, QueueTimeout: 5 * time.Second})
+	ls, _, err := pl.acquire("a", 1, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	lsc := make(chan *lease, 1)
+	go func() {
+		qls, _, err := pl.acquire("b", 1, nil)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		lsc <- qls
+	}()
+	waitQueued(t, pl, 1)
+
+	// the host leaves rotation and its request ends, which leaves the queued
+	// request waiting until the host returns
+	pl.ups[0].hlth.mu.Lock()
+	pl.ups[0].hlth.healthy = false
+	pl.ups[0].hlth.mu.Unlock()
+	pl.release(ls)
+
+	select {
+	case <-lsc:
+		t.Fatal("request admitted to an unhealthy host")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	pl.ups[0].hlth.restore()
+	pl.resume()
+
+	select {
+	case qls := <-lsc:
+		if qls == nil || qls.up != pl.ups[0] {
+			t.Error("request not admitted to the restored host")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not admitted once the host returned to rotation")
+	}
+}
+
+func TestRunnerPoolPreempt(t *testing.T) {
+	tests := []struct {
+		name string
+		// calls lists the batch leases admitted, in order: "call" for an
+		// upstream call underway, "none" for a call not yet underway and
+		// "preempted" for a lease already preempted
+		calls []string
+		want  int
+	}{
+		{name: "most recent lease", calls: []string{"call", "call"}, want: 1},
+		{name: "call not yet underway", calls: []string{"call", "none"}, want: 0},
+		{name: "already preempted", calls: []string{"call", "preempted"}, want: 0},
+		{name: "nothing underway", calls: []string{"none", "preempted"}, want: -1},
+		{name: "no batch leases", want: -1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pl := newTestPool(1, models.Concurrency{MaxInFlight: 10})
+			rank, _ := models.PriorityRank(models.PriorityBatch)
+
+			lss := []*lease{}
+			for _, c := range tt.calls {
+				pl.qmu.Lock()
+				ls := pl.hold(pl.ups[0], rank)
+				pl.qmu.Unlock()
+
+				switch c {
+				case "call":
+					pl.track(ls, &upstreamCall{})
+				case "preempted":
+					pl.track(ls, &upstreamCall{})
+					ls.preempted = true
+				}
+				lss = append(lss, ls)
+			}
+
+			pl.preempt()
+
+			for i, ls := range lss {
+				aborted := ls.call != nil && errors.Is(ls.call.err(), errPreempted)
+				if aborted != (i == tt.want) {
+					t.Errorf("lease %d: aborted = %t, want %t", i, aborted, i == tt.want)
+				}
+			}
+
+			wantCount := uint64(0)
+			if tt.want >= 0 {
+				wantCount = 1
+			}
+
+			if got := pl.queue().Preempted; got != wantCount {
+				t.Errorf("preempted = %d, want %d", got, wantCount)
+			}
+		})
+	}
+}
+
+func TestRunnerPoolPreemptWhileQueued(t *testing.T) {
+	pl := newTestPool(1, models.Concurrency{
+		MaxInFlight:  1,
+		PreemptAfter: 10 * time.Millisecond,
+		QueueTimeout: 5 * time.Second,
+	})
+
+	// a batch request holds the host, with its upstream call underway
+	btch, _ := models.PriorityRank(models.PriorityBatch)
+	ls, _, err := pl.acquire("batch", btch, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	call := &upstreamCall{}
+	pl.track(ls, call)
+
+	// an interactive request waiting beyond the threshold preempts it, and is
+	// admitted once the preempted request is released
+	lsc := make(chan *lease, 1)
+	go func() {
+		qls, _, err := pl.acquire("interactive", 0, nil)
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+		lsc <- qls
+	}()
+
+	for range 500 {
+		if call.isCanceled() {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if !errors.Is(call.err(), errPreempted) {
+		t.Fatalf("batch call error = %v, want %v", call.err(), errPreempted)
+	}
+
+	pl.release(ls)
+
+	select {
+	case qls := <-lsc:
+		if qls.rank != 0 {
+			t.Errorf("admitted rank = %d, want 0", qls.rank)
+		}
+		pl.release(qls)
+	case <-time.After(5 * time.Second):
+		t.Fatal("interactive request not admitted")
+	}
+
+	if len(pl.btch) != 0 {
+		t.Errorf("%d batch leases still tracked", len(pl.btch))
+	}
+}
@@ -0,0 +1,308 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	bolt "go.etcd.io/bbolt"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const defaultQuotaPath = "quotas.db"
+
+var quotaBucket = []byte("quotas")
+
+// quotaService counts the usage of each account toward the configured quotas
+// and rejects requests once a quota is spent... counters are kept in an
+// embedded database so they persist across restarts
+type quotaService struct {
+	db  *bolt.DB
+	log zerolog.Logger
+	s   *models.Settings
+}
+
+// quotaCounter is the usage counted toward a quota within a single window
+type quotaCounter struct {
+	start time.Time
+	used  float64
+}
+
+// NewQuotaService opens the quota counter database, when quotas are configured
+func NewQuotaService(s *models.Settings) (*quotaService, error) {
+	svc := &quotaService{
+		log: log.With().Str("service", "quota").Logger(),
+		s:   s,
+	}
+
+	if len(s.Quotas.Limits) == 0 {
+		return svc, nil
+	}
+
+	nms := map[string]bool{}
+	for _, q := range s.Quotas.Limits {
+		if err := q.Validate(); err != nil {
+			return nil, err
+		}
+
+		if nms[q.Name] {
+			return nil, fmt.Errorf("duplicate quota name: %s", q.Name)
+		}
+		nms[q.Name] = true
+	}
+
+	pth := s.Quotas.Path
+	if pth == "" {
+		pth = defaultQuotaPath
+	}
+
+	db, err := bolt.Open(pth, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open quota database %s: %w", pth, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(quotaBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to prepare quota database %s: %w", pth, err)
+	}
+
+	svc.db = db
+	svc.log.Info().
+		Int("quotas", len(s.Quotas.Limits)).
+		Str("path", pth).
+		Msg("Opened quota database")
+
+	return svc, nil
+}
+
+// Count adds the usage reported for a request to each of the quotas that
+// apply to the account and runner... requests quotas are counted as requests
+// are admitted instead, as not every request reports its usage
+func (svc *quotaService) Count(u models.Usage) {
+	if svc.db == nil {
+		return
+	}
+
+	svc.add(u.Runner, u.Account, u.Time, func(q models.Quota) float64 {
+		if q.Metric == models.MetricRequests {
+			return 0
+		}
+
+		return q.Amount(u)
+	})
+}
+
+// EnforceQuotas rejects requests with 429 Too Many Requests once the account
+// has spent any of the quotas that apply to it on the runner, reporting the
+// usage and limits of each of them
+func (svc *quotaService) EnforceQuotas(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if svc.db == nil {
+		return next
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		acct := svc.account(models.ContextClaims(ctx))
+		models.SetContextAccount(ctx, acct)
+
+		now := time.Now()
+		usgs := svc.usage(now, func(q models.Quota) bool {
+			return q.Applies(rnr.Name, acct)
+		}, acct)
+
+		var rst time.Time
+		for _, usg := range usgs {
+			if usg.Exceeded && usg.ResetsAt.After(rst) {
+				rst = usg.ResetsAt
+			}
+		}
+
+		// requests count toward quotas once admitted, whether or not they
+		// succeed (or the runner reports their usage)
+		if rst.IsZero() {
+			svc.add(rnr.Name, acct, now, func(q models.Quota) float64 {
+				if q.Metric == models.MetricRequests {
+					return 1
+				}
+
+				return 0
+			})
+
+			next(ctx)
+			return
+		}
+
+		models.RequestLogger(ctx, svc.log).Warn().
+			Str("account", acct).
+			Str("path", string(ctx.Path())).
+			Str("runner", rnr.Name).
+			Msg("Quota exceeded, rejected request")
+
+		b, _ := json.Marshal(map[string]any{
+			"error":  "quota exceeded",
+			"quotas": usgs,
+		})
+
+		ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(rst.Sub(now).Seconds()))))
+		ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+		ctx.SetContentType("application/json")
+		ctx.SetBody(b)
+	}
+}
+
+// Quotas returns the usage of the account toward each quota that applies to
+// it (on any runner), or of every account counted when empty
+func (svc *quotaService) Quotas(acct string) []models.QuotaUsage {
+	if svc.db == nil {
+		return []models.QuotaUsage{}
+	}
+
+	now := time.Now()
+	if acct != "" {
+		return svc.usage(now, func(q models.Quota) bool {
+			return len(q.Accounts) == 0 || slices.Contains(q.Accounts, acct)
+		}, acct)
+	}
+
+	usgs := []models.QuotaUsage{}
+	if err := svc.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(quotaBucket).ForEach(func(k []byte, v []byte) error {
+			nm, acct, ok := bytes.Cut(k, []byte{0})
+			if !ok {
+				return nil
+			}
+
+			for _, q := range svc.s.Quotas.Limits {
+				if q.Name == string(nm) {
+					usgs = append(usgs, svc.quotaUsage(q, string(acct), readCounter(v), now))
+				}
+			}
+
+			return nil
+		})
+	}); err != nil {
+		svc.log.Error().Err(err).Msg("Failed to read quota usage")
+	}
+
+	return usgs
+}
+
+// add adds the amount measured for each of the quotas that apply to the
+// account and runner to the counter of its window holding t
+func (svc *quotaService) add(rnr string, acct string, t time.Time, amt func(models.Quota) float64) {
+	if err := svc.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(quotaBucket)
+		for _, q := range svc.s.Quotas.Limits {
+			n := amt(q)
+			if n == 0 || !q.Applies(rnr, acct) {
+				continue
+			}
+
+			key := quotaKey(q.Name, acct)
+			cnt := readCounter(bkt.Get(key))
+			if start := q.Start(t); !cnt.start.Equal(start) {
+				cnt = quotaCounter{start: start}
+			}
+			cnt.used += n
+
+			if err := bkt.Put(key, cnt.bytes()); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		svc.log.Error().
+			Err(err).
+			Str("account", acct).
+			Str("runner", rnr).
+			Msg("Failed to count usage toward quotas")
+	}
+}
+
+// account returns the account usage is counted toward, which is the value of
+// the quota claim (when configured and held by the token) or the subject
+func (svc *quotaService) account(clms models.Claims) string {
+	if clm := svc.s.Quotas.Claim; clm != "" {
+		if vals := clms.Values(clm); len(vals) > 0 {
+			return vals[0]
+		}
+	}
+
+	return clms.Subject()
+}
+
+// quotaUsage returns the usage of a quota in the window holding now
+func (svc *quotaService) quotaUsage(q models.Quota, acct string, cnt quotaCounter, now time.Time) models.QuotaUsage {
+	start := q.Start(now)
+	if !cnt.start.Equal(start) {
+		cnt.used = 0
+	}
+
+	return models.QuotaUsage{
+		Account:  acct,
+		Exceeded: cnt.used >= q.Limit,
+		Limit:    q.Limit,
+		Metric:   q.Metric,
+		Name:     q.Name,
+		ResetsAt: start.Add(q.Window),
+		Used:     cnt.used,
+		Window:   q.Window.String(),
+	}
+}
+
+// usage returns the usage of the account toward the quotas selected
+func (svc *quotaService) usage(now time.Time, sel func(models.Quota) bool, acct string) []models.QuotaUsage {
+	usgs := []models.QuotaUsage{}
+	if err := svc.db.View(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(quotaBucket)
+		for _, q := range svc.s.Quotas.Limits {
+			if sel(q) {
+				usgs = append(usgs, svc.quotaUsage(q, acct, readCounter(bkt.Get(quotaKey(q.Name, acct))), now))
+			}
+		}
+
+		return nil
+	}); err != nil {
+		svc.log.Error().
+			Err(err).
+			Str("account", acct).
+			Msg("Failed to read quota usage")
+	}
+
+	return usgs
+}
+
+func (c quotaCounter) bytes() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, uint64(c.start.Unix()))
+	binary.BigEndian.PutUint64(b[8:], math.Float64bits(c.used))
+
+	return b
+}
+
+// quotaKey is the database key of the counter for a quota and account
+func quotaKey(nm string, acct string) []byte {
+	return []byte(nm + "\x00" + acct)
+}
+
+func readCounter(b []byte) quotaCounter {
+	if len(b) != 16 {
+		return quotaCounter{}
+	}
+
+	return quotaCounter{
+		start: time.Unix(int64(binary.BigEndian.Uint64(b)), 0).UTC(),
+		used:  math.Float64frombits(binary.BigEndian.Uint64(b[8:])),
+	}
+}
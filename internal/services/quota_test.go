@@ -0,0 +1,154 @@
+package services
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// newTestQuotaService returns a quota service for the quotas, counting
+// toward a database in a temporary directory
+func newTestQuotaService(t *testing.T, qs ...models.Quota) *quotaService {
+	t.Helper()
+
+	s := &models.Settings{}
+	s.Quotas.Limits = qs
+	s.Quotas.Path = filepath.Join(t.TempDir(), "quotas.db")
+
+	svc, err := NewQuotaService(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.db.Close() })
+
+	return svc
+}
+
+func TestQuotaWindow(t *testing.T) {
+	tests := []struct {
+		name  string
+		wndw  time.Duration
+		t     time.Time
+		start time.Time
+		reset time.Time
+	}{
+		{
+			name:  "hourly",
+			wndw:  time.Hour,
+			t:     time.Date(2026, 3, 5, 13, 45, 10, 0, time.UTC),
+			start: time.Date(2026, 3, 5, 13, 0, 0, 0, time.UTC),
+			reset: time.Date(2026, 3, 5, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "hourly on the hour",
+			wndw:  time.Hour,
+			t:     time.Date(2026, 3, 5, 13, 0, 0, 0, time.UTC),
+			start: time.Date(2026, 3, 5, 13, 0, 0, 0, time.UTC),
+			reset: time.Date(2026, 3, 5, 14, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "hourly in a half hour zone",
+			wndw:  time.Hour,
+			t:     time.Date(2026, 3, 5, 13, 45, 10, 0, time.FixedZone("IST", 5*60*60+30*60)),
+			start: time.Date(2026, 3, 5, 8, 0, 0, 0, time.UTC),
+			reset: time.Date(2026, 3, 5, 9, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "daily",
+			wndw:  24 * time.Hour,
+			t:     time.Date(2026, 3, 5, 13, 45, 10, 0, time.UTC),
+			start: time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC),
+			reset: time.Date(2026, 3, 6, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "daily at midnight UTC in another zone",
+			wndw:  24 * time.Hour,
+			t:     time.Date(2026, 3, 5, 1, 30, 0, 0, time.FixedZone("PKT", 5*60*60)),
+			start: time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC),
+			reset: time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			name:  "weekly from Thursday",
+			wndw:  7 * 24 * time.Hour,
+			t:     time.Date(2026, 3, 4, 13, 45, 10, 0, time.UTC),
+			start: time.Date(2026, 2, 26, 0, 0, 0, 0, time.UTC),
+			reset: time.Date(2026, 3, 5, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := models.Quota{Limit: 1, Metric: models.MetricRequests, Name: "q", Window: tt.wndw}
+			if got := q.Start(tt.t); !got.Equal(tt.start) {
+				t.Errorf("Start() = %s, want %s", got, tt.start)
+			}
+
+			svc := &quotaService{}
+			if got := svc.quotaUsage(q, "alice", quotaCounter{}, tt.t).ResetsAt; !got.Equal(tt.reset) {
+				t.Errorf("ResetsAt = %s, want %s", got, tt.reset)
+			}
+		})
+	}
+}
+
+func TestEnforceQuotas(t *testing.T) {
+	svc := newTestQuotaService(t,
+		models.Quota{Limit: 2, Metric: models.MetricRequests, Name: "requests", Window: 24 * time.Hour},
+		models.Quota{Limit: 100, Metric: models.MetricTotalTokens, Name: "tokens", Window: 24 * time.Hour},
+	)
+
+	// the handler records the usage counted while the runner responds, and
+	// fails the request, which counts all the same
+	var used map[string]float64
+	hndlr := svc.EnforceQuotas(models.Runner{Name: "ollama"}, func(ctx *fasthttp.RequestCtx) {
+		used = map[string]float64{}
+		for _, usg := range svc.Quotas("alice") {
+			used[usg.Name] = usg.Used
+		}
+
+		ctx.SetStatusCode(fasthttp.StatusBadGateway)
+	})
+
+	tests := []struct {
+		name string
+		code int
+		used map[string]float64
+	}{
+		{name: "first request", code: fasthttp.StatusBadGateway, used: map[string]float64{"requests": 1, "tokens": 0}},
+		{name: "last request", code: fasthttp.StatusBadGateway, used: map[string]float64{"requests": 2, "tokens": 0}},
+		{name: "quota spent", code: fasthttp.StatusTooManyRequests},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			used = nil
+
+			ctx := &fasthttp.RequestCtx{}
+			models.SetContextClaims(ctx, models.Claims{"sub": "alice"})
+			hndlr(ctx)
+
+			if code := ctx.Response.StatusCode(); code != tt.code {
+				t.Errorf("status = %d, want %d", code, tt.code)
+			}
+
+			if len(used) != len(tt.used) {
+				t.Fatalf("used = %v, want %v", used, tt.used)
+			}
+			for nm, n := range tt.used {
+				if used[nm] != n {
+					t.Errorf("used %s = %v, want %v", nm, used[nm], n)
+				}
+			}
+		})
+	}
+
+	// the rejected request is not counted
+	for _, usg := range svc.Quotas("alice") {
+		if usg.Name == "requests" && usg.Used != 2 {
+			t.Errorf("used requests = %v, want 2", usg.Used)
+		}
+	}
+}
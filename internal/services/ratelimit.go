@@ -0,0 +1,320 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+// buckets that have refilled are removed at most this often, so that clients
+// (i.e. IP addresses) seen once are not held indefinitely
+const rateLimitSweep = time.Minute
+
+// rate limit response headers (draft-ietf-httpapi-ratelimit-headers)
+const (
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitPolicy    = "RateLimit-Policy"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+)
+
+// rate limit scopes, reported when a request is rejected
+const (
+	rateScopeGlobal  = "global"
+	rateScopeIP      = "ip"
+	rateScopeRunner  = "runner"
+	rateScopeSubject = "subject"
+)
+
+// rateLimitService limits the rate of requests (using token buckets) across
+// the gateway, per client IP address, per runner and per token subject
+type rateLimitService struct {
+	glbl *bucketSet
+	ips  *bucketSet
+	log  zerolog.Logger
+	rnrs *bucketSet
+	s    *models.Settings
+	sbjs *bucketSet
+}
+
+// bucketSet holds a token bucket for each key limited (i.e. each subject)
+type bucketSet struct {
+	bkts  map[string]*tokenBucket
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// rateDecision is the outcome of taking a request from a bucket
+type rateDecision struct {
+	ok    bool
+	remn  int
+	reset time.Duration
+	retry time.Duration
+	rl    models.RateLimit
+	scope string
+}
+
+// tokenBucket holds the requests available to a key, as of the last request
+type tokenBucket struct {
+	last   time.Time
+	rl     models.RateLimit
+	tokens float64
+}
+
+// NewRateLimitService validates the rate limits configured for the gateway
+func NewRateLimitService(s *models.Settings) (*rateLimitService, error) {
+	rls := map[string]models.RateLimit{
+		rateScopeGlobal:  s.RateLimits.Global,
+		rateScopeIP:      s.RateLimits.IP,
+		rateScopeRunner:  s.RateLimits.Runner,
+		rateScopeSubject: s.RateLimits.Subject,
+	}
+	for scope, rl := range rls {
+		if err := rl.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s rate limit: %w", scope, err)
+		}
+	}
+
+	if s.RateLimits.TrustedProxies < 0 {
+		return nil, fmt.Errorf("rate limit trusted proxies must not be negative")
+	}
+
+	return &rateLimitService{
+		glbl: newBucketSet(),
+		ips:  newBucketSet(),
+		log:  log.With().Str("service", "ratelimit").Logger(),
+		rnrs: newBucketSet(),
+		s:    s,
+		sbjs: newBucketSet(),
+	}, nil
+}
+
+// LimitClients limits the rate of requests per client IP address and across
+// the gateway before calling next... it is applied ahead of authorization, so
+// that clients guessing tokens are turned away cheaply
+func (svc *rateLimitService) LimitClients(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	glbl := svc.s.RateLimits.Global
+	ip := svc.s.RateLimits.IP
+	if !glbl.Enabled() && !ip.Enabled() {
+		return next
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		now := time.Now()
+		dcsns := []rateDecision{}
+
+		if ip.Enabled() {
+			dcsn := svc.ips.take(clientIP(ctx, svc.s.RateLimits.IPHeader, svc.s.RateLimits.TrustedProxies), ip, now)
+			dcsn.scope = rateScopeIP
+			if !svc.admit(ctx, dcsn) {
+				return
+			}
+			dcsns = append(dcsns, dcsn)
+		}
+
+		if glbl.Enabled() {
+			dcsn := svc.glbl.take("", glbl, now)
+			dcsn.scope = rateScopeGlobal
+			if !svc.admit(ctx, dcsn) {
+				return
+			}
+			dcsns = append(dcsns, dcsn)
+		}
+
+		next(ctx)
+		setRateLimitHeaders(ctx, dcsns...)
+	}
+}
+
+// LimitRunner limits the rate of requests to the runner and per token subject
+// (when the token holds the rate limit claim, it takes the place of the
+// subject rate limit configured) before calling next
+func (svc *rateLimitService) LimitRunner(rnr models.Runner, next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	rrl := svc.s.RateLimits.Runner
+	if rnr.RateLimit.Enabled() {
+		rrl = rnr.RateLimit
+	}
+
+	if !rrl.Enabled() && !svc.s.RateLimits.Subject.Enabled() && svc.s.RateLimits.Claim == "" {
+		return next
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		now := time.Now()
+		dcsns := []rateDecision{}
+
+		// tokens without a subject are limited individually
+		clms := models.ContextClaims(ctx)
+		if srl := svc.subjectLimit(ctx, clms); srl.Enabled() || srl.Denies() {
+			dcsn := svc.sbjs.take(clms.Key(), srl, now)
+			dcsn.scope = rateScopeSubject
+			if !svc.admit(ctx, dcsn) {
+				return
+			}
+			dcsns = append(dcsns, dcsn)
+		}
+
+		if rrl.Enabled() {
+			dcsn := svc.rnrs.take(rnr.Key(), rrl, now)
+			dcsn.scope = rateScopeRunner
+			if !svc.admit(ctx, dcsn) {
+				return
+			}
+			dcsns = append(dcsns, dcsn)
+		}
+
+		next(ctx)
+		setRateLimitHeaders(ctx, dcsns...)
+	}
+}
+
+// admit responds with 429 Too Many Requests when the request was not
+// permitted by the rate limit
+func (svc *rateLimitService) admit(ctx *fasthttp.RequestCtx, dcsn rateDecision) bool {
+	if dcsn.ok {
+		return true
+	}
+
+	models.RequestLogger(ctx, svc.log).Warn().
+		Str("ip", ctx.RemoteIP().String()).
+		Str("path", string(ctx.Path())).
+		Str("scope", dcsn.scope).
+		Str("subject", models.ContextClaims(ctx).Subject()).
+		Msg("Rate limit exceeded, rejected request")
+
+	b, _ := json.Marshal(map[string]string{
+		"error": "rate limit exceeded",
+		"scope": dcsn.scope,
+	})
+
+	ctx.SetStatusCode(fasthttp.StatusTooManyRequests)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(b)
+	setRateLimitHeaders(ctx, dcsn)
+	ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(ceilSeconds(dcsn.retry)))
+
+	return false
+}
+
+// subjectLimit returns the rate limit held by the token claim (which denies
+// every request when it permits none), or the subject rate limit configured
+func (svc *rateLimitService) subjectLimit(ctx *fasthttp.RequestCtx, clms models.Claims) models.RateLimit {
+	if clm := svc.s.RateLimits.Claim; clm != "" {
+		if vals := clms.Values(clm); len(vals) > 0 {
+			rl, err := models.ParseRateLimit(vals[0])
+			if err == nil {
+				return rl
+			}
+
+			models.RequestLogger(ctx, svc.log).Warn().
+				Err(err).
+				Str("claim", clm).
+				Str("subject", clms.Subject()).
+				Msg("Invalid rate limit claim, using the subject rate limit")
+		}
+	}
+
+	return svc.s.RateLimits.Subject
+}
+
+func newBucketSet() *bucketSet {
+	return &bucketSet{bkts: map[string]*tokenBucket{}}
+}
+
+// take removes a request from the bucket for the key, after refilling it for
+// the time passed since the last request
+func (bs *bucketSet) take(key string, rl models.RateLimit, now time.Time) rateDecision {
+	// a rate limit permitting no requests never refills
+	if rl.Denies() {
+		return rateDecision{reset: rl.Window, retry: rl.Window, rl: rl}
+	}
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+
+	if now.Sub(bs.swept) >= rateLimitSweep {
+		for k, b := range bs.bkts {
+			if b.available(now) >= b.rl.Capacity() {
+				delete(bs.bkts, k)
+			}
+		}
+		bs.swept = now
+	}
+
+	b, ok := bs.bkts[key]
+	if !ok {
+		b = &tokenBucket{last: now, rl: rl, tokens: rl.Capacity()}
+		bs.bkts[key] = b
+	}
+
+	// the rate limit may differ from the last request (i.e. a new token)
+	b.rl = rl
+	b.tokens = b.available(now)
+	b.last = now
+
+	dcsn := rateDecision{rl: rl}
+	if b.tokens >= 1 {
+		b.tokens--
+		dcsn.ok = true
+	} else {
+		dcsn.retry = rateDuration(1-b.tokens, rl)
+	}
+
+	dcsn.remn = int(b.tokens)
+	dcsn.reset = rateDuration(rl.Capacity()-b.tokens, rl)
+
+	return dcsn
+}
+
+// available returns the requests in the bucket at now, up to its capacity
+func (b *tokenBucket) available(now time.Time) float64 {
+	return math.Min(b.rl.Capacity(), b.tokens+now.Sub(b.last).Seconds()*b.rl.Rate())
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// rateDuration returns the time taken to refill the requests given
+func rateDuration(reqs float64, rl models.RateLimit) time.Duration {
+	return time.Duration(reqs / rl.Rate() * float64(time.Second))
+}
+
+// setRateLimitHeaders reports the most restrictive of the rate limits applied
+// to the request, unless a more restrictive one has been reported already
+func setRateLimitHeaders(ctx *fasthttp.RequestCtx, dcsns ...rateDecision) {
+	if len(dcsns) == 0 {
+		return
+	}
+
+	dcsn := dcsns[0]
+	for _, d := range dcsns[1:] {
+		if d.remn < dcsn.remn {
+			dcsn = d
+		}
+	}
+
+	if cur := ctx.Response.Header.Peek(headerRateLimitRemaining); len(cur) > 0 {
+		if remn, err := strconv.Atoi(string(cur)); err == nil && remn <= dcsn.remn {
+			return
+		}
+	}
+
+	plcy := fmt.Sprintf("%d;w=%d", dcsn.rl.Requests, ceilSeconds(dcsn.rl.Window))
+	if dcsn.rl.Burst > 0 {
+		plcy += fmt.Sprintf(";burst=%d", dcsn.rl.Burst)
+	}
+
+	ctx.Response.Header.Set(headerRateLimitLimit, strconv.Itoa(dcsn.rl.Requests))
+	ctx.Response.Header.Set(headerRateLimitPolicy, plcy)
+	ctx.Response.Header.Set(headerRateLimitRemaining, strconv.Itoa(dcsn.remn))
+	ctx.Response.Header.Set(headerRateLimitReset, strconv.Itoa(ceilSeconds(dcsn.reset)))
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+func TestBucketSetTake(t *testing.T) {
+	type take struct {
+		after time.Duration
+		ok    bool
+		remn  int
+		reset time.Duration
+		retry time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		rl    models.RateLimit
+		takes []take
+	}{
+		{
+			name: "denies",
+			rl:   models.RateLimit{Window: time.Minute},
+			takes: []take{
+				{reset: time.Minute, retry: time.Minute},
+				{after: 2 * time.Minute, reset: time.Minute, retry: time.Minute},
+			},
+		},
+		{
+			name: "exhausted",
+			rl:   models.RateLimit{Requests: 2, Window: time.Second},
+			takes: []take{
+				{ok: true, remn: 1, reset: 500 * time.Millisecond},
+				{ok: true, reset: time.Second},
+				{reset: time.Second, retry: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "refilled after window",
+			rl:   models.RateLimit{Requests: 2, Window: time.Second},
+			takes: []take{
+				{ok: true, remn: 1, reset: 500 * time.Millisecond},
+				{ok: true, reset: time.Second},
+				{reset: time.Second, retry: 500 * time.Millisecond},
+				{after: time.Second, ok: true, remn: 1, reset: 500 * time.Millisecond},
+				{after: time.Second, ok: true, reset: time.Second},
+				{after: time.Second, reset: time.Second, retry: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "refilled in part",
+			rl:   models.RateLimit{Requests: 2, Window: time.Second},
+			takes: []take{
+				{ok: true, remn: 1, reset: 500 * time.Millisecond},
+				{ok: true, reset: time.Second},
+				{after: 500 * time.Millisecond, ok: true, reset: time.Second},
+				{after: 500 * time.Millisecond, reset: time.Second, retry: 500 * time.Millisecond},
+			},
+		},
+		{
+			name: "burst",
+			rl:   models.RateLimit{Burst: 2, Requests: 60, Window: time.Minute},
+			takes: []take{
+				{ok: true, remn: 1, reset: time.Second},
+				{ok: true, reset: 2 * time.Second},
+				{reset: 2 * time.Second, retry: time.Second},
+				{after: time.Minute, ok: true, remn: 1, reset: time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := newBucketSet()
+			now := time.Now()
+
+			for i, tk := range tt.takes {
+				dcsn := bs.take("sub", tt.rl, now.Add(tk.after))
+				if dcsn.ok != tk.ok || dcsn.remn != tk.remn || dcsn.reset != tk.reset || dcsn.retry != tk.retry {
+					t.Errorf("take %d = ok %t, remaining %d, reset %s, retry %s, want ok %t, remaining %d, reset %s, retry %s",
+						i, dcsn.ok, dcsn.remn, dcsn.reset, dcsn.retry, tk.ok, tk.remn, tk.reset, tk.retry)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package services
+
+import (
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"go.jtlabs.io/runner-gateway/internal/interfaces"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+const readyCheck = "ok"
+
+type readinessService struct {
+	as  interfaces.AuthorizationService
+	gs  interfaces.GatewayService
+	log zerolog.Logger
+	s   *models.Settings
+	ts  *tlsService
+}
+
+func NewReadinessService(s *models.Settings, as interfaces.AuthorizationService, gs interfaces.GatewayService, ts *tlsService) *readinessService {
+	return &readinessService{
+		as:  as,
+		gs:  gs,
+		log: log.With().Str("service", "readiness").Logger(),
+		s:   s,
+		ts:  ts,
+	}
+}
+
+// Readiness reports whether the gateway is ready to serve requests... the
+// settings are loaded, the token keys were read, the TLS certificate (when
+// configured) is valid and at least one runner has a healthy host
+func (svc *readinessService) Readiness() models.Readiness {
+	rdy := models.Readiness{
+		Checks:  map[string]string{},
+		Ready:   true,
+		Runners: []models.RunnerHealth{},
+	}
+
+	fail := func(chk string, rsn string) {
+		rdy.Checks[chk] = rsn
+		rdy.Ready = false
+	}
+
+	if svc.s == nil {
+		fail("settings", "settings are not loaded")
+	} else {
+		rdy.Checks["settings"] = readyCheck
+	}
+
+	if err := svc.as.VerifyKeys(); err != nil {
+		fail("keys", err.Error())
+	} else {
+		rdy.Checks["keys"] = readyCheck
+	}
+
+	switch {
+	case svc.s != nil && svc.s.Server.CertificatePath == "":
+		rdy.Checks["tls"] = "disabled"
+	default:
+		if err := svc.ts.Verify(); err != nil {
+			fail("tls", err.Error())
+		} else {
+			rdy.Checks["tls"] = readyCheck
+		}
+	}
+
+	rdy.Runners = append(rdy.Runners, svc.gs.Health()...)
+	rdy.Checks["runners"] = "no healthy runners"
+	for _, rh := range rdy.Runners {
+		if rh.Healthy {
+			rdy.Checks["runners"] = readyCheck
+			break
+		}
+	}
+
+	if rdy.Checks["runners"] != readyCheck {
+		rdy.Ready = false
+	}
+
+	if !rdy.Ready {
+		svc.log.Debug().
+			Interface("checks", rdy.Checks).
+			Msg("Gateway is not ready")
+	}
+
+	return rdy
+}
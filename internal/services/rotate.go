@@ -0,0 +1,134 @@
+package services
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rotated files are named for the time they were rotated, so that they sort
+// in the order they were written
+const rotateTimeFormat = "20060102T150405.000"
+
+// rotatingFile appends to a file, which is rotated (renamed with the time it
+// was rotated) once it reaches the size limit or has been written to for the
+// rotation interval... only the most recent rotated files are kept, when a
+// limit is set
+type rotatingFile struct {
+	f       *os.File
+	intvl   time.Duration
+	maxBaks int
+	maxSize int64
+	mu      sync.Mutex
+	opened  time.Time
+	path    string
+	size    int64
+}
+
+func newRotatingFile(pth string, maxSize int64, intvl time.Duration, maxBaks int) (*rotatingFile, error) {
+	rf := &rotatingFile{
+		intvl:   intvl,
+		maxBaks: maxBaks,
+		maxSize: maxSize,
+		path:    pth,
+	}
+
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.f.Close()
+}
+
+// Write appends p to the file, rotating the file first when p would take it
+// beyond the size limit or the rotation interval has passed
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	// records are still written to the file when it cannot be rotated
+	var rerr error
+	full := rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize
+	due := rf.intvl > 0 && time.Since(rf.opened) >= rf.intvl
+	if full || due {
+		rerr = rf.rotate()
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	if err == nil {
+		err = rerr
+	}
+
+	return n, err
+}
+
+// open opens the file for appending, continuing from its current size (the
+// rotation interval begins when the file is opened)
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.f = f
+	rf.opened = time.Now()
+	rf.size = fi.Size()
+
+	return nil
+}
+
+// prune removes the oldest rotated files beyond the limit
+func (rf *rotatingFile) prune() error {
+	if rf.maxBaks <= 0 {
+		return nil
+	}
+
+	baks, err := filepath.Glob(rf.path + ".*")
+	if err != nil {
+		return err
+	}
+
+	sort.Strings(baks)
+	for len(baks) > rf.maxBaks {
+		if err := os.Remove(baks[0]); err != nil {
+			return err
+		}
+		baks = baks[1:]
+	}
+
+	return nil
+}
+
+// rotate renames the file and opens a new one in its place (which must be
+// called holding the lock)
+func (rf *rotatingFile) rotate() error {
+	rf.f.Close()
+
+	// the file is reopened in place when it cannot be renamed
+	err := os.Rename(rf.path, rf.path+"."+time.Now().Format(rotateTimeFormat))
+	if oerr := rf.open(); oerr != nil {
+		return oerr
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return rf.prune()
+}
@@ -2,6 +2,11 @@ package services
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -9,8 +14,10 @@ import (
 )
 
 type tlsService struct {
-	log zerolog.Logger
-	s   *models.Settings
+	crts []tls.Certificate
+	log  zerolog.Logger
+	mu   sync.Mutex
+	s    *models.Settings
 }
 
 func NewTLSService(s *models.Settings) *tlsService {
@@ -20,6 +27,9 @@ func NewTLSService(s *models.Settings) *tlsService {
 	}
 }
 
+// Configuration loads the server certificate along with any additional
+// certificates... the certificate presented is selected by the TLS SNI name,
+// and the server certificate is presented when no other certificate matches
 func (svc *tlsService) Configuration() (*tls.Config, error) {
 	svc.log.Trace().Msg("Creating TLS configuration")
 	crt, err := svc.LoadCertificate()
@@ -27,23 +37,118 @@ func (svc *tlsService) Configuration() (*tls.Config, error) {
 		return nil, err
 	}
 
+	crts := []tls.Certificate{crt}
+	for _, c := range svc.s.Server.Certificates {
+		crt, err := svc.loadCertificate(c.CertificatePath, c.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+
+		crts = append(crts, crt)
+	}
+
+	// retain the certificates served so that they can be verified
+	svc.mu.Lock()
+	svc.crts = crts
+	svc.mu.Unlock()
+
+	svc.checkHostnames(crts)
+
 	return &tls.Config{
-		Certificates: []tls.Certificate{
-			crt,
-		},
+		Certificates: crts,
 	}, nil
 }
 
 func (svc *tlsService) LoadCertificate() (tls.Certificate, error) {
+	return svc.loadCertificate(svc.s.Server.CertificatePath, svc.s.Server.KeyPath)
+}
+
+// Verify ensures the certificates being served (loading them when they have
+// not been) are within their validity period
+func (svc *tlsService) Verify() error {
+	svc.mu.Lock()
+	crts := svc.crts
+	svc.mu.Unlock()
+
+	if crts == nil {
+		crt, err := svc.LoadCertificate()
+		if err != nil {
+			return err
+		}
+
+		crts = []tls.Certificate{crt}
+	}
+
+	now := time.Now()
+	for _, crt := range crts {
+		leaf, err := certificateLeaf(crt)
+		if err != nil {
+			return err
+		}
+
+		if now.Before(leaf.NotBefore) {
+			return fmt.Errorf("certificate for %s is not valid until %s", leaf.Subject.CommonName, leaf.NotBefore.Format(time.RFC3339))
+		}
+
+		if now.After(leaf.NotAfter) {
+			return fmt.Errorf("certificate for %s expired at %s", leaf.Subject.CommonName, leaf.NotAfter.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// checkHostnames warns of any runner hostnames that none of the certificates
+// are valid for, as clients will reject the connection
+func (svc *tlsService) checkHostnames(crts []tls.Certificate) {
+	for _, rnr := range svc.s.Runners {
+		for _, hst := range rnr.Hostnames {
+			// a wildcard hostname is checked with a name it matches
+			name := models.NormalizeHostname(hst)
+			if len(name) > 1 && name[0] == '*' {
+				name = "host" + name[1:]
+			}
+
+			ok := false
+			for _, crt := range crts {
+				if leaf, err := certificateLeaf(crt); err == nil && leaf.VerifyHostname(name) == nil {
+					ok = true
+					break
+				}
+			}
+
+			if !ok {
+				svc.log.Warn().
+					Str("hostname", hst).
+					Str("runner", rnr.Name).
+					Msg("No TLS certificate is valid for runner hostname")
+			}
+		}
+	}
+}
+
+func (svc *tlsService) loadCertificate(crtPth string, keyPth string) (tls.Certificate, error) {
 	svc.log.Trace().
-		Str("certPath", svc.s.Server.CertificatePath).
-		Str("keyPath", svc.s.Server.KeyPath).
+		Str("certPath", crtPth).
+		Str("keyPath", keyPth).
 		Msg("Loading TLS certificate")
 
-	crt, err := tls.LoadX509KeyPair(svc.s.Server.CertificatePath, svc.s.Server.KeyPath)
+	crt, err := tls.LoadX509KeyPair(crtPth, keyPth)
 	if err != nil {
 		return crt, err
 	}
 
 	return crt, nil
 }
+
+func certificateLeaf(crt tls.Certificate) (*x509.Certificate, error) {
+	if crt.Leaf != nil {
+		return crt.Leaf, nil
+	}
+
+	if len(crt.Certificate) == 0 {
+		return nil, errors.New("certificate is empty")
+	}
+
+	return x509.ParseCertificate(crt.Certificate[0])
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/valyala/fasthttp"
+	"go.jtlabs.io/runner-gateway/internal/models"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultServiceName   = "runner-gateway"
+	serverSpanKey        = "serverSpan"
+	traceShutdownTimeout = 5 * time.Second
+	tracerName           = "go.jtlabs.io/runner-gateway"
+)
+
+// gateway span attributes (those without a semantic convention)
+const (
+	attrAuthFailure = attribute.Key("gateway.auth_failure")
+	attrPriority    = attribute.Key("gateway.priority")
+	attrQueueWait   = attribute.Key("gateway.queue_wait_ms")
+	attrRequestID   = attribute.Key("gateway.request_id")
+	attrRunner      = attribute.Key("gateway.runner")
+)
+
+// tracer creates the gateway spans... spans are not recorded (though the
+// inbound trace headers are still forwarded) until tracing is configured
+var tracer = otel.Tracer(tracerName)
+
+// tracingService exports the spans of each request to the configured
+// exporter (an OTLP/HTTP collector, a file or stdout)
+type tracingService struct {
+	f   *os.File
+	log zerolog.Logger
+	s   *models.Settings
+	tp  *sdktrace.TracerProvider
+}
+
+// serverSpan is the span of a request in progress... the span ends once the
+// request has been handled and, for streamed responses, once the stream has
+// ended (whichever is last)
+type serverSpan struct {
+	refs atomic.Int32
+	span trace.Span
+}
+
+// headerCarrier reads and writes the trace headers (traceparent and
+// tracestate) of a request
+type headerCarrier struct {
+	h *fasthttp.RequestHeader
+}
+
+// NewTracingService creates the exporter configured and registers the tracer
+// provider and W3C trace context propagator globally... when no exporter is
+// configured, requests are not traced
+func NewTracingService(s *models.Settings) (*tracingService, error) {
+	svc := &tracingService{
+		log: log.With().Str("service", "tracing").Logger(),
+		s:   s,
+	}
+
+	if s.Tracing.Exporter == "" {
+		return svc, nil
+	}
+
+	nm := s.Tracing.ServiceName
+	if nm == "" {
+		nm = defaultServiceName
+	}
+
+	// spans are sampled by ratio, unless the inbound trace was sampled
+	smpl := sdktrace.AlwaysSample()
+	if rto := s.Tracing.SampleRatio; rto > 0 && rto < 1 {
+		smpl = sdktrace.TraceIDRatioBased(rto)
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(nm))),
+		sdktrace.WithSampler(sdktrace.ParentBased(smpl)),
+	}
+
+	switch s.Tracing.Exporter {
+	case models.TraceExporterOTLP:
+		eopts := []otlptracehttp.Option{}
+		if ep := s.Tracing.Endpoint; ep != "" {
+			eopts = append(eopts, otlptracehttp.WithEndpointURL(ep))
+		}
+
+		if len(s.Tracing.Headers) > 0 {
+			eopts = append(eopts, otlptracehttp.WithHeaders(s.Tracing.Headers))
+		}
+
+		exp, err := otlptracehttp.New(context.Background(), eopts...)
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	case models.TraceExporterFile:
+		f, err := os.OpenFile(s.Tracing.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, err
+		}
+
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		svc.f = f
+		opts = append(opts, sdktrace.WithSyncer(exp))
+	case models.TraceExporterStdout:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, err
+		}
+
+		opts = append(opts, sdktrace.WithSyncer(exp))
+	default:
+		return nil, fmt.Errorf("unsupported trace exporter: %s (supported: %s, %s and %s)", s.Tracing.Exporter, models.TraceExporterFile, models.TraceExporterOTLP, models.TraceExporterStdout)
+	}
+
+	svc.tp = sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(svc.tp)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	svc.log.Info().
+		Str("endpoint", s.Tracing.Endpoint).
+		Str("exporter", s.Tracing.Exporter).
+		Str("serviceName", nm).
+		Msg("Tracing requests")
+
+	return svc, nil
+}
+
+// Shutdown exports any spans not yet exported and closes the exporter
+func (svc *tracingService) Shutdown() error {
+	if svc.tp == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+	defer cancel()
+
+	err := svc.tp.Shutdown(ctx)
+	if svc.f != nil {
+		svc.f.Close()
+	}
+
+	return err
+}
+
+// TraceRequest begins the span of the request (continuing the trace of the
+// inbound traceparent header, if any) and makes it available to subsequent
+// handlers, which create their spans from it... the span ends once the
+// response has been sent, which for streamed responses is after the handler
+// returns
+func (svc *tracingService) TraceRequest(next fasthttp.RequestHandler) fasthttp.RequestHandler {
+	if svc.tp == nil {
+		return next
+	}
+
+	return func(ctx *fasthttp.RequestCtx) {
+		mthd := string(ctx.Method())
+		tc := otel.GetTextMapPropagator().Extract(context.Background(), headerCarrier{&ctx.Request.Header})
+		tc, span := tracer.Start(tc, mthd,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attrRequestID.String(models.ContextRequestID(ctx)),
+				semconv.ClientAddress(ctx.RemoteIP().String()),
+				semconv.HTTPRequestMethodKey.String(mthd),
+				semconv.ServerAddress(string(ctx.Host())),
+				semconv.URLPath(string(ctx.URI().Path())),
+				semconv.UserAgentOriginal(string(ctx.UserAgent())),
+			))
+
+		ss := &serverSpan{span: span}
+		ss.refs.Store(1)
+		defer ss.release()
+
+		models.SetContextTrace(ctx, tc)
+		ctx.SetUserValue(serverSpanKey, ss)
+
+		next(ctx)
+
+		endSpan(span, ctx.Response.StatusCode(), nil)
+	}
+}
+
+// contextSpan returns the server span of the request, which is nil when the
+// request is not traced
+func contextSpan(ctx *fasthttp.RequestCtx) *serverSpan {
+	ss, _ := ctx.UserValue(serverSpanKey).(*serverSpan)
+	return ss
+}
+
+// hold delays ending the span until the response stream has ended
+func (ss *serverSpan) hold() {
+	if ss == nil {
+		return
+	}
+
+	ss.refs.Add(1)
+}
+
+// release ends the span once both the request has been handled and the
+// response stream (if any) has ended
+func (ss *serverSpan) release() {
+	if ss == nil {
+		return
+	}
+
+	if ss.refs.Add(-1) == 0 {
+		ss.span.End()
+	}
+}
+
+func (c headerCarrier) Get(key string) string {
+	return string(c.h.Peek(key))
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := []string{}
+	c.h.VisitAll(func(k, _ []byte) {
+		keys = append(keys, string(k))
+	})
+
+	return keys
+}
+
+func (c headerCarrier) Set(key string, val string) {
+	c.h.Set(key, val)
+}
+
+// endSpan records the response status (and error, if any) on the span, where
+// server errors (and errors reaching the runner) mark the span as failed
+func endSpan(span trace.Span, code int, err error) {
+	if code > 0 {
+		span.SetAttributes(semconv.HTTPResponseStatusCode(code))
+	}
+
+	switch {
+	case err != nil:
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	case code >= fasthttp.StatusInternalServerError:
+		span.SetStatus(codes.Error, fasthttp.StatusMessage(code))
+	}
+}
+
+// injectTrace sets the trace headers of the request forwarded to the runner,
+// so that the runner continues the trace from the span given
+func injectTrace(tc context.Context, req *fasthttp.Request) {
+	otel.GetTextMapPropagator().Inject(tc, headerCarrier{&req.Header})
+}
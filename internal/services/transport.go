@@ -0,0 +1,493 @@
+package services
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http/httputil"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var errUpstreamCanceled = errors.New("upstream request canceled")
+
+// upstreamTransport is a fasthttp.RoundTripper that manages its own pool of
+// runner connections. Owning the connections means an in-flight request can
+// be aborted at any point (i.e. when the client disconnects) by closing the
+// connection it was sent on, and response bodies are always streamed so that
+// they can be relayed as they arrive.
+type upstreamTransport struct {
+	calls   map[*fasthttp.Request]*upstreamCall
+	conns   map[string]*connStats
+	idle    map[string][]*upstreamConn
+	mu      sync.Mutex
+	timeout time.Duration
+}
+
+// upstreamCall tracks the connection used by an in-flight request, and the
+// reason it was canceled (reported in place of any error reading from the
+// runner)
+type upstreamCall struct {
+	canceled bool
+	cause    error
+	conn     net.Conn
+	mu       sync.Mutex
+}
+
+// connStats counts the connections to a runner host
+type connStats struct {
+	dials  uint64
+	idle   int
+	open   int
+	reuses uint64
+}
+
+type upstreamConn struct {
+	net.Conn
+	addr    string
+	br      *bufio.Reader
+	bw      *bufio.Writer
+	closed  atomic.Bool
+	idle    time.Duration
+	lastUse time.Time
+	t       *upstreamTransport
+}
+
+// upstreamBody reads a response body from a runner connection and returns
+// the connection to the pool once the body has been read in full
+type upstreamBody struct {
+	call    *upstreamCall
+	chunked bool
+	conn    *upstreamConn
+	done    bool
+	keep    bool
+	rdr     io.Reader
+	remain  int
+	t       *upstreamTransport
+}
+
+func newUpstreamTransport(timeout time.Duration) *upstreamTransport {
+	return &upstreamTransport{
+		calls:   map[*fasthttp.Request]*upstreamCall{},
+		conns:   map[string]*connStats{},
+		idle:    map[string][]*upstreamConn{},
+		timeout: timeout,
+	}
+}
+
+// Close closes the connection (once, as a canceled request and the response
+// body may both close it)
+func (c *upstreamConn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+
+	c.t.mu.Lock()
+	c.t.stats(c.addr).open--
+	c.t.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *upstreamConn) Read(b []byte) (int, error) {
+	if c.idle > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.idle)); err != nil {
+			return 0, err
+		}
+	}
+
+	return c.Conn.Read(b)
+}
+
+func (c *upstreamCall) attach(conn net.Conn) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.canceled {
+		return false
+	}
+
+	c.conn = conn
+	return true
+}
+
+// abort cancels the request for the reason given (i.e. it was preempted)
+func (c *upstreamCall) abort(cause error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.canceled {
+		return
+	}
+
+	c.canceled = true
+	c.cause = cause
+	if c.conn != nil {
+		c.conn.Close()
+	}
+}
+
+// cancel aborts the request by closing the runner connection it is using (or
+// prevents it from being sent, if it is not yet in flight)
+func (c *upstreamCall) cancel() {
+	c.abort(errUpstreamCanceled)
+}
+
+func (c *upstreamCall) detach() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.conn = nil
+	c.mu.Unlock()
+}
+
+func (c *upstreamCall) err() error {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.cause
+}
+
+func (c *upstreamCall) isCanceled() bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.canceled
+}
+
+// isDisconnected reports whether the request was canceled because the client
+// went away
+func (c *upstreamCall) isDisconnected() bool {
+	return c.err() == errUpstreamCanceled
+}
+
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+
+	// bound fixed length bodies so the connection can be reused
+	if b.remain >= 0 && len(p) > b.remain {
+		p = p[:b.remain]
+	}
+
+	n, err := b.rdr.Read(p)
+	if b.remain >= 0 {
+		b.remain -= n
+	}
+
+	switch {
+	case b.remain == 0:
+		b.finish(b.keep)
+		return n, io.EOF
+	case err == nil:
+		return n, nil
+	case errors.Is(err, io.EOF) && b.chunked:
+		b.finish(b.keep && discardTrailer(b.conn.br) == nil)
+		return n, io.EOF
+	case errors.Is(err, io.EOF) && !b.chunked && b.remain < 0:
+		// bodies without a length are read until the runner closes
+		b.finish(false)
+		return n, io.EOF
+	case errors.Is(err, io.EOF):
+		err = io.ErrUnexpectedEOF
+	}
+
+	cause := b.call.err()
+	b.finish(false)
+
+	if cause != nil {
+		return n, cause
+	}
+
+	return n, err
+}
+
+// Close is called by fasthttp when the response is released... any portion of
+// the body that was not read leaves the connection in an unknown state, so it
+// is closed rather than returned to the pool
+func (b *upstreamBody) Close() error {
+	if !b.done {
+		b.finish(false)
+	}
+
+	return nil
+}
+
+func (b *upstreamBody) finish(reuse bool) {
+	b.done = true
+	b.call.detach()
+	b.t.release(b.conn, reuse)
+}
+
+func (t *upstreamTransport) RoundTrip(hc *fasthttp.HostClient, req *fasthttp.Request, resp *fasthttp.Response) (bool, error) {
+	conn, reused, err := t.acquire(hc)
+	if err != nil {
+		return false, err
+	}
+
+	call := t.call(req)
+	if !call.attach(conn) {
+		conn.Close()
+		return false, call.err()
+	}
+
+	// write the request to the runner
+	if err := t.write(hc, conn, req); err != nil {
+		call.detach()
+		t.release(conn, false)
+
+		// stale pooled connections are safe to retry for idempotent requests
+		return reused && !call.isCanceled(), t.canceledOr(call, err)
+	}
+
+	// there is no timeout waiting for the response header (runners may take
+	// some time to load a model or evaluate a prompt), unless configured
+	dl := time.Time{}
+	if hc.ReadTimeout > 0 {
+		dl = time.Now().Add(hc.ReadTimeout)
+	}
+
+	if err := conn.SetReadDeadline(dl); err != nil {
+		call.detach()
+		t.release(conn, false)
+		return false, err
+	}
+
+	if err := resp.Header.Read(conn.br); err != nil {
+		call.detach()
+		t.release(conn, false)
+		return reused && !call.isCanceled(), t.canceledOr(call, err)
+	}
+
+	keep := !req.ConnectionClose() && !resp.ConnectionClose()
+	sc := resp.StatusCode()
+	cl := resp.Header.ContentLength()
+
+	// responses without a body release the connection right away
+	if req.Header.IsHead() || sc < fasthttp.StatusOK || sc == fasthttp.StatusNoContent || sc == fasthttp.StatusNotModified || cl == 0 {
+		resp.SkipBody = true
+		call.detach()
+		t.release(conn, keep)
+		return false, nil
+	}
+
+	// once the body begins, the idle timeout applies between each read
+	conn.idle = t.timeout
+
+	body := &upstreamBody{
+		call:   call,
+		conn:   conn,
+		keep:   keep,
+		rdr:    conn.br,
+		remain: cl,
+		t:      t,
+	}
+
+	if cl == -1 {
+		body.chunked = true
+		body.rdr = httputil.NewChunkedReader(conn.br)
+	}
+
+	resp.SetBodyStream(body, cl)
+
+	return false, nil
+}
+
+func (t *upstreamTransport) acquire(hc *fasthttp.HostClient) (*upstreamConn, bool, error) {
+	maxIdle := hc.MaxIdleConnDuration
+	if maxIdle <= 0 {
+		maxIdle = fasthttp.DefaultMaxIdleConnDuration
+	}
+
+	t.mu.Lock()
+	for conns := t.idle[hc.Addr]; len(conns) > 0; conns = t.idle[hc.Addr] {
+		conn := conns[len(conns)-1]
+		t.idle[hc.Addr] = conns[:len(conns)-1]
+
+		if time.Since(conn.lastUse) > maxIdle {
+			conn.Close()
+			continue
+		}
+
+		t.stats(hc.Addr).reuses++
+		t.mu.Unlock()
+		return conn, true, nil
+	}
+	t.mu.Unlock()
+
+	conn, err := t.dial(hc)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return conn, false, nil
+}
+
+func (t *upstreamTransport) call(req *fasthttp.Request) *upstreamCall {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.calls[req]
+}
+
+func (t *upstreamTransport) canceledOr(call *upstreamCall, err error) error {
+	if cause := call.err(); cause != nil {
+		return cause
+	}
+
+	return err
+}
+
+func (t *upstreamTransport) dial(hc *fasthttp.HostClient) (*upstreamConn, error) {
+	dl := hc.Dial
+	if dl == nil {
+		dl = fasthttp.Dial
+	}
+
+	conn, err := dl(hc.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if hc.IsTLS {
+		cfg := &tls.Config{}
+		if hc.TLSConfig != nil {
+			cfg = hc.TLSConfig.Clone()
+		}
+
+		if cfg.ServerName == "" {
+			if hst, _, err := net.SplitHostPort(hc.Addr); err == nil {
+				cfg.ServerName = hst
+			}
+		}
+
+		conn = tls.Client(conn, cfg)
+	}
+
+	uc := &upstreamConn{
+		Conn: conn,
+		addr: hc.Addr,
+		t:    t,
+	}
+
+	t.mu.Lock()
+	st := t.stats(hc.Addr)
+	st.dials++
+	st.open++
+	t.mu.Unlock()
+	uc.br = bufio.NewReader(uc)
+	uc.bw = bufio.NewWriter(uc)
+
+	return uc, nil
+}
+
+// connections returns the connection counts for each runner host
+func (t *upstreamTransport) connections() map[string]connStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	conns := map[string]connStats{}
+	for addr, st := range t.conns {
+		cs := *st
+		cs.idle = len(t.idle[addr])
+		conns[addr] = cs
+	}
+
+	return conns
+}
+
+// release returns the connection to the idle pool, or closes it
+func (t *upstreamTransport) release(conn *upstreamConn, reuse bool) {
+	if !reuse {
+		conn.Close()
+		return
+	}
+
+	conn.idle = 0
+	conn.lastUse = time.Now()
+
+	t.mu.Lock()
+	t.idle[conn.addr] = append(t.idle[conn.addr], conn)
+	t.mu.Unlock()
+}
+
+// stats returns the connection counts for the runner host (which must be
+// called holding the transport lock)
+func (t *upstreamTransport) stats(addr string) *connStats {
+	st, ok := t.conns[addr]
+	if !ok {
+		st = &connStats{}
+		t.conns[addr] = st
+	}
+
+	return st
+}
+
+// track registers the request so that it can be canceled while in flight
+func (t *upstreamTransport) track(req *fasthttp.Request) *upstreamCall {
+	call := &upstreamCall{}
+
+	t.mu.Lock()
+	t.calls[req] = call
+	t.mu.Unlock()
+
+	return call
+}
+
+func (t *upstreamTransport) untrack(req *fasthttp.Request) {
+	t.mu.Lock()
+	delete(t.calls, req)
+	t.mu.Unlock()
+}
+
+func (t *upstreamTransport) write(hc *fasthttp.HostClient, conn *upstreamConn, req *fasthttp.Request) error {
+	dl := time.Time{}
+	if hc.WriteTimeout > 0 {
+		dl = time.Now().Add(hc.WriteTimeout)
+	}
+
+	if err := conn.SetWriteDeadline(dl); err != nil {
+		return err
+	}
+
+	if err := req.Write(conn.bw); err != nil {
+		return err
+	}
+
+	return conn.bw.Flush()
+}
+
+// discardTrailer consumes any trailer fields (and the final CRLF) following
+// the last chunk of a chunked body
+func discardTrailer(br *bufio.Reader) error {
+	for {
+		ln, err := br.ReadSlice('\n')
+		if err != nil {
+			return err
+		}
+
+		if len(ln) <= 2 {
+			return nil
+		}
+	}
+}
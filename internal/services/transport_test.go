@@ -0,0 +1,326 @@
+package services
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// testRunner is a runner listening on a loopback address, which answers each
+// request read from a connection with the next of its raw responses (in
+// order, across connections) and counts the connections accepted
+type testRunner struct {
+	accepted atomic.Int32
+	lstnr    net.Listener
+	resps    chan string
+}
+
+func newTestRunner(t *testing.T, resps ...string) *testRunner {
+	t.Helper()
+
+	lstnr, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &testRunner{lstnr: lstnr, resps: make(chan string, len(resps))}
+	for _, resp := range resps {
+		r.resps <- resp
+	}
+
+	go func() {
+		for {
+			conn, err := lstnr.Accept()
+			if err != nil {
+				return
+			}
+
+			r.accepted.Add(1)
+			go r.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { lstnr.Close() })
+
+	return r
+}
+
+// serve answers each request on the connection... a response ending with
+// "\x00" is sent without the marker and the connection is then held open
+// until the client closes it, and a response with "Connection: close" closes
+// the connection once written
+func (r *testRunner) serve(conn net.Conn) {
+	defer conn.Close()
+
+	br := bufio.NewReader(conn)
+	for {
+		req := fasthttp.AcquireRequest()
+		err := req.Read(br)
+		fasthttp.ReleaseRequest(req)
+		if err != nil {
+			return
+		}
+
+		resp := <-r.resps
+		if hold, ok := strings.CutSuffix(resp, "\x00"); ok {
+			conn.Write([]byte(hold))
+			io.Copy(io.Discard, conn)
+			return
+		}
+
+		if _, err := conn.Write([]byte(resp)); err != nil {
+			return
+		}
+
+		if strings.Contains(resp, "Connection: close") {
+			return
+		}
+	}
+}
+
+func (r *testRunner) client(tr *upstreamTransport) *fasthttp.HostClient {
+	return &fasthttp.HostClient{Addr: r.lstnr.Addr().String(), Transport: tr}
+}
+
+// roundTrip sends a request through the transport and reads the response
+// body in full
+func roundTrip(t *testing.T, hc *fasthttp.HostClient, tr *upstreamTransport) (int, string, error) {
+	t.Helper()
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI("http://" + hc.Addr + "/api/generate")
+	req.Header.SetMethod(fasthttp.MethodPost)
+	req.SetBodyString(`{"model":"llama3.2"}`)
+
+	tr.track(req)
+	defer tr.untrack(req)
+
+	if err := hc.Do(req, resp); err != nil {
+		return 0, "", err
+	}
+
+	if resp.BodyStream() == nil {
+		return resp.StatusCode(), string(resp.Body()), nil
+	}
+
+	b, err := io.ReadAll(resp.BodyStream())
+	return resp.StatusCode(), string(b), err
+}
+
+func TestUpstreamTransportBodies(t *testing.T) {
+	tests := []struct {
+		name   string
+		resp   string
+		want   string
+		reused bool
+	}{
+		{
+			name:   "content length",
+			resp:   "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: 11\r\n\r\n{\"ok\":true}",
+			want:   `{"ok":true}`,
+			reused: true,
+		},
+		{
+			name:   "chunked",
+			resp:   "HTTP/1.1 200 OK\r\nContent-Type: application/x-ndjson\r\nTransfer-Encoding: chunked\r\n\r\n7\r\n{\"a\":1}\r\n8\r\n\n{\"b\":2}\r\n0\r\n\r\n",
+			want:   "{\"a\":1}\n{\"b\":2}",
+			reused: true,
+		},
+		{
+			name:   "chunked with trailer",
+			resp:   "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\nX-Done: 1\r\n\r\n",
+			want:   "hello",
+			reused: true,
+		},
+		{
+			name:   "no content",
+			resp:   "HTTP/1.1 204 No Content\r\n\r\n",
+			want:   "",
+			reused: true,
+		},
+		{
+			name: "read until closed",
+			resp: "HTTP/1.1 200 OK\r\nConnection: close\r\n\r\nuntil closed",
+			want: "until closed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the runner answers the same way twice, to show whether the
+			// connection of the first request was returned to the pool
+			r := newTestRunner(t, tt.resp, tt.resp)
+			tr := newUpstreamTransport(time.Second)
+			hc := r.client(tr)
+
+			for i := 0; i < 2; i++ {
+				_, got, err := roundTrip(t, hc, tr)
+				if err != nil {
+					t.Fatalf("request %d: unexpected error: %v", i, err)
+				}
+
+				if got != tt.want {
+					t.Errorf("request %d: body = %q, want %q", i, got, tt.want)
+				}
+			}
+
+			st := tr.connections()[hc.Addr]
+			wantDials := uint64(2)
+			if tt.reused {
+				wantDials = 1
+			}
+
+			if st.dials != wantDials {
+				t.Errorf("dials = %d, want %d", st.dials, wantDials)
+			}
+
+			if got := r.accepted.Load(); got != int32(wantDials) {
+				t.Errorf("runner accepted %d connections, want %d", got, wantDials)
+			}
+		})
+	}
+}
+
+func TestUpstreamTransportPartialRead(t *testing.T) {
+	body := strings.Repeat("x", 64)
+	resp := "HTTP/1.1 200 OK\r\nContent-Length: 64\r\n\r\n" + body
+	r := newTestRunner(t, resp, resp)
+	tr := newUpstreamTransport(time.Second)
+	hc := r.client(tr)
+
+	// the first response is released with most of its body unread
+	req := fasthttp.AcquireRequest()
+	req.SetRequestURI("http://" + hc.Addr + "/api/generate")
+	res := fasthttp.AcquireResponse()
+	tr.track(req)
+	if err := hc.Do(req, res); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(res.BodyStream(), buf); err != nil {
+		t.Fatalf("unexpected error reading body: %v", err)
+	}
+	tr.untrack(req)
+	fasthttp.ReleaseResponse(res)
+	fasthttp.ReleaseRequest(req)
+
+	if st := tr.connections()[hc.Addr]; st.idle != 0 || st.open != 0 {
+		t.Errorf("connection left open after a partial read: %+v", st)
+	}
+
+	// the next request is sent on a new connection and read in full
+	_, got, err := roundTrip(t, hc, tr)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if got != body {
+		t.Errorf("body = %q, want %q", got, body)
+	}
+
+	if st := tr.connections()[hc.Addr]; st.dials != 2 || st.reuses != 0 {
+		t.Errorf("dials = %d, reuses = %d, want 2 dials and no reuse", st.dials, st.reuses)
+	}
+}
+
+func TestUpstreamTransportCancel(t *testing.T) {
+	tests := []struct {
+		name string
+		resp string
+		read int
+	}{
+		{
+			name: "chunked",
+			resp: "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n7\r\n{\"a\":1}\r\n\x00",
+			read: 7,
+		},
+		{
+			name: "content length",
+			resp: "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n{\"a\":1}\x00",
+			read: 7,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRunner(t, tt.resp)
+			tr := newUpstreamTransport(time.Minute)
+			hc := r.client(tr)
+
+			req := fasthttp.AcquireRequest()
+			defer fasthttp.ReleaseRequest(req)
+			resp := fasthttp.AcquireResponse()
+			defer fasthttp.ReleaseResponse(resp)
+
+			req.SetRequestURI("http://" + hc.Addr + "/api/generate")
+			call := tr.track(req)
+			defer tr.untrack(req)
+
+			if err := hc.Do(req, resp); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			// the runner holds the body open after the first bytes, until the
+			// call is canceled mid-body
+			buf := make([]byte, tt.read)
+			if _, err := io.ReadFull(resp.BodyStream(), buf); err != nil {
+				t.Fatalf("unexpected error reading body: %v", err)
+			}
+
+			time.AfterFunc(50*time.Millisecond, call.cancel)
+
+			errc := make(chan error, 1)
+			go func() {
+				_, err := io.ReadAll(resp.BodyStream())
+				errc <- err
+			}()
+
+			select {
+			case err := <-errc:
+				if !errors.Is(err, errUpstreamCanceled) {
+					t.Errorf("error = %v, want %v", err, errUpstreamCanceled)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("read was not interrupted by the cancellation")
+			}
+
+			if !call.isDisconnected() {
+				t.Error("call not reported as disconnected")
+			}
+
+			if st := tr.connections()[hc.Addr]; st.idle != 0 || st.open != 0 {
+				t.Errorf("canceled connection left open: %+v", st)
+			}
+		})
+	}
+}
+
+func TestUpstreamTransportCancelBeforeSend(t *testing.T) {
+	r := newTestRunner(t, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	tr := newUpstreamTransport(time.Second)
+	hc := r.client(tr)
+
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI("http://" + hc.Addr + "/api/generate")
+	tr.track(req).abort(errPreempted)
+	defer tr.untrack(req)
+
+	if err := hc.Do(req, resp); !errors.Is(err, errPreempted) {
+		t.Errorf("error = %v, want %v", err, errPreempted)
+	}
+}
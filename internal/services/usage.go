@@ -0,0 +1,189 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+	"go.jtlabs.io/runner-gateway/internal/interfaces"
+	"go.jtlabs.io/runner-gateway/internal/models"
+)
+
+var usageBucket = []byte("usage")
+
+// usageService accumulates the token usage and runner time reported for each
+// request, by subject, runner and model, and counts it toward quotas... the
+// totals are kept in an embedded database (when a path is configured) so
+// they persist across restarts
+type usageService struct {
+	db   *bolt.DB
+	log  zerolog.Logger
+	mu   sync.RWMutex
+	qs   interfaces.QuotaService
+	s    *models.Settings
+	ttls map[usageKey]*models.UsageTotals
+}
+
+type usageKey struct {
+	mdl string
+	rnr string
+	sbj string
+}
+
+// NewUsageService opens the usage database and reads the totals recorded
+// previously, when a usage path is configured
+func NewUsageService(s *models.Settings, qs interfaces.QuotaService) (*usageService, error) {
+	svc := &usageService{
+		log:  log.With().Str("service", "usage").Logger(),
+		qs:   qs,
+		s:    s,
+		ttls: map[usageKey]*models.UsageTotals{},
+	}
+
+	pth := s.Usage.Path
+	if pth == "" {
+		return svc, nil
+	}
+
+	// the database is locked while open, so it cannot be shared with quotas
+	if len(s.Quotas.Limits) > 0 && (pth == s.Quotas.Path || (s.Quotas.Path == "" && pth == defaultQuotaPath)) {
+		return nil, fmt.Errorf("usage path must differ from the quota path: %s", pth)
+	}
+
+	db, err := bolt.Open(pth, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open usage database %s: %w", pth, err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		bkt, err := tx.CreateBucketIfNotExists(usageBucket)
+		if err != nil {
+			return err
+		}
+
+		return bkt.ForEach(func(_ []byte, v []byte) error {
+			ttl := &models.UsageTotals{}
+			if err := json.Unmarshal(v, ttl); err != nil {
+				return err
+			}
+
+			svc.ttls[usageKey{mdl: ttl.Model, rnr: ttl.Runner, sbj: ttl.Subject}] = ttl
+			return nil
+		})
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to read usage database %s: %w", pth, err)
+	}
+
+	svc.db = db
+	svc.log.Info().
+		Str("path", pth).
+		Int("totals", len(svc.ttls)).
+		Msg("Opened usage database")
+
+	return svc, nil
+}
+
+// Record logs the usage of a single request and adds it to the totals
+func (svc *usageService) Record(u models.Usage) {
+	svc.log.Info().
+		Str("account", u.Account).
+		Int("completionTokens", u.CompletionTokens).
+		Dur("evalDuration", u.EvalDuration).
+		Str("host", u.Host).
+		Str("model", u.Model).
+		Str("path", u.Path).
+		Int("promptTokens", u.PromptTokens).
+		Str("requestId", u.RequestID).
+		Str("runner", u.Runner).
+		Str("subject", u.Subject).
+		Dur("totalDuration", u.TotalDuration).
+		Msg("Recorded usage")
+
+	key := usageKey{mdl: u.Model, rnr: u.Runner, sbj: u.Subject}
+
+	svc.mu.Lock()
+	ttl, ok := svc.ttls[key]
+	if !ok {
+		ttl = &models.UsageTotals{Model: u.Model, Runner: u.Runner, Subject: u.Subject}
+		svc.ttls[key] = ttl
+	}
+	ttl.Add(u)
+	svc.mu.Unlock()
+
+	svc.persist(key, u)
+
+	if svc.qs != nil {
+		svc.qs.Count(u)
+	}
+}
+
+// persist adds the usage to the totals stored for the key, which are read
+// and written in a single transaction so that concurrent requests are each
+// counted
+func (svc *usageService) persist(key usageKey, u models.Usage) {
+	if svc.db == nil {
+		return
+	}
+
+	if err := svc.db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket(usageBucket)
+		k := []byte(key.sbj + "\x00" + key.rnr + "\x00" + key.mdl)
+
+		ttl := models.UsageTotals{Model: key.mdl, Runner: key.rnr, Subject: key.sbj}
+		if v := bkt.Get(k); v != nil {
+			if err := json.Unmarshal(v, &ttl); err != nil {
+				return err
+			}
+		}
+		ttl.Add(u)
+
+		b, err := json.Marshal(ttl)
+		if err != nil {
+			return err
+		}
+
+		return bkt.Put(k, b)
+	}); err != nil {
+		svc.log.Error().
+			Err(err).
+			Str("model", u.Model).
+			Str("runner", u.Runner).
+			Str("subject", u.Subject).
+			Msg("Failed to persist usage totals")
+	}
+}
+
+// Totals returns the usage accumulated for the subject (or for every subject
+// when empty), ordered by subject, runner and model
+func (svc *usageService) Totals(sbj string) []models.UsageTotals {
+	svc.mu.RLock()
+	defer svc.mu.RUnlock()
+
+	ttls := []models.UsageTotals{}
+	for key, ttl := range svc.ttls {
+		if sbj == "" || key.sbj == sbj {
+			ttls = append(ttls, *ttl)
+		}
+	}
+
+	sort.Slice(ttls, func(i, j int) bool {
+		a, b := ttls[i], ttls[j]
+		if a.Subject != b.Subject {
+			return a.Subject < b.Subject
+		}
+
+		if a.Runner != b.Runner {
+			return a.Runner < b.Runner
+		}
+
+		return a.Model < b.Model
+	})
+
+	return ttls
+}
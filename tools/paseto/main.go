@@ -156,13 +156,15 @@ func main() {
 				Msg("No token provided for validation")
 		}
 
-		if err := authSvc.ValidateToken(*tkn); err != nil {
+		parsed, err := authSvc.ValidateToken(*tkn)
+		if err != nil {
 			log.Fatal().
 				Err(err).
 				Msg("Failed to validate PASETO token")
 		}
 
 		log.Info().
+			RawJSON("claims", parsed.ClaimsJSON()).
 			Msg("PASETO token validated successfully")
 
 	default: